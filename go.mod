@@ -5,7 +5,10 @@ go 1.23.2
 require (
 	github.com/Sternisaea/dnsservermock v0.0.0-20241129120909-15f8c6bc4206
 	github.com/Sternisaea/smtpservermock v0.0.0-20241210115920-b48c8dc54b88
+	golang.org/x/crypto v0.31.0
 	golang.org/x/net v0.32.0
+	golang.org/x/term v0.27.0
+	golang.org/x/text v0.21.0
 )
 
-require golang.org/x/text v0.21.0 // indirect
+require golang.org/x/sys v0.28.0 // indirect
@@ -0,0 +1,524 @@
+package authentication
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/Sternisaea/gosend/src/types"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	testMechanisms = "PLAIN LOGIN SCRAM-SHA-1 SCRAM-SHA-256 SCRAM-SHA-256-PLUS XOAUTH2 OAUTHBEARER"
+
+	testHost  = "localhost"
+	testUser  = "user@domain.local"
+	testPass  = "MySecret"
+	testToken = "ya29.token"
+)
+
+var (
+	ErrAuthFailed   = errors.New("5.7.8 Authentication credentials invalid")
+	ErrInvalidToken = errors.New("token rejected by server: status invalid_token, scope https://mail.domain.local/, schemes bearer")
+)
+
+// authScript handles the AUTH command of the stand-in server. The initial response is already base64 decoded.
+type authScript func(tp *textproto.Conn, mechanism string, initial []byte) error
+
+type check struct {
+	name           string
+	authentication SmtpAuthentication
+	expectedType   types.AuthenticationMethod
+	script         authScript
+	expectedErrors *[]error
+}
+
+func Test_Authenticate(t *testing.T) {
+	xoauth2Response := fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", testUser, testToken)
+	bearerResponse := fmt.Sprintf("n,a=%s,\x01host=%s\x01port=587\x01auth=Bearer %s\x01\x01", testUser, testHost, testToken)
+	rejectStatus := `{"status":"invalid_token","schemes":"bearer","scope":"https://mail.domain.local/"}`
+
+	checklist := make([]check, 0, 20)
+	addCheck(t, &checklist, "login", NewAuthLogin(testHost, testUser, testPass), types.LoginAuth, loginScript(testUser, testPass), nil)
+	addCheck(t, &checklist, "login wrong password", NewAuthLogin(testHost, testUser, "Wrong"), types.LoginAuth, loginScript(testUser, testPass), &[]error{ErrAuthFailed})
+	addCheck(t, &checklist, "login no password", NewAuthLogin(testHost, testUser, ""), types.LoginAuth, loginScript(testUser, testPass), &[]error{errors.New("no password provided")})
+	addCheck(t, &checklist, "login other prompts", NewAuthLogin(testHost, testUser, testPass), types.LoginAuth, loginPromptScript(testUser, testPass, "User Name\x00", "Passwort"), nil)
+	addCheck(t, &checklist, "login third challenge", NewAuthLogin(testHost, testUser, testPass), types.LoginAuth, loginPromptScript(testUser, testPass, "Username:", "Password:", "Domain:"), &[]error{errors.New("unexpected server challenge: Domain:")})
+	addCheck(t, &checklist, "login wrong host", NewAuthLogin("mail.domain.local", testUser, testPass), types.LoginAuth, loginScript(testUser, testPass), &[]error{ErrWrongHostName})
+
+	addCheck(t, &checklist, "xoauth2", NewAuthXOAuth2(testHost, testUser, testToken), types.XOAuth2Auth, bearerScript("XOAUTH2", xoauth2Response, rejectStatus, ""), nil)
+	addCheck(t, &checklist, "xoauth2 rejected", NewAuthXOAuth2(testHost, testUser, "Expired"), types.XOAuth2Auth, bearerScript("XOAUTH2", xoauth2Response, rejectStatus, ""), &[]error{ErrTokenRejected, ErrInvalidToken, ErrAuthFailed})
+	addCheck(t, &checklist, "xoauth2 no token", NewAuthXOAuth2(testHost, testUser, ""), types.XOAuth2Auth, bearerScript("XOAUTH2", xoauth2Response, rejectStatus, ""), &[]error{errors.New("no token provided")})
+
+	addCheck(t, &checklist, "oauthbearer", NewAuthOAuthBearer(testHost, 587, testUser, testToken), types.OAuthBearerAuth, bearerScript("OAUTHBEARER", bearerResponse, rejectStatus, "\x01"), nil)
+	addCheck(t, &checklist, "oauthbearer rejected", NewAuthOAuthBearer(testHost, 587, testUser, "Expired"), types.OAuthBearerAuth, bearerScript("OAUTHBEARER", bearerResponse, rejectStatus, "\x01"), &[]error{ErrTokenRejected, ErrInvalidToken, ErrAuthFailed})
+	addCheck(t, &checklist, "oauthbearer invalid status", NewAuthOAuthBearer(testHost, 587, testUser, "Expired"), types.OAuthBearerAuth, bearerScript("OAUTHBEARER", bearerResponse, "not json", "\x01"), &[]error{ErrTokenRejected, errors.New("not json")})
+
+	addCheck(t, &checklist, "scram-sha-1", NewAuthScram(types.ScramSha1Auth, testUser, testPass), types.ScramSha1Auth, scramScript("SCRAM-SHA-1", sha1.New, testPass, scramOptions{}), nil)
+	addCheck(t, &checklist, "scram-sha-256", NewAuthScram(types.ScramSha256Auth, testUser, testPass), types.ScramSha256Auth, scramScript("SCRAM-SHA-256", sha256.New, testPass, scramOptions{}), nil)
+	addCheck(t, &checklist, "scram-sha-256 wrong password", NewAuthScram(types.ScramSha256Auth, testUser, "Wrong"), types.ScramSha256Auth, scramScript("SCRAM-SHA-256", sha256.New, testPass, scramOptions{}), &[]error{ErrAuthFailed})
+	addCheck(t, &checklist, "scram-sha-256 server signature", NewAuthScram(types.ScramSha256Auth, testUser, testPass), types.ScramSha256Auth, scramScript("SCRAM-SHA-256", sha256.New, testPass, scramOptions{tamper: true}), &[]error{ErrServerSignature})
+	addCheck(t, &checklist, "scram-sha-256 final data", NewAuthScram(types.ScramSha256Auth, testUser, testPass), types.ScramSha256Auth, scramScript("SCRAM-SHA-256", sha256.New, testPass, scramOptions{finalData: true}), nil)
+	addCheck(t, &checklist, "scram-sha-256 final data signature", NewAuthScram(types.ScramSha256Auth, testUser, testPass), types.ScramSha256Auth, scramScript("SCRAM-SHA-256", sha256.New, testPass, scramOptions{tamper: true, finalData: true}), &[]error{ErrServerSignature})
+	addCheck(t, &checklist, "scram-sha-256 saslprep user", NewAuthScram(types.ScramSha256Auth, "Rene\u0301=Nr\u00a01", testPass), types.ScramSha256Auth, scramScript("SCRAM-SHA-256", sha256.New, testPass, scramOptions{user: "Ren\u00e9=3DNr 1"}), nil)
+	addCheck(t, &checklist, "scram-sha-256-plus no tls", NewAuthScram(types.ScramSha256PlusAuth, testUser, testPass), types.ScramSha256PlusAuth, scramScript("SCRAM-SHA-256-PLUS", sha256.New, testPass, scramOptions{}), &[]error{ErrChannelBindingNoTls})
+	addCheck(t, &checklist, "scram unknown method", NewAuthScram(types.PlainAuth, testUser, testPass), types.PlainAuth, scramScript("SCRAM-SHA-256", sha256.New, testPass, scramOptions{}), &[]error{types.ErrAuthenticationInvalid})
+
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			if authType := c.authentication.GetType(); authType != c.expectedType {
+				t.Errorf("Expected type %s, got %s", c.expectedType, authType)
+			}
+
+			client, stop := connectAuthServer(t, testMechanisms, c.script)
+			defer stop()
+
+			err := c.authentication.Authenticate(context.Background(), client, GetServerCapabilities(client, testHost))
+			if cont, err := checkError(err, c.expectedErrors); !cont || err != nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func Test_AuthAuto(t *testing.T) {
+	type autoCheck struct {
+		name             string
+		authentication   *AuthAuto
+		advertised       string
+		hostname         string
+		script           authScript
+		tls              bool
+		expectedSelected types.AuthenticationMethod
+		expectedErrors   *[]error
+	}
+	bearerResponse := fmt.Sprintf("n,a=%s,\x01host=%s\x01port=587\x01auth=Bearer %s\x01\x01", testUser, testHost, testToken)
+
+	checklist := []autoCheck{
+		{name: "prefer scram", authentication: NewAuthAuto(testHost, 587, testUser, testPass, ""), advertised: testMechanisms, hostname: testHost,
+			script: scramScript("SCRAM-SHA-256", sha256.New, testPass, scramOptions{}), expectedSelected: types.ScramSha256Auth},
+		{name: "scram-sha-1 only", authentication: NewAuthAuto(testHost, 587, testUser, testPass, ""), advertised: "LOGIN SCRAM-SHA-1 PLAIN", hostname: testHost,
+			script: scramScript("SCRAM-SHA-1", sha1.New, testPass, scramOptions{}), expectedSelected: types.ScramSha1Auth},
+		{name: "token", authentication: NewAuthAuto(testHost, 587, testUser, "", testToken), advertised: testMechanisms, hostname: testHost,
+			script: bearerScript("OAUTHBEARER", bearerResponse, "", "\x01"), expectedSelected: types.OAuthBearerAuth},
+		{name: "login on localhost", authentication: NewAuthAuto(testHost, 587, testUser, testPass, ""), advertised: "LOGIN", hostname: testHost,
+			script: loginScript(testUser, testPass), expectedSelected: types.LoginAuth},
+		{name: "prefer cram-md5 without tls", authentication: NewAuthAuto(testHost, 587, testUser, testPass, ""), advertised: "CRAM-MD5 PLAIN LOGIN", hostname: testHost,
+			script: cramScript(testUser, testPass), expectedSelected: types.CramMd5Auth},
+		{name: "prefer plain with tls", authentication: NewAuthAuto(testHost, 587, testUser, testPass, ""), advertised: "CRAM-MD5 PLAIN LOGIN", hostname: testHost, tls: true,
+			script: plainScript(testUser, testPass), expectedSelected: types.PlainAuth},
+		{name: "prefer login with tls", authentication: NewAuthAuto(testHost, 587, testUser, testPass, ""), advertised: "CRAM-MD5 LOGIN", hostname: testHost, tls: true,
+			script: loginScript(testUser, testPass), expectedSelected: types.LoginAuth},
+		{name: "plain not allowed", authentication: NewAuthAuto("mail.domain.local", 587, testUser, testPass, ""), advertised: "PLAIN LOGIN", hostname: "mail.domain.local",
+			script: loginScript(testUser, testPass), expectedErrors: &[]error{ErrNoMechanism, errors.New("plain: not allowed on this connection")}},
+		{name: "channel binding not allowed", authentication: NewAuthAuto(testHost, 587, testUser, testPass, ""), advertised: "SCRAM-SHA-256-PLUS", hostname: testHost,
+			script: loginScript(testUser, testPass), expectedErrors: &[]error{ErrNoMechanism, errors.New("scram-sha-256-plus: not allowed on this connection")}},
+		{name: "missing credentials", authentication: NewAuthAuto(testHost, 587, testUser, "", testToken), advertised: "SCRAM-SHA-256 CRAM-MD5", hostname: testHost,
+			script: loginScript(testUser, testPass), expectedErrors: &[]error{ErrNoMechanism, errors.New("scram-sha-256: no password provided")}},
+		{name: "unsupported", authentication: NewAuthAuto(testHost, 587, testUser, testPass, ""), advertised: "GSSAPI NTLM", hostname: testHost,
+			script: loginScript(testUser, testPass), expectedErrors: &[]error{ErrNoMechanism, errors.New("server advertises GSSAPI NTLM")}},
+		{name: "no auth extension", authentication: NewAuthAuto(testHost, 587, testUser, testPass, ""), advertised: "", hostname: testHost,
+			script: loginScript(testUser, testPass), expectedErrors: &[]error{ErrNoMechanism, errors.New("server does not advertise AUTH")}},
+		{name: "no credentials", authentication: NewAuthAuto(testHost, 587, testUser, "", ""), advertised: testMechanisms, hostname: testHost,
+			script: loginScript(testUser, testPass), expectedErrors: &[]error{errors.New("no password or token provided")}},
+	}
+
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			client, stop := connectAuthServer(t, c.advertised, c.script)
+			defer stop()
+
+			// The stand-in server has no TLS, a TLS session is simulated with c.tls
+			server := GetServerCapabilities(client, c.hostname)
+			(*server).Tls = c.tls
+			err := c.authentication.Authenticate(context.Background(), client, server)
+			if cont, err := checkError(err, c.expectedErrors); !cont || err != nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if selected := c.authentication.GetSelected(); selected != c.expectedSelected {
+				t.Errorf("Expected selected method %s, got %s", c.expectedSelected, selected)
+			}
+		})
+	}
+}
+
+func Test_AuthExternal(t *testing.T) {
+	type externalCheck struct {
+		name           string
+		authentication *AuthExternal
+		tls            bool
+		expectedErrors *[]error
+	}
+	checklist := []externalCheck{
+		{name: "external", authentication: NewAuthExternal(""), tls: true},
+		{name: "external authzid", authentication: NewAuthExternal(testUser), tls: true},
+		{name: "external other authzid", authentication: NewAuthExternal("other@domain.local"), tls: true, expectedErrors: &[]error{ErrAuthFailed}},
+		{name: "external no tls", authentication: NewAuthExternal(""), tls: false, expectedErrors: &[]error{ErrExternalNoTls}},
+	}
+
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			client, stop := connectAuthServer(t, "EXTERNAL", externalScript(testUser))
+			defer stop()
+
+			// The stand-in server has no TLS, the certificate identity is assumed to be testUser
+			server := GetServerCapabilities(client, testHost)
+			(*server).Tls = c.tls
+			err := c.authentication.Authenticate(context.Background(), client, server)
+			if cont, err := checkError(err, c.expectedErrors); !cont || err != nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func Test_CheckSecurity(t *testing.T) {
+	type securityCheck struct {
+		method        types.AuthenticationMethod
+		tls           bool
+		hostname      string
+		expectedError error
+	}
+	checklist := []securityCheck{
+		{method: types.PlainAuth, tls: true, hostname: "mail.domain.local", expectedError: nil},
+		{method: types.PlainAuth, tls: false, hostname: "localhost", expectedError: nil},
+		{method: types.PlainAuth, tls: false, hostname: "mail.domain.local", expectedError: ErrRequiresSecureConnection},
+		{method: types.XOAuth2Auth, tls: false, hostname: "mail.domain.local", expectedError: ErrRequiresSecureConnection},
+		{method: types.ScramSha256Auth, tls: false, hostname: "mail.domain.local", expectedError: nil},
+		{method: types.ScramSha256PlusAuth, tls: false, hostname: "localhost", expectedError: ErrRequiresChannelBinding},
+		{method: types.CramMd5Auth, tls: false, hostname: "mail.domain.local", expectedError: nil},
+		{method: types.ExternalAuth, tls: false, hostname: "localhost", expectedError: ErrRequiresSecureConnection},
+		{method: types.ExternalAuth, tls: true, hostname: "mail.domain.local", expectedError: nil},
+	}
+	for _, c := range checklist {
+		if err := CheckSecurity(c.method, c.tls, c.hostname); !errors.Is(err, c.expectedError) {
+			t.Errorf("%s (tls %t, host %s): expected error %v, got %v", c.method, c.tls, c.hostname, c.expectedError, err)
+		}
+	}
+}
+
+func addCheck(t testing.TB, checklist *[]check, name string, authentication SmtpAuthentication, expectedType types.AuthenticationMethod, script authScript, expectedErrors *[]error) {
+	t.Helper()
+	*checklist = append(*checklist, check{name: name, authentication: authentication, expectedType: expectedType, script: script, expectedErrors: expectedErrors})
+}
+
+func loginScript(user, password string) authScript {
+	return loginPromptScript(user, password, "Username:", "Password:")
+}
+
+// loginPromptScript asks for the user and password with the given prompts, as the prompts of LOGIN are not standardised
+func loginPromptScript(user, password string, prompts ...string) authScript {
+	return func(tp *textproto.Conn, mechanism string, initial []byte) error {
+		if mechanism != "LOGIN" {
+			return tp.PrintfLine("504 Unrecognized authentication type")
+		}
+		var answers [][]byte
+		for _, prompt := range prompts {
+			answer, err := challenge(tp, prompt)
+			if err != nil {
+				return err
+			}
+			answers = append(answers, answer)
+		}
+		if len(answers) != 2 {
+			return tp.PrintfLine("535 5.7.8 Authentication credentials invalid")
+		}
+		u, p := answers[0], answers[1]
+		if string(u) != user || string(p) != password {
+			return tp.PrintfLine("535 5.7.8 Authentication credentials invalid")
+		}
+		return tp.PrintfLine("235 2.7.0 Authentication successful")
+	}
+}
+
+func plainScript(user, password string) authScript {
+	return func(tp *textproto.Conn, mechanism string, initial []byte) error {
+		if mechanism != "PLAIN" {
+			return tp.PrintfLine("504 Unrecognized authentication type")
+		}
+		if string(initial) != "\x00"+user+"\x00"+password {
+			return tp.PrintfLine("535 5.7.8 Authentication credentials invalid")
+		}
+		return tp.PrintfLine("235 2.7.0 Authentication successful")
+	}
+}
+
+func cramScript(user, password string) authScript {
+	return func(tp *textproto.Conn, mechanism string, initial []byte) error {
+		if mechanism != "CRAM-MD5" {
+			return tp.PrintfLine("504 Unrecognized authentication type")
+		}
+		text := "<1896.697170952@domain.local>"
+		resp, err := challenge(tp, text)
+		if err != nil {
+			return err
+		}
+		mac := hmac.New(md5.New, []byte(password))
+		mac.Write([]byte(text))
+		if string(resp) != user+" "+hex.EncodeToString(mac.Sum(nil)) {
+			return tp.PrintfLine("535 5.7.8 Authentication credentials invalid")
+		}
+		return tp.PrintfLine("235 2.7.0 Authentication successful")
+	}
+}
+
+func bearerScript(expectedMechanism, expectedResponse, status, expectedErrorResponse string) authScript {
+	return func(tp *textproto.Conn, mechanism string, initial []byte) error {
+		if mechanism != expectedMechanism {
+			return tp.PrintfLine("504 Unrecognized authentication type")
+		}
+		if string(initial) == expectedResponse {
+			return tp.PrintfLine("235 2.7.0 Authentication successful")
+		}
+		resp, err := challenge(tp, status)
+		if err != nil {
+			return err
+		}
+		if string(resp) != expectedErrorResponse {
+			return tp.PrintfLine("501 Unexpected response")
+		}
+		return tp.PrintfLine("535 5.7.8 Authentication credentials invalid")
+	}
+}
+
+// externalScript accepts an empty authorization identity or the identity of the client certificate
+func externalScript(certificateIdentity string) authScript {
+	return func(tp *textproto.Conn, mechanism string, initial []byte) error {
+		if mechanism != "EXTERNAL" {
+			return tp.PrintfLine("504 Unrecognized authentication type")
+		}
+		authzid := initial
+		if initial == nil {
+			var err error
+			if authzid, err = challenge(tp, ""); err != nil {
+				return err
+			}
+		}
+		if len(authzid) != 0 && string(authzid) != certificateIdentity {
+			return tp.PrintfLine("535 5.7.8 Authentication credentials invalid")
+		}
+		return tp.PrintfLine("235 2.7.0 Authentication successful")
+	}
+}
+
+// scramOptions changes the behaviour of the SCRAM stand-in server
+type scramOptions struct {
+	user      string // Expected user name of the client-first-message, not checked when empty
+	tamper    bool   // Invalidate the server signature
+	finalData bool   // Send the server-final-message as additional data of the 235 reply instead of a challenge
+}
+
+// scramScript verifies the client proof as a SCRAM server would
+func scramScript(expectedMechanism string, newHash func() hash.Hash, password string, options scramOptions) authScript {
+	salt := []byte("gosend-salt")
+	hmacSum := func(key, data []byte) []byte {
+		mac := hmac.New(newHash, key)
+		mac.Write(data)
+		return mac.Sum(nil)
+	}
+	return func(tp *textproto.Conn, mechanism string, initial []byte) error {
+		if mechanism != expectedMechanism {
+			return tp.PrintfLine("504 Unrecognized authentication type")
+		}
+		parts := strings.SplitN(string(initial), ",", 3)
+		if len(parts) != 3 || parts[0] != "n" {
+			return tp.PrintfLine("501 Invalid GS2 header")
+		}
+		gs2Header, clientFirstBare := parts[0]+","+parts[1]+",", parts[2]
+		clientNonce := clientFirstBare[strings.Index(clientFirstBare, ",r=")+3:]
+		if options.user != "" && !strings.HasPrefix(clientFirstBare, "n="+options.user+",") {
+			return tp.PrintfLine("535 5.7.8 Authentication credentials invalid")
+		}
+
+		serverFirst := fmt.Sprintf("r=%sServerNonce,s=%s,i=4096", clientNonce, base64.StdEncoding.EncodeToString(salt))
+		clientFinal, err := challenge(tp, serverFirst)
+		if err != nil {
+			return err
+		}
+		proofIndex := bytes.LastIndex(clientFinal, []byte(",p="))
+		if proofIndex == -1 {
+			return tp.PrintfLine("501 No proof")
+		}
+		clientFinalWithoutProof := string(clientFinal[:proofIndex])
+		if !strings.HasPrefix(clientFinalWithoutProof, "c="+base64.StdEncoding.EncodeToString([]byte(gs2Header))+",") {
+			return tp.PrintfLine("501 Invalid channel binding")
+		}
+		proof, err := base64.StdEncoding.DecodeString(string(clientFinal[proofIndex+3:]))
+		if err != nil {
+			return tp.PrintfLine("501 Invalid proof")
+		}
+
+		authMessage := []byte(clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+		saltedPassword := pbkdf2.Key([]byte(password), salt, 4096, newHash().Size(), newHash)
+		h := newHash()
+		h.Write(hmacSum(saltedPassword, []byte("Client Key")))
+		storedKey := h.Sum(nil)
+		clientSignature := hmacSum(storedKey, authMessage)
+		clientKey := make([]byte, len(proof))
+		for i := range proof {
+			clientKey[i] = proof[i] ^ clientSignature[i%len(clientSignature)]
+		}
+		h = newHash()
+		h.Write(clientKey)
+		if !hmac.Equal(h.Sum(nil), storedKey) {
+			return tp.PrintfLine("535 5.7.8 Authentication credentials invalid")
+		}
+
+		serverSignature := hmacSum(hmacSum(saltedPassword, []byte("Server Key")), authMessage)
+		if options.tamper {
+			serverSignature[0] ^= 0xff
+		}
+		serverFinal := "v=" + base64.StdEncoding.EncodeToString(serverSignature)
+		if options.finalData {
+			return tp.PrintfLine("235 2.7.0 %s", base64.StdEncoding.EncodeToString([]byte(serverFinal)))
+		}
+		resp, err := challenge(tp, serverFinal)
+		if err != nil {
+			return err
+		}
+		if len(resp) != 0 {
+			return tp.PrintfLine("501 Unexpected response")
+		}
+		return tp.PrintfLine("235 2.7.0 Authentication successful")
+	}
+}
+
+func challenge(tp *textproto.Conn, text string) ([]byte, error) {
+	if err := tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(text))); err != nil {
+		return nil, err
+	}
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(line)
+}
+
+func connectAuthServer(t testing.TB, advertised string, script authScript) (*smtp.Client, func()) {
+	t.Helper()
+	addr, stop, err := startAuthServer(advertised, script)
+	if err != nil {
+		t.Fatalf("Cannot start SMTP server: %s", err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	client, err := smtp.NewClient(conn, testHost)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		stop()
+	}
+}
+
+// startAuthServer starts a minimal stand-in SMTP server that only handles EHLO, AUTH and QUIT. The advertised mechanisms are listed in the EHLO reply.
+func startAuthServer(advertised string, script authScript) (string, func() error, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveAuth(conn, advertised, script)
+		}
+	}()
+	return listener.Addr().String(), listener.Close, nil
+}
+
+func serveAuth(conn net.Conn, advertised string, script authScript) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	if err := tp.PrintfLine("220 Stand-in SMTP Server"); err != nil {
+		return
+	}
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		switch strings.ToUpper(words[0]) {
+		case "EHLO":
+			if advertised == "" {
+				err = tp.PrintfLine("250 Stand-in SMTP Server")
+			} else {
+				err = tp.PrintfLine("250-Stand-in SMTP Server\r\n250 AUTH %s", advertised)
+			}
+		case "AUTH":
+			var initial []byte
+			if len(words) > 2 {
+				initial, err = base64.StdEncoding.DecodeString(words[2])
+				if err != nil {
+					err = tp.PrintfLine("501 Invalid base64")
+					break
+				}
+			}
+			err = script(tp, strings.ToUpper(words[1]), initial)
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			err = tp.PrintfLine("500 Command not recognized")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func checkError(occuredErr error, expectedErr *[]error) (bool, error) {
+	if expectedErr == nil || len(*expectedErr) == 0 {
+		if occuredErr != nil {
+			return false, fmt.Errorf("Expected no error, got %s", occuredErr)
+		}
+	} else {
+		if occuredErr == nil {
+			if len(*expectedErr) == 1 {
+				return false, fmt.Errorf("Expected error %s, got no error", (*expectedErr)[0])
+			} else {
+				return false, fmt.Errorf("Expected errors %s, got no error", errors.Join(*expectedErr...))
+			}
+		} else {
+			for _, exp := range *expectedErr {
+				if !strings.Contains(occuredErr.Error(), exp.Error()) {
+					return false, fmt.Errorf("Expected error %s, got %s", exp, occuredErr)
+				}
+			}
+			return false, nil
+		}
+	}
+	return true, nil
+}
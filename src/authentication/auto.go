@@ -0,0 +1,127 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+var (
+	ErrNoMechanism = errors.New("no suitable authentication mechanism")
+)
+
+// Order of preference of the automatic selection on an unencrypted session, strongest mechanism first
+var autoPreference = []types.AuthenticationMethod{
+	types.ScramSha256PlusAuth,
+	types.ScramSha1PlusAuth,
+	types.ScramSha256Auth,
+	types.ScramSha1Auth,
+	types.OAuthBearerAuth,
+	types.XOAuth2Auth,
+	types.CramMd5Auth,
+	types.PlainAuth,
+	types.LoginAuth,
+}
+
+// Order of preference on a TLS session. TLS protects the password of PLAIN and LOGIN, while CRAM-MD5 requires the server
+// to store the password in a form that is equivalent to the password, so it is tried last.
+var autoPreferenceTls = []types.AuthenticationMethod{
+	types.ScramSha256PlusAuth,
+	types.ScramSha1PlusAuth,
+	types.ScramSha256Auth,
+	types.ScramSha1Auth,
+	types.OAuthBearerAuth,
+	types.XOAuth2Auth,
+	types.PlainAuth,
+	types.LoginAuth,
+	types.CramMd5Auth,
+}
+
+type AuthAuto struct {
+	hostname string
+	port     int
+	user     string
+	password string
+	token    string
+	selected SmtpAuthentication
+}
+
+func NewAuthAuto(hostname string, port int, user string, password string, token string) *AuthAuto {
+	return &AuthAuto{hostname: hostname, port: port, user: user, password: password, token: token}
+}
+
+func (a *AuthAuto) Check() error {
+	var errMsgs []error
+	if (*a).user == "" {
+		errMsgs = append(errMsgs, fmt.Errorf("no login user provided"))
+	}
+	if (*a).password == "" && (*a).token == "" {
+		errMsgs = append(errMsgs, fmt.Errorf("no password or token provided"))
+	}
+	return errors.Join(errMsgs...)
+}
+
+func (a *AuthAuto) GetType() types.AuthenticationMethod {
+	return types.AutoAuth
+}
+
+// GetSelected returns the authentication method chosen during Authenticate
+func (a *AuthAuto) GetSelected() types.AuthenticationMethod {
+	if (*a).selected == nil {
+		return types.NoAuthentication
+	}
+	return (*a).selected.GetType()
+}
+
+func (a *AuthAuto) Authenticate(ctx context.Context, client *smtp.Client, server *ServerCapabilities) error {
+	if err := a.Check(); err != nil {
+		return err
+	}
+	auth, err := a.selectMechanism(server)
+	if err != nil {
+		return err
+	}
+	(*a).selected = auth
+	return auth.Authenticate(ctx, client, server)
+}
+
+// selectMechanism picks the most preferred mechanism that is advertised, allowed on the connection and has the required credentials
+func (a *AuthAuto) selectMechanism(server *ServerCapabilities) (SmtpAuthentication, error) {
+	if len((*server).Mechanisms) == 0 {
+		return nil, fmt.Errorf("%w: server does not advertise AUTH", ErrNoMechanism)
+	}
+
+	preference := autoPreference
+	if (*server).Tls {
+		preference = autoPreferenceTls
+	}
+	var reasons []string
+	for _, method := range preference {
+		if !server.Advertises(method.String()) {
+			continue
+		}
+		if err := CheckSecurity(method, (*server).Tls, (*server).HostName); err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: not allowed on this connection", method))
+			continue
+		}
+		auth, err := getAuthentication(method, (*a).hostname, (*a).port, (*a).user, (*a).password, (*a).token)
+		if err != nil {
+			return nil, err
+		}
+		if err := auth.Check(); err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", method, strings.ReplaceAll(err.Error(), "\n", ", ")))
+			continue
+		}
+		return auth, nil
+	}
+
+	var details string
+	if len(reasons) > 0 {
+		details = " (" + strings.Join(reasons, "; ") + ")"
+	}
+	return nil, fmt.Errorf("%w: server advertises %s%s", ErrNoMechanism, strings.Join((*server).Mechanisms, " "), details)
+}
@@ -1,6 +1,7 @@
 package authentication
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/smtp"
@@ -32,13 +33,13 @@ func (a *AuthCramMd5) GetType() types.AuthenticationMethod {
 	return types.CramMd5Auth
 }
 
-func (a *AuthCramMd5) Authenticate(client *smtp.Client) error {
+func (a *AuthCramMd5) Authenticate(ctx context.Context, client *smtp.Client, server *ServerCapabilities) error {
 	if err := a.Check(); err != nil {
 		return err
 	}
 
 	auth := smtp.CRAMMD5Auth((*a).user, (*a).password)
-	if err := client.Auth(auth); err != nil {
+	if err := authenticate(ctx, client, auth); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,62 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"net/smtp"
+
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+var (
+	ErrExternalNoTls = errors.New("authentication method external requires a TLS connection with a client certificate")
+)
+
+type AuthExternal struct {
+	authzid string
+}
+
+// NewAuthExternal returns the EXTERNAL mechanism (RFC 4422 appendix A). The identity is taken from the TLS
+// client certificate; an optional authorization identity requests to act as a different user.
+func NewAuthExternal(authzid string) *AuthExternal {
+	return &AuthExternal{authzid: authzid}
+}
+
+func (a *AuthExternal) Check() error {
+	return nil
+}
+
+func (a *AuthExternal) GetType() types.AuthenticationMethod {
+	return types.ExternalAuth
+}
+
+func (a *AuthExternal) Authenticate(ctx context.Context, client *smtp.Client, server *ServerCapabilities) error {
+	if err := a.Check(); err != nil {
+		return err
+	}
+	if !(*server).Tls {
+		return ErrExternalNoTls
+	}
+
+	if err := authenticate(ctx, client, &externalAuth{authzid: (*a).authzid}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// externalAuth implements smtp.Auth for the EXTERNAL mechanism
+type externalAuth struct {
+	authzid string
+}
+
+func (e *externalAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Without authzid there is no initial response and an empty response follows the server challenge
+	return "EXTERNAL", []byte((*e).authzid), nil
+}
+
+func (e *externalAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
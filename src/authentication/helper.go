@@ -0,0 +1,57 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"net/smtp"
+	"strings"
+)
+
+var (
+	ErrUnencryptedConnection = errors.New("unencrypted connection")
+	ErrWrongHostName         = errors.New("wrong host name")
+)
+
+// checkServerInfo applies the same restrictions as smtp.PlainAuth for mechanisms that send credentials unencrypted
+func checkServerInfo(server *smtp.ServerInfo, hostname string) error {
+	if !(*server).TLS && !isLocalhost((*server).Name) {
+		return ErrUnencryptedConnection
+	}
+	if (*server).Name != hostname {
+		return ErrWrongHostName
+	}
+	return nil
+}
+
+// authenticate runs the SASL exchange of auth. When ctx is cancelled between two steps, the exchange is cancelled with the server.
+func authenticate(ctx context.Context, client *smtp.Client, auth smtp.Auth) error {
+	return client.Auth(&contextAuth{ctx: ctx, Auth: auth})
+}
+
+type contextAuth struct {
+	ctx context.Context
+	smtp.Auth
+}
+
+func (a *contextAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := (*a).ctx.Err(); err != nil {
+		return "", nil, err
+	}
+	return (*a).Auth.Start(server)
+}
+
+func (a *contextAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if err := (*a).ctx.Err(); err != nil {
+		return nil, err
+	}
+	return (*a).Auth.Next(fromServer, more)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// saslName escapes a name for use in a GS2 header (RFC 5801)
+func saslName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
@@ -1,28 +1,104 @@
 package authentication
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/smtp"
+	"strings"
 
 	"github.com/Sternisaea/gosend/src/cmdflags"
 	"github.com/Sternisaea/gosend/src/types"
 )
 
+var (
+	ErrRequiresSecureConnection = errors.New("authentication method is only allowed on a secure connection")
+	ErrRequiresChannelBinding   = errors.New("authentication method requires a secure connection for channel binding")
+)
+
 type SmtpAuthentication interface {
 	Check() error
-	Authenticate(client *smtp.Client) error
+	Authenticate(ctx context.Context, client *smtp.Client, server *ServerCapabilities) error
 	GetType() types.AuthenticationMethod
 }
 
+// ServerCapabilities holds the authentication mechanisms advertised in the EHLO reply of the connected server
+type ServerCapabilities struct {
+	HostName   string
+	Tls        bool
+	Mechanisms []string
+}
+
+func GetServerCapabilities(client *smtp.Client, hostname string) *ServerCapabilities {
+	caps := &ServerCapabilities{HostName: hostname}
+	_, (*caps).Tls = client.TLSConnectionState()
+	if ok, params := client.Extension("AUTH"); ok {
+		for _, m := range strings.Fields(params) {
+			(*caps).Mechanisms = append((*caps).Mechanisms, strings.ToUpper(m))
+		}
+	}
+	return caps
+}
+
+func (sc *ServerCapabilities) Advertises(mechanism string) bool {
+	for _, m := range (*sc).Mechanisms {
+		if strings.EqualFold(m, mechanism) {
+			return true
+		}
+	}
+	return false
+}
+
 func GetAuthentication(st *cmdflags.Settings) (SmtpAuthentication, error) {
 	switch st.Authentication {
+	case types.AutoAuth:
+		return NewAuthAuto(st.SmtpHost.String(), int(st.SmtpPort), st.Login, st.Password, st.Token), nil
+	default:
+		return getAuthentication(st.Authentication, st.SmtpHost.String(), int(st.SmtpPort), st.Login, st.Password, st.Token)
+	}
+}
+
+func getAuthentication(method types.AuthenticationMethod, hostname string, port int, login, password, token string) (SmtpAuthentication, error) {
+	switch method {
 	case types.NoAuthentication:
 		return NewAuthNone(), nil
 	case types.PlainAuth:
-		return NewAuthPlain(st.SmtpHost.String(), st.Login, st.Password), nil
+		return NewAuthPlain(hostname, login, password), nil
+	case types.LoginAuth:
+		return NewAuthLogin(hostname, login, password), nil
 	case types.CramMd5Auth:
-		return NewAuthCramMd5(st.Login, st.Password), nil
+		return NewAuthCramMd5(login, password), nil
+	case types.ScramSha1Auth, types.ScramSha1PlusAuth, types.ScramSha256Auth, types.ScramSha256PlusAuth:
+		return NewAuthScram(method, login, password), nil
+	case types.XOAuth2Auth:
+		return NewAuthXOAuth2(hostname, login, token), nil
+	case types.OAuthBearerAuth:
+		return NewAuthOAuthBearer(hostname, port, login, token), nil
+	case types.ExternalAuth:
+		// The identity is taken from the client certificate, the login user is the authorization identity
+		return NewAuthExternal(login), nil
 	default:
-		return nil, fmt.Errorf("unknown authentication method: %s", st.Authentication)
+		return nil, fmt.Errorf("unknown authentication method: %s", method)
+	}
+}
+
+// CheckSecurity reports whether an authentication method may be used on a connection with or without TLS
+func CheckSecurity(method types.AuthenticationMethod, tls bool, hostname string) error {
+	if tls {
+		return nil
+	}
+	switch method {
+	case types.PlainAuth, types.LoginAuth, types.XOAuth2Auth, types.OAuthBearerAuth:
+		// Credentials are sent readable, which is only acceptable to localhost
+		if hostname != "localhost" {
+			return fmt.Errorf("%w: '%s'", ErrRequiresSecureConnection, method)
+		}
+	case types.ScramSha1PlusAuth, types.ScramSha256PlusAuth:
+		return fmt.Errorf("%w: '%s'", ErrRequiresChannelBinding, method)
+	case types.ExternalAuth:
+		// The identity is provided by the TLS client certificate
+		return fmt.Errorf("%w: '%s'", ErrRequiresSecureConnection, method)
 	}
+	// SCRAM without channel binding and CRAM-MD5 do not expose the password
+	return nil
 }
@@ -0,0 +1,80 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+type AuthLogin struct {
+	hostname string
+	user     string
+	password string
+}
+
+func NewAuthLogin(hostname string, user string, password string) *AuthLogin {
+	return &AuthLogin{hostname: hostname, user: user, password: password}
+}
+
+func (a *AuthLogin) Check() error {
+	var errMsgs []error
+	if (*a).hostname == "" {
+		errMsgs = append(errMsgs, fmt.Errorf("no hostname provided"))
+	}
+	if (*a).user == "" {
+		errMsgs = append(errMsgs, fmt.Errorf("no login user provided"))
+	}
+	if (*a).password == "" {
+		errMsgs = append(errMsgs, fmt.Errorf("no password provided"))
+	}
+	return errors.Join(errMsgs...)
+}
+
+func (a *AuthLogin) GetType() types.AuthenticationMethod {
+	return types.LoginAuth
+}
+
+func (a *AuthLogin) Authenticate(ctx context.Context, client *smtp.Client, server *ServerCapabilities) error {
+	if err := a.Check(); err != nil {
+		return err
+	}
+
+	if err := authenticate(ctx, client, &loginAuth{hostname: (*a).hostname, user: (*a).user, password: (*a).password}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// loginAuth implements smtp.Auth for the non-standardised LOGIN mechanism. The text of the prompts differs
+// between servers, e.g. "User Name" or a localised text, so the challenges are answered by their order.
+type loginAuth struct {
+	hostname string
+	user     string
+	password string
+	step     int
+}
+
+func (l *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkServerInfo(server, (*l).hostname); err != nil {
+		return "", nil, err
+	}
+	return "LOGIN", nil, nil
+}
+
+func (l *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	(*l).step++
+	switch (*l).step {
+	case 1:
+		return []byte((*l).user), nil
+	case 2:
+		return []byte((*l).password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+	}
+}
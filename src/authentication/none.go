@@ -1,6 +1,7 @@
 package authentication
 
 import (
+	"context"
 	"net/smtp"
 
 	"github.com/Sternisaea/gosend/src/types"
@@ -21,7 +22,7 @@ func (a *AuthNone) GetType() types.AuthenticationMethod {
 	return types.NoAuthentication
 }
 
-func (a *AuthNone) Authenticate(client *smtp.Client) error {
+func (a *AuthNone) Authenticate(ctx context.Context, client *smtp.Client, server *ServerCapabilities) error {
 	if err := a.Check(); err != nil {
 		return err
 	}
@@ -0,0 +1,38 @@
+package authentication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrTokenRejected = errors.New("token rejected by server")
+
+// oauthStatus is the JSON error payload a server sends as challenge when a bearer token is rejected (RFC 7628 section 3.2.2)
+type oauthStatus struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes"`
+	Scope   string `json:"scope"`
+}
+
+func parseOAuthStatus(fromServer []byte) error {
+	var st oauthStatus
+	if err := json.Unmarshal(fromServer, &st); err != nil {
+		return fmt.Errorf("%w: %s", ErrTokenRejected, fromServer)
+	}
+	text := fmt.Sprintf("status %s", st.Status)
+	if st.Scope != "" {
+		text += fmt.Sprintf(", scope %s", st.Scope)
+	}
+	if st.Schemes != "" {
+		text += fmt.Sprintf(", schemes %s", st.Schemes)
+	}
+	return fmt.Errorf("%w: %s", ErrTokenRejected, text)
+}
+
+func joinOAuthError(err error, statusErr error) error {
+	if statusErr != nil {
+		return fmt.Errorf("%w: %w", statusErr, err)
+	}
+	return err
+}
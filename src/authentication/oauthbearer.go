@@ -0,0 +1,82 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+type AuthOAuthBearer struct {
+	hostname string
+	port     int
+	user     string
+	token    string
+}
+
+func NewAuthOAuthBearer(hostname string, port int, user string, token string) *AuthOAuthBearer {
+	return &AuthOAuthBearer{hostname: hostname, port: port, user: user, token: token}
+}
+
+func (a *AuthOAuthBearer) Check() error {
+	var errMsgs []error
+	if (*a).hostname == "" {
+		errMsgs = append(errMsgs, fmt.Errorf("no hostname provided"))
+	}
+	if (*a).token == "" {
+		errMsgs = append(errMsgs, fmt.Errorf("no token provided"))
+	}
+	return errors.Join(errMsgs...)
+}
+
+func (a *AuthOAuthBearer) GetType() types.AuthenticationMethod {
+	return types.OAuthBearerAuth
+}
+
+func (a *AuthOAuthBearer) Authenticate(ctx context.Context, client *smtp.Client, server *ServerCapabilities) error {
+	if err := a.Check(); err != nil {
+		return err
+	}
+
+	auth := &oauthBearerAuth{hostname: (*a).hostname, port: (*a).port, user: (*a).user, token: (*a).token}
+	if err := authenticate(ctx, client, auth); err != nil {
+		return joinOAuthError(err, (*auth).statusErr)
+	}
+	return nil
+}
+
+// oauthBearerAuth implements smtp.Auth for the OAUTHBEARER mechanism (RFC 7628)
+type oauthBearerAuth struct {
+	hostname  string
+	port      int
+	user      string
+	token     string
+	statusErr error
+}
+
+func (o *oauthBearerAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkServerInfo(server, (*o).hostname); err != nil {
+		return "", nil, err
+	}
+	gs2Header := "n,,"
+	if (*o).user != "" {
+		gs2Header = fmt.Sprintf("n,a=%s,", saslName((*o).user))
+	}
+	resp := fmt.Sprintf("%s\x01host=%s\x01", gs2Header, (*o).hostname)
+	if (*o).port != 0 {
+		resp += fmt.Sprintf("port=%d\x01", (*o).port)
+	}
+	resp += fmt.Sprintf("auth=Bearer %s\x01\x01", (*o).token)
+	return "OAUTHBEARER", []byte(resp), nil
+}
+
+func (o *oauthBearerAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	// The server sends an error status as challenge, which has to be answered with a single %x01
+	(*o).statusErr = parseOAuthStatus(fromServer)
+	return []byte{0x01}, nil
+}
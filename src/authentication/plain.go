@@ -1,6 +1,7 @@
 package authentication
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/smtp"
@@ -36,13 +37,13 @@ func (a *AuthPlain) GetType() types.AuthenticationMethod {
 	return types.PlainAuth
 }
 
-func (a *AuthPlain) Authenticate(client *smtp.Client) error {
+func (a *AuthPlain) Authenticate(ctx context.Context, client *smtp.Client, server *ServerCapabilities) error {
 	if err := a.Check(); err != nil {
 		return err
 	}
 
 	auth := smtp.PlainAuth("", (*a).user, (*a).password, (*a).hostname)
-	if err := client.Auth(auth); err != nil {
+	if err := authenticate(ctx, client, auth); err != nil {
 		return err
 	}
 	return nil
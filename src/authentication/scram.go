@@ -0,0 +1,279 @@
+package authentication
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/smtp"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/types"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/text/secure/precis"
+)
+
+const (
+	scramMinIterations = 4096 // RFC 5802 section 5.1
+	scramNonceLength   = 24
+
+	cbTlsUnique   = "tls-unique"
+	cbTlsExporter = "tls-exporter"
+)
+
+// Enhanced status code of a successful reply, e.g. 2.7.0 (RFC 3463 section 2)
+var enhancedSuccessRegex = regexp.MustCompile(`^2\.\d{1,3}\.\d{1,3}$`)
+
+var (
+	ErrChannelBindingNoTls = errors.New("channel binding requires a TLS connection")
+	ErrChannelBinding      = errors.New("cannot obtain channel binding data")
+	ErrScramServer         = errors.New("SCRAM authentication failed")
+	ErrServerSignature     = errors.New("server signature could not be verified")
+)
+
+type AuthScram struct {
+	method   types.AuthenticationMethod
+	user     string
+	password string
+}
+
+func NewAuthScram(method types.AuthenticationMethod, user string, password string) *AuthScram {
+	return &AuthScram{method: method, user: user, password: password}
+}
+
+func (a *AuthScram) Check() error {
+	var errMsgs []error
+	if _, _, err := getScramMechanism((*a).method); err != nil {
+		errMsgs = append(errMsgs, err)
+	}
+	if (*a).user == "" {
+		errMsgs = append(errMsgs, fmt.Errorf("no login user provided"))
+	}
+	if (*a).password == "" {
+		errMsgs = append(errMsgs, fmt.Errorf("no password provided"))
+	}
+	return errors.Join(errMsgs...)
+}
+
+func (a *AuthScram) GetType() types.AuthenticationMethod {
+	return (*a).method
+}
+
+func (a *AuthScram) Authenticate(ctx context.Context, client *smtp.Client, server *ServerCapabilities) error {
+	if err := a.Check(); err != nil {
+		return err
+	}
+	mechanism, newHash, _ := getScramMechanism((*a).method)
+	user, err := precis.OpaqueString.String((*a).user)
+	if err != nil {
+		return fmt.Errorf("invalid login user: %w", err)
+	}
+	password, err := precis.OpaqueString.String((*a).password)
+	if err != nil {
+		return fmt.Errorf("invalid password: %w", err)
+	}
+
+	state, tlsActive := client.TLSConnectionState()
+	var gs2Header string
+	var cbData []byte
+	switch {
+	case strings.HasSuffix(mechanism, "-PLUS"):
+		if !tlsActive {
+			return ErrChannelBindingNoTls
+		}
+		var cbType string
+		cbType, cbData, err = getChannelBinding(&state)
+		if err != nil {
+			return err
+		}
+		gs2Header = fmt.Sprintf("p=%s,,", cbType)
+	case tlsActive && !server.Advertises(mechanism+"-PLUS"):
+		// Channel binding is supported by gosend, but the server does not offer it
+		gs2Header = "y,,"
+	default:
+		gs2Header = "n,,"
+	}
+
+	nonce, err := getNonce()
+	if err != nil {
+		return err
+	}
+	auth := &scramAuth{
+		mechanism: mechanism,
+		newHash:   newHash,
+		user:      user,
+		password:  password,
+		gs2Header: gs2Header,
+		cbData:    cbData,
+		nonce:     nonce,
+	}
+	return authenticate(ctx, client, auth)
+}
+
+// scramAuth implements smtp.Auth for the SCRAM mechanisms (RFC 5802, RFC 7677)
+type scramAuth struct {
+	mechanism string
+	newHash   func() hash.Hash
+	user      string
+	password  string
+	gs2Header string
+	cbData    []byte
+	nonce     string
+
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool
+}
+
+func (s *scramAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	(*s).clientFirstBare = fmt.Sprintf("n=%s,r=%s", saslName((*s).user), (*s).nonce)
+	return (*s).mechanism, []byte((*s).gs2Header + (*s).clientFirstBare), nil
+}
+
+func (s *scramAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		// Some servers send the server-final-message as additional data with the 235 reply, after the enhanced status code
+		if !(*s).verified {
+			if decoded, err := base64.StdEncoding.DecodeString(stripEnhancedCode(string(fromServer))); err == nil {
+				if err := s.verifyServerFinal(decoded); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !(*s).verified {
+			return nil, ErrServerSignature
+		}
+		return nil, nil
+	}
+
+	if (*s).serverSignature == nil {
+		return s.clientFinal(fromServer)
+	}
+	if err := s.verifyServerFinal(fromServer); err != nil {
+		return nil, err
+	}
+	return []byte{}, nil
+}
+
+func (s *scramAuth) clientFinal(serverFirst []byte) ([]byte, error) {
+	attrs, err := parseScramAttributes(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+	nonce, salt64, iter := attrs['r'], attrs['s'], attrs['i']
+	if !strings.HasPrefix(nonce, (*s).nonce) || len(nonce) == len((*s).nonce) {
+		return nil, fmt.Errorf("%w: invalid server nonce", ErrScramServer)
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("%w: invalid salt", ErrScramServer)
+	}
+	iterations, err := strconv.Atoi(iter)
+	if err != nil || iterations < scramMinIterations {
+		return nil, fmt.Errorf("%w: invalid iteration count %s", ErrScramServer, iter)
+	}
+
+	cbInput := append([]byte((*s).gs2Header), (*s).cbData...)
+	clientFinalWithoutProof := fmt.Sprintf("c=%s,r=%s", base64.StdEncoding.EncodeToString(cbInput), nonce)
+	authMessage := []byte((*s).clientFirstBare + "," + string(serverFirst) + "," + clientFinalWithoutProof)
+
+	saltedPassword := pbkdf2.Key([]byte((*s).password), salt, iterations, (*s).newHash().Size(), (*s).newHash)
+	clientKey := s.hmac(saltedPassword, []byte("Client Key"))
+	h := (*s).newHash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	clientSignature := s.hmac(storedKey, authMessage)
+	clientProof := make([]byte, len(clientKey))
+	subtle.XORBytes(clientProof, clientKey, clientSignature)
+
+	serverKey := s.hmac(saltedPassword, []byte("Server Key"))
+	(*s).serverSignature = s.hmac(serverKey, authMessage)
+
+	return []byte(fmt.Sprintf("%s,p=%s", clientFinalWithoutProof, base64.StdEncoding.EncodeToString(clientProof))), nil
+}
+
+func (s *scramAuth) verifyServerFinal(serverFinal []byte) error {
+	attrs, err := parseScramAttributes(serverFinal)
+	if err != nil {
+		return err
+	}
+	if e, ok := attrs['e']; ok {
+		return fmt.Errorf("%w: %s", ErrScramServer, e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil || (*s).serverSignature == nil || !hmac.Equal(signature, (*s).serverSignature) {
+		return ErrServerSignature
+	}
+	(*s).verified = true
+	return nil
+}
+
+func (s *scramAuth) hmac(key, data []byte) []byte {
+	mac := hmac.New((*s).newHash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func getScramMechanism(method types.AuthenticationMethod) (string, func() hash.Hash, error) {
+	switch method {
+	case types.ScramSha1Auth, types.ScramSha1PlusAuth:
+		return strings.ToUpper(method.String()), sha1.New, nil
+	case types.ScramSha256Auth, types.ScramSha256PlusAuth:
+		return strings.ToUpper(method.String()), sha256.New, nil
+	default:
+		return "", nil, fmt.Errorf("%w: %s", types.ErrAuthenticationInvalid, method)
+	}
+}
+
+// getChannelBinding returns tls-exporter (RFC 9266) for TLS 1.3 and tls-unique (RFC 5929) for older versions
+func getChannelBinding(state *tls.ConnectionState) (string, []byte, error) {
+	if (*state).Version >= tls.VersionTLS13 {
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %w", ErrChannelBinding, err)
+		}
+		return cbTlsExporter, data, nil
+	}
+	if len((*state).TLSUnique) == 0 {
+		return "", nil, ErrChannelBinding
+	}
+	return cbTlsUnique, (*state).TLSUnique, nil
+}
+
+func getNonce() (string, error) {
+	b := make([]byte, scramNonceLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// stripEnhancedCode removes the enhanced status code from the start of the text of a successful reply
+func stripEnhancedCode(msg string) string {
+	field, rest, found := strings.Cut(msg, " ")
+	if found && enhancedSuccessRegex.MatchString(field) {
+		return rest
+	}
+	return msg
+}
+
+func parseScramAttributes(message []byte) (map[byte]string, error) {
+	attrs := make(map[byte]string)
+	for _, part := range bytes.Split(message, []byte(",")) {
+		if len(part) < 2 || part[1] != '=' {
+			return nil, fmt.Errorf("%w: invalid message %q", ErrScramServer, message)
+		}
+		attrs[part[0]] = string(part[2:])
+	}
+	return attrs, nil
+}
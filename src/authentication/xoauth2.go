@@ -0,0 +1,75 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+type AuthXOAuth2 struct {
+	hostname string
+	user     string
+	token    string
+}
+
+func NewAuthXOAuth2(hostname string, user string, token string) *AuthXOAuth2 {
+	return &AuthXOAuth2{hostname: hostname, user: user, token: token}
+}
+
+func (a *AuthXOAuth2) Check() error {
+	var errMsgs []error
+	if (*a).hostname == "" {
+		errMsgs = append(errMsgs, fmt.Errorf("no hostname provided"))
+	}
+	if (*a).user == "" {
+		errMsgs = append(errMsgs, fmt.Errorf("no login user provided"))
+	}
+	if (*a).token == "" {
+		errMsgs = append(errMsgs, fmt.Errorf("no token provided"))
+	}
+	return errors.Join(errMsgs...)
+}
+
+func (a *AuthXOAuth2) GetType() types.AuthenticationMethod {
+	return types.XOAuth2Auth
+}
+
+func (a *AuthXOAuth2) Authenticate(ctx context.Context, client *smtp.Client, server *ServerCapabilities) error {
+	if err := a.Check(); err != nil {
+		return err
+	}
+
+	auth := &xoauth2Auth{hostname: (*a).hostname, user: (*a).user, token: (*a).token}
+	if err := authenticate(ctx, client, auth); err != nil {
+		return joinOAuthError(err, (*auth).statusErr)
+	}
+	return nil
+}
+
+// xoauth2Auth implements smtp.Auth for the XOAUTH2 mechanism of Google and Microsoft
+type xoauth2Auth struct {
+	hostname  string
+	user      string
+	token     string
+	statusErr error
+}
+
+func (x *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkServerInfo(server, (*x).hostname); err != nil {
+		return "", nil, err
+	}
+	resp := fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", (*x).user, (*x).token)
+	return "XOAUTH2", []byte(resp), nil
+}
+
+func (x *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	// The server sends an error status as challenge, which has to be answered with an empty response
+	(*x).statusErr = parseOAuthStatus(fromServer)
+	return []byte{}, nil
+}
@@ -7,11 +7,18 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 	"os"
 	"time"
 )
 
+var (
+	ErrInvalidPem = errors.New("invalid PEM file")
+)
+
+// CreateCertificate creates a self-signed server certificate for hostname
 func CreateCertificate(organisation, hostname string) (string, string, error) {
 	// Generate a private key
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -34,7 +41,96 @@ func CreateCertificate(organisation, hostname string) (string, string, error) {
 	}
 
 	// Create a self-signed certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	return writeCertificate(&template, &template, priv, priv)
+}
+
+// CreateCA creates a self-signed certificate authority that can sign certificates with CreateClientCertificate
+func CreateCA(organisation string) (string, string, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Organization: []string{organisation},
+			CommonName:   organisation + " CA",
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return writeCertificate(&template, &template, priv, priv)
+}
+
+// CreateServerCertificate creates a server certificate for hostname, signed by the CA in caCertPath and caKeyPath
+func CreateServerCertificate(organisation, hostname, caCertPath, caKeyPath string) (string, string, error) {
+	caCert, caKey, err := readCertificate(caCertPath, caKeyPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return "", "", err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{organisation},
+			CommonName:   hostname,
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{hostname},
+	}
+	return writeCertificate(&template, caCert, priv, caKey)
+}
+
+// CreateClientCertificate creates a client certificate for commonName, signed by the CA in caCertPath and caKeyPath
+func CreateClientCertificate(organisation, commonName, caCertPath, caKeyPath string) (string, string, error) {
+	caCert, caKey, err := readCertificate(caCertPath, caKeyPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return "", "", err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{organisation},
+			CommonName:   commonName,
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	return writeCertificate(&template, caCert, priv, caKey)
+}
+
+func writeCertificate(template, parent *x509.Certificate, priv, parentPriv *ecdsa.PrivateKey) (string, string, error) {
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, &priv.PublicKey, parentPriv)
 	if err != nil {
 		return "", "", err
 	}
@@ -61,3 +157,32 @@ func CreateCertificate(organisation, hostname string) (string, string, error) {
 
 	return certOut.Name(), keyOut.Name(), nil
 }
+
+func readCertificate(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPem, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPem)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidPem, certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPem, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPem)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidPem, keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
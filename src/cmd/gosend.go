@@ -1,19 +1,37 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Sternisaea/gosend/src/authentication"
 	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/message"
+	"github.com/Sternisaea/gosend/src/oauth"
 	"github.com/Sternisaea/gosend/src/secureconnection"
 	"github.com/Sternisaea/gosend/src/send"
+	"github.com/Sternisaea/gosend/src/types"
 )
 
 var version = "development"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "vault" {
+		os.Exit(runVault(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "probe" {
+		// The probe subcommand accepts the regular server flags
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		os.Exit(runProbe(os.Stdout, os.Stderr))
+	}
+
 	st, err := cmdflags.GetSettings(os.Stdout, version)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
@@ -22,12 +40,32 @@ func main() {
 	if st == nil {
 		return
 	}
+	switch st.Deliver {
+	case types.MxDelivery:
+		os.Exit(runMx(st, os.Stdout, os.Stderr))
+	case types.LmtpDelivery:
+		os.Exit(runLmtp(st, os.Stdout, os.Stderr))
+	case types.SendmailDelivery:
+		os.Exit(runSendmail(st, os.Stderr))
+	}
 
+	discover := secureconnection.IsDiscover(st.SmtpHost)
 	conn, err := secureconnection.GetSecureConnection(st)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(2)
 	}
+	if discover {
+		log.Printf("Discovered submission server %s port %d (%s)", st.SmtpHost, st.SmtpPort, st.Security)
+	}
+
+	loginCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = oauth.GetAccessToken(loginCtx, st, os.Stdout)
+	stop()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
 
 	auth, err := authentication.GetAuthentication(st)
 	if err != nil {
@@ -35,7 +73,12 @@ func main() {
 		os.Exit(2)
 	}
 
+	retry := send.GetRetryPolicy(st)
+	recipients := send.GetRecipientPolicy(st)
 	send := send.NewSmtpSend(conn, auth)
+	send.SetRetry(retry)
+	send.SetRecipientPolicy(recipients)
+	send.SetLogger(log.Printf)
 	if err := send.CreateMessage(st); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
@@ -45,11 +88,97 @@ func main() {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(2)
 	} else {
-		if err := send.SendMail(); err != nil {
+		ctx, cancel := sessionContext(st)
+		err := send.SendMail(ctx)
+		cancel()
+		printRecipients(send.GetResults(), isSent(err), os.Stdout, os.Stderr)
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err)
-			os.Exit(1)
+			os.Exit(exitCode(err))
 		}
 	}
 
 	log.Printf("E-mail sent succesfully")
 }
+
+// sessionContext returns the context of the SMTP sessions, which is cancelled by Ctrl-C or SIGTERM and ends after the total timeout
+func sessionContext(st *cmdflags.Settings) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if st.TotalTimeout == 0 {
+		return ctx, stop
+	}
+	ctx, cancel := context.WithTimeout(ctx, st.TotalTimeout.GetDuration())
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// printRecipients prints the reply of the server for every recipient that was tried. Accepted recipients are only printed when the message was sent.
+func printRecipients(results []message.RecipientResult, sent bool, output io.Writer, errOutput io.Writer) {
+	for _, r := range results {
+		switch {
+		case !r.Accepted():
+			fmt.Fprintf(errOutput, "%s: rejected: %s\n", r.Recipient, r.Err)
+		case sent:
+			fmt.Fprintf(output, "%s: accepted (%d)\n", r.Recipient, r.Code)
+		}
+	}
+}
+
+// isSent reports whether the message was delivered to all or part of the recipients
+func isSent(err error) bool {
+	return err == nil || errors.Is(err, send.ErrPartialDelivery)
+}
+
+// Exit codes of a failed delivery. Except for a partial delivery, they are the codes of sysexits.h also used by sendmail.
+const (
+	exitPartialDelivery = 3
+	exitNoUser          = 67 // EX_NOUSER: a recipient was rejected permanently
+	exitNoHost          = 68 // EX_NOHOST: the host name of the server was not found
+	exitUnavailable     = 69 // EX_UNAVAILABLE: the server rejected permanently
+	exitTempFail        = 75 // EX_TEMPFAIL: a transient failure, the message may be sent later
+	exitProtocol        = 76 // EX_PROTOCOL: STARTTLS or the TLS handshake failed
+	exitNoPerm          = 77 // EX_NOPERM: authentication failed
+)
+
+// exitCode returns the exit code of a failed delivery, or 1 when it has no specific code, e.g. when it was aborted by Ctrl-C
+func exitCode(err error) int {
+	if errors.Is(err, send.ErrPartialDelivery) {
+		return exitPartialDelivery
+	}
+	if errors.Is(err, context.Canceled) {
+		return 1
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return exitTempFail
+	}
+	var sendmailErr *send.SendmailError
+	if errors.As(err, &sendmailErr) && sendmailErr.ExitCode >= 64 && sendmailErr.ExitCode <= 78 {
+		return sendmailErr.ExitCode
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return exitNoHost
+	}
+
+	var smtpErr *send.SmtpError
+	if errors.As(err, &smtpErr) {
+		switch {
+		case send.IsTransient(smtpErr):
+			return exitTempFail
+		case smtpErr.Phase == types.AuthPhase:
+			return exitNoPerm
+		case smtpErr.Phase == types.StartTlsPhase:
+			return exitProtocol
+		case smtpErr.Phase == types.RcptPhase && smtpErr.Permanent():
+			return exitNoUser
+		case smtpErr.Permanent():
+			return exitUnavailable
+		}
+	}
+	if send.IsTransient(err) {
+		return exitTempFail
+	}
+	return 1
+}
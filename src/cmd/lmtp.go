@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/secureconnection"
+	"github.com/Sternisaea/gosend/src/send"
+)
+
+// runLmtp delivers the message into a mail store with LMTP, prints the outcome per recipient and returns the exit code.
+// Accepted recipients are only printed when the message was sent.
+func runLmtp(st *cmdflags.Settings, output io.Writer, errOutput io.Writer) int {
+	conn, err := secureconnection.GetLmtpConnection(st)
+	if err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 2
+	}
+	lmtp := send.NewLmtpSend(conn)
+	lmtp.SetRecipientPolicy(send.GetRecipientPolicy(st))
+	if err := lmtp.CreateMessage(st); err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 1
+	}
+	if err := lmtp.CheckMessage(); err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 2
+	}
+
+	ctx, cancel := sessionContext(st)
+	defer cancel()
+	err = lmtp.SendMail(ctx)
+	sent := isSent(err)
+	for _, r := range lmtp.GetResults() {
+		switch {
+		case r.Err != nil:
+			fmt.Fprintf(errOutput, "%s: failed: %s\n", r.Recipient, r.Err)
+		case sent:
+			fmt.Fprintf(output, "%s: delivered to %s\n", r.Recipient, conn.GetAddress())
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return exitCode(err)
+	}
+	return 0
+}
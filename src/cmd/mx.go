@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/secureconnection"
+	"github.com/Sternisaea/gosend/src/send"
+)
+
+// runMx delivers the message directly to the MX hosts of the recipient domains, prints the outcome per domain and returns the exit code
+func runMx(st *cmdflags.Settings, output io.Writer, errOutput io.Writer) int {
+	mx := send.NewMxSend(int(st.SmtpPort), secureconnection.GetTlsPolicy(st))
+	cache, err := secureconnection.GetStsCache(st)
+	if err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 1
+	}
+	mx.SetStsCache(cache)
+	mx.SetLogger(log.Printf)
+	proxy, err := secureconnection.GetProxy(st)
+	if err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 2
+	}
+	mx.SetProxy(proxy)
+	mx.SetTimeouts(secureconnection.GetTimeouts(st))
+	mx.SetSource(secureconnection.GetSource(st))
+	mx.SetEhloName(secureconnection.GetEhloName(st))
+	mx.SetRecipientPolicy(send.GetRecipientPolicy(st))
+	if err := mx.CreateMessage(st); err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 1
+	}
+	if err := mx.CheckMessage(); err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 2
+	}
+
+	ctx, cancel := sessionContext(st)
+	defer cancel()
+	err = mx.SendMail(ctx)
+	for _, r := range mx.GetResults() {
+		recipients := strings.Join(r.Recipients, ", ")
+		if r.StsMode != "" {
+			recipients += fmt.Sprintf(" (MTA-STS %s)", r.StsMode)
+		}
+		switch {
+		case r.Err != nil && r.Host != "":
+			fmt.Fprintf(errOutput, "%s: failed at %s for %s: %s\n", r.Domain, r.Host, recipients, r.Err)
+		case r.Err != nil:
+			fmt.Fprintf(errOutput, "%s: failed for %s: %s\n", r.Domain, recipients, r.Err)
+		case r.Tls:
+			fmt.Fprintf(output, "%s: delivered to %s with TLS for %s\n", r.Domain, r.Host, recipients)
+		default:
+			fmt.Fprintf(output, "%s: delivered to %s without TLS for %s\n", r.Domain, r.Host, recipients)
+		}
+		for _, rcpt := range r.Results {
+			if !rcpt.Accepted() {
+				fmt.Fprintf(errOutput, "%s: rejected by %s: %s\n", rcpt.Recipient, r.Host, rcpt.Err)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return exitCode(err)
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/secureconnection"
+)
+
+// runProbe prints the certificate chain presented by the SMTP server with its fingerprints and returns the exit code
+func runProbe(output io.Writer, errOutput io.Writer) int {
+	st, err := cmdflags.GetSettings(output, version)
+	if err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 2
+	}
+	if st == nil {
+		return 0
+	}
+
+	discover := secureconnection.IsDiscover(st.SmtpHost)
+	conn, err := secureconnection.GetSecureConnection(st)
+	if err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 2
+	}
+	if discover {
+		fmt.Fprintf(output, "server: %s port %d (%s)\n", st.SmtpHost, st.SmtpPort, st.Security)
+	}
+	prober, ok := conn.(secureconnection.CertificateProber)
+	if !ok {
+		fmt.Fprintf(errOutput, "security protocol '%s' does not use TLS\n", conn.GetType())
+		return 2
+	}
+
+	ctx, cancel := sessionContext(st)
+	defer cancel()
+	chain, err := prober.ProbeCertificates(ctx)
+	if err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 1
+	}
+	for i, cert := range chain {
+		fmt.Fprintf(output, "%d: %s\n", i, cert.Subject)
+		fmt.Fprintf(output, "   issuer:     %s\n", cert.Issuer)
+		fmt.Fprintf(output, "   valid:      %s - %s\n", cert.NotBefore.Format("2006-01-02"), cert.NotAfter.Format("2006-01-02"))
+		if len(cert.DNSNames) > 0 {
+			fmt.Fprintf(output, "   names:      %v\n", cert.DNSNames)
+		}
+		fmt.Fprintf(output, "   tls-pin:    spki:%s\n", secureconnection.SpkiFingerprint(cert))
+		fmt.Fprintf(output, "   tls-pin:    cert:%s\n", secureconnection.CertificateFingerprint(cert))
+	}
+
+	// Report whether a regular connection with the current settings would be accepted
+	_, close, _, err := conn.ClientConnect(ctx)
+	if err != nil {
+		fmt.Fprintf(output, "verification: failed: %s\n", err)
+		return 1
+	}
+	close()
+	fmt.Fprintf(output, "verification: ok\n")
+	return 0
+}
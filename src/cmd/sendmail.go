@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/send"
+)
+
+// runSendmail hands the message to the local sendmail command and returns the exit code
+func runSendmail(st *cmdflags.Settings, errOutput io.Writer) int {
+	sendmail := send.NewSendmailSend(st.Sendmail)
+	if err := sendmail.CreateMessage(st); err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 1
+	}
+	if err := sendmail.CheckMessage(); err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 2
+	}
+
+	ctx, cancel := sessionContext(st)
+	defer cancel()
+	if err := sendmail.SendMail(ctx); err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return exitCode(err)
+	}
+	return 0
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/vault"
+	"golang.org/x/term"
+)
+
+const vaultUsage = `Usage: gosend vault [-vault-file path] <command> [name]
+
+Commands:
+  init           Create a new vault protected by a passphrase
+  set <name>     Store a secret (read from the terminal or standard input)
+  get <name>     Print a secret
+  list           List the names of the stored secrets
+  remove <name>  Remove a secret
+
+Refer to an entry in a settings file with e.g. password="vault:<name>".
+`
+
+var ErrPassphraseMismatch = errors.New("passphrases do not match")
+
+// runVault handles the vault subcommands and returns the exit code
+func runVault(args []string, output io.Writer, errOutput io.Writer) int {
+	fs := flag.NewFlagSet("vault", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	vaultFile := fs.String("vault-file", "", "Path to credential vault.")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fmt.Fprint(errOutput, vaultUsage)
+		return 2
+	}
+	path := *vaultFile
+	if path == "" {
+		var err error
+		if path, err = vault.DefaultPath(); err != nil {
+			fmt.Fprintf(errOutput, "%s\n", err)
+			return 1
+		}
+	}
+
+	command, name := fs.Arg(0), fs.Arg(1)
+	needsName := command == "set" || command == "get" || command == "remove"
+	if (needsName && (name == "" || fs.NArg() != 2)) || (!needsName && fs.NArg() != 1) {
+		fmt.Fprint(errOutput, vaultUsage)
+		return 2
+	}
+
+	if err := vaultCommand(path, command, name, output); err != nil {
+		fmt.Fprintf(errOutput, "%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func vaultCommand(path, command, name string, output io.Writer) error {
+	if command == "init" {
+		passphrase, err := newPassphrase()
+		if err != nil {
+			return err
+		}
+		if _, err := vault.Create(path, passphrase); err != nil {
+			return err
+		}
+		fmt.Fprintf(output, "Vault created: %s\n", path)
+		return nil
+	}
+
+	passphrase, err := cmdflags.VaultPassphrase()
+	if err != nil {
+		return err
+	}
+	v, err := vault.Open(path, passphrase)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "set":
+		secret, err := readVaultSecret(name)
+		if err != nil {
+			return err
+		}
+		if err := v.Set(name, secret); err != nil {
+			return err
+		}
+		return v.Save()
+	case "get":
+		secret, err := v.Get(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(output, secret)
+	case "list":
+		for _, n := range v.List() {
+			fmt.Fprintln(output, n)
+		}
+	case "remove":
+		if err := v.Remove(name); err != nil {
+			return err
+		}
+		return v.Save()
+	default:
+		return fmt.Errorf("unknown vault command: %s", command)
+	}
+	return nil
+}
+
+func newPassphrase() (string, error) {
+	if passphrase, ok := os.LookupEnv(vault.EnvVaultPassphrase); ok {
+		return passphrase, nil
+	}
+	passphrase, err := cmdflags.PromptSecret("New vault passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	confirm, err := cmdflags.PromptSecret("Repeat vault passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != confirm {
+		return "", ErrPassphraseMismatch
+	}
+	return passphrase, nil
+}
+
+// readVaultSecret prompts for the secret on a terminal, otherwise the first line of standard input is used
+func readVaultSecret(name string) (string, error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return cmdflags.PromptSecret(fmt.Sprintf("Secret for %s: ", name))
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,277 @@
+package cmdflags
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/types"
+	"github.com/Sternisaea/gosend/src/vault"
+	"golang.org/x/term"
+)
+
+const (
+	EnvPassword = "GOSEND_PASSWORD"
+	EnvToken    = "GOSEND_TOKEN"
+	EnvNetrc    = "NETRC"
+)
+
+var (
+	ErrCredentialCommand   = errors.New("credential command failed")
+	ErrNoCredentialCommand = errors.New("no credential command provided")
+	ErrNoNetrcEntry        = errors.New("no matching entry in netrc file")
+	ErrNoNetrcPassword     = errors.New("no password in netrc entry")
+	ErrEnvNotSet           = errors.New("environment variable not set")
+	ErrNoTerminal          = errors.New("cannot prompt for credentials without a terminal")
+)
+
+// PromptSecret reads a secret from the terminal with echo turned off. It may be replaced, e.g. for testing.
+var PromptSecret = func(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", ErrNoTerminal
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// Confirm asks a yes or no question on the terminal, e.g. to use a discovered server. Without a terminal the answer is no.
+// It may be replaced, e.g. for testing.
+var Confirm = func(question string) (bool, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false, ErrNoTerminal
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// VaultPassphrase provides the passphrase of the credential vault: $GOSEND_VAULT_PASSPHRASE or a terminal prompt.
+// It may be replaced, e.g. for testing.
+var VaultPassphrase = func() (string, error) {
+	if passphrase, ok := os.LookupEnv(vault.EnvVaultPassphrase); ok {
+		return passphrase, nil
+	}
+	return PromptSecret("Vault passphrase: ")
+}
+
+// ReadSecret obtains a password or token from the given source:
+//   - command: the first line of the output of command, run by the shell
+//   - netrc: the password of the entry for host (and login if provided) in $NETRC or ~/.netrc, an entry without password is an error
+//   - env: the environment variable envVar
+//   - prompt: the terminal, after showing prompt
+func ReadSecret(source types.CredentialSource, command, host, login, envVar, prompt string) (string, error) {
+	switch source {
+	case types.NoCredentialSource:
+		return "", nil
+	case types.CommandCredentialSource:
+		return runCredentialCommand(command)
+	case types.NetrcCredentialSource:
+		entryLogin, password, err := lookupNetrc(host, login)
+		if err != nil {
+			return "", err
+		}
+		if password == "" {
+			return "", fmt.Errorf("%w: %s %s", ErrNoNetrcPassword, host, entryLogin)
+		}
+		return password, nil
+	case types.EnvCredentialSource:
+		secret, ok := os.LookupEnv(envVar)
+		if !ok {
+			return "", fmt.Errorf("%w: %s", ErrEnvNotSet, envVar)
+		}
+		return secret, nil
+	case types.PromptCredentialSource:
+		return PromptSecret(prompt)
+	default:
+		return "", fmt.Errorf("%w: %s", types.ErrCredentialSourceInvalid, source)
+	}
+}
+
+// ResolveCredentials fills the password and token from their sources for the SMTP host, unless provided directly.
+// GetSettings does so, except when the SMTP host is still to be discovered.
+func ResolveCredentials(st *Settings) error {
+	if err := resolveCredentials(st); err != nil {
+		return err
+	}
+	return resolveVaultReferences(st)
+}
+
+// resolveCredentials fills the password and token from their sources, unless provided directly
+func resolveCredentials(st *Settings) error {
+	host := (*st).SmtpHost.String()
+	if (*st).Login == "" && ((*st).PasswordSource == types.NetrcCredentialSource || (*st).TokenSource == types.NetrcCredentialSource) {
+		// The login of the netrc entry is used when no login is provided
+		if login, _, err := lookupNetrc(host, ""); err == nil {
+			(*st).Login = login
+		}
+	}
+
+	if (*st).Password == "" {
+		password, err := ReadSecret((*st).PasswordSource, (*st).PasswordCommand, host, (*st).Login, EnvPassword, fmt.Sprintf("Password for %s@%s: ", (*st).Login, host))
+		if err != nil {
+			return fmt.Errorf("cannot read password: %w", err)
+		}
+		(*st).Password = password
+	}
+	if (*st).Token == "" {
+		token, err := ReadSecret((*st).TokenSource, (*st).TokenCommand, host, (*st).Login, EnvToken, fmt.Sprintf("Token for %s@%s: ", (*st).Login, host))
+		if err != nil {
+			return fmt.Errorf("cannot read token: %w", err)
+		}
+		(*st).Token = token
+	}
+	return nil
+}
+
+// resolveVaultReferences replaces values like vault:work-relay by the secret of the vault entry. The vault is only opened when referenced.
+func resolveVaultReferences(st *Settings) error {
+	var v *vault.Vault
+	for _, value := range []*string{&(*st).Password, &(*st).Token, &(*st).OAuthClientSecret, &(*st).OAuthRefreshToken} {
+		name, ok := strings.CutPrefix(*value, vault.ReferencePrefix)
+		if !ok {
+			continue
+		}
+		if v == nil {
+			path := (*st).VaultFile.String()
+			if path == "" {
+				var err error
+				if path, err = vault.DefaultPath(); err != nil {
+					return err
+				}
+			}
+			passphrase, err := VaultPassphrase()
+			if err != nil {
+				return fmt.Errorf("cannot open vault: %w", err)
+			}
+			if v, err = vault.Open(path, passphrase); err != nil {
+				return fmt.Errorf("cannot open vault: %w", err)
+			}
+		}
+		secret, err := v.Get(name)
+		if err != nil {
+			return err
+		}
+		*value = secret
+	}
+	return nil
+}
+
+func runCredentialCommand(command string) (string, error) {
+	if command == "" {
+		return "", ErrNoCredentialCommand
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %w: %s", ErrCredentialCommand, err, msg)
+		}
+		return "", fmt.Errorf("%w: %w", ErrCredentialCommand, err)
+	}
+	secret, _, _ := strings.Cut(stdout.String(), "\n")
+	return strings.TrimSuffix(secret, "\r"), nil
+}
+
+// lookupNetrc returns login and password of the first netrc entry for host. When login is provided, it must match as well.
+// A default entry matches any host.
+func lookupNetrc(host, login string) (string, string, error) {
+	path := os.Getenv(EnvNetrc)
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", err
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, entry := range parseNetrc(content) {
+		if entry.machine != host && !entry.isDefault {
+			continue
+		}
+		if login != "" && entry.login != "" && entry.login != login {
+			continue
+		}
+		return entry.login, entry.password, nil
+	}
+	return "", "", fmt.Errorf("%w: %s", ErrNoNetrcEntry, host)
+}
+
+type netrcEntry struct {
+	machine   string
+	isDefault bool
+	login     string
+	password  string
+}
+
+func parseNetrc(content []byte) []netrcEntry {
+	var entries []netrcEntry
+	var current *netrcEntry
+	var inMacro bool
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// A macro definition ends with an empty line
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "#") {
+				break
+			}
+			value := ""
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+			switch fields[i] {
+			case "machine":
+				entries = append(entries, netrcEntry{machine: value})
+				current = &entries[len(entries)-1]
+				i++
+			case "default":
+				entries = append(entries, netrcEntry{isDefault: true})
+				current = &entries[len(entries)-1]
+			case "login":
+				if current != nil {
+					(*current).login = value
+				}
+				i++
+			case "password":
+				if current != nil {
+					(*current).password = value
+				}
+				i++
+			case "account":
+				i++
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	return entries
+}
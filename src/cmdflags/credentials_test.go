@@ -0,0 +1,132 @@
+package cmdflags
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sternisaea/gosend/src/types"
+	"github.com/Sternisaea/gosend/src/vault"
+)
+
+func Test_ReadSecret(t *testing.T) {
+	netrc, err := os.CreateTemp(os.TempDir(), "netrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(netrc.Name())
+	content := "# Mail relays\n" +
+		"machine mail.domain.local login user@domain.local password NetrcSecret\n" +
+		"machine mail.domain.local\n  login other@domain.local\n  password OtherSecret\n" +
+		"macdef init\nmachine ignored.local password Ignored\n\n" +
+		"machine relay.domain.local login relay password RelaySecret account internal\n" +
+		"machine nopassword.domain.local login user@domain.local\n"
+	if _, err := netrc.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	netrc.Close()
+	t.Setenv(EnvNetrc, netrc.Name())
+	t.Setenv("GOSEND_TEST_SECRET", "EnvSecret")
+
+	PromptSecret = func(prompt string) (string, error) {
+		if !strings.Contains(prompt, "user@domain.local") {
+			return "", errors.New("unexpected prompt")
+		}
+		return "PromptSecret", nil
+	}
+
+	type secretCheck struct {
+		name           string
+		source         types.CredentialSource
+		command        string
+		host           string
+		login          string
+		envVar         string
+		expectedSecret string
+		expectedErrors *[]error
+	}
+	checklist := []secretCheck{
+		{name: "none", source: types.NoCredentialSource, expectedSecret: ""},
+		{name: "command", source: types.CommandCredentialSource, command: "echo CmdSecret", expectedSecret: "CmdSecret"},
+		{name: "command spaces", source: types.CommandCredentialSource, command: "echo '  Cmd Secret  '", expectedSecret: "  Cmd Secret  "},
+		{name: "command failure", source: types.CommandCredentialSource, command: "echo denied >&2; exit 1", expectedErrors: &[]error{ErrCredentialCommand, errors.New("denied")}},
+		{name: "command empty", source: types.CommandCredentialSource, command: "", expectedErrors: &[]error{ErrNoCredentialCommand}},
+		{name: "netrc", source: types.NetrcCredentialSource, host: "mail.domain.local", login: "user@domain.local", expectedSecret: "NetrcSecret"},
+		{name: "netrc other login", source: types.NetrcCredentialSource, host: "mail.domain.local", login: "other@domain.local", expectedSecret: "OtherSecret"},
+		{name: "netrc no login", source: types.NetrcCredentialSource, host: "relay.domain.local", expectedSecret: "RelaySecret"},
+		{name: "netrc macro", source: types.NetrcCredentialSource, host: "ignored.local", expectedErrors: &[]error{ErrNoNetrcEntry}},
+		{name: "netrc no password", source: types.NetrcCredentialSource, host: "nopassword.domain.local", login: "user@domain.local", expectedErrors: &[]error{ErrNoNetrcPassword, errors.New("nopassword.domain.local user@domain.local")}},
+		{name: "netrc unknown host", source: types.NetrcCredentialSource, host: "unknown.local", expectedErrors: &[]error{ErrNoNetrcEntry}},
+		{name: "env", source: types.EnvCredentialSource, envVar: "GOSEND_TEST_SECRET", expectedSecret: "EnvSecret"},
+		{name: "env not set", source: types.EnvCredentialSource, envVar: "GOSEND_TEST_UNSET", expectedErrors: &[]error{ErrEnvNotSet}},
+		{name: "prompt", source: types.PromptCredentialSource, login: "user@domain.local", expectedSecret: "PromptSecret"},
+	}
+
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			secret, err := ReadSecret(c.source, c.command, c.host, c.login, c.envVar, "Password for "+c.login+": ")
+			if c.expectedErrors != nil {
+				if err == nil {
+					t.Fatalf("Expected errors %s, got no error", errors.Join(*c.expectedErrors...))
+				}
+				for _, e := range *c.expectedErrors {
+					if !strings.Contains(err.Error(), e.Error()) {
+						t.Errorf("Expected error %s, got %s", e, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if secret != c.expectedSecret {
+				t.Errorf("Expected secret %q, got %q", c.expectedSecret, secret)
+			}
+		})
+	}
+}
+
+func Test_ResolveVaultReferences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	v, err := vault.Create(path, "MyPassphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Set("work-relay", "VaultSecret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	passphrase := "MyPassphrase"
+	opened := 0
+	VaultPassphrase = func() (string, error) {
+		opened++
+		return passphrase, nil
+	}
+
+	st := &Settings{Password: "vault:work-relay", OAuthClientSecret: "vault:work-relay", OAuthRefreshToken: "vault:work-relay", Token: "NotFromVault", VaultFile: types.FilePath(path)}
+	if err := resolveVaultReferences(st); err != nil {
+		t.Fatal(err)
+	}
+	if (*st).Password != "VaultSecret" || (*st).OAuthClientSecret != "VaultSecret" || (*st).OAuthRefreshToken != "VaultSecret" || (*st).Token != "NotFromVault" {
+		t.Errorf("Unexpected settings after resolving vault references: %+v", *st)
+	}
+	if opened != 1 {
+		t.Errorf("Expected vault to be opened once, got %d", opened)
+	}
+
+	st = &Settings{Password: "vault:unknown", VaultFile: types.FilePath(path)}
+	if err := resolveVaultReferences(st); !errors.Is(err, vault.ErrEntryNotFound) {
+		t.Errorf("Expected error %s, got %v", vault.ErrEntryNotFound, err)
+	}
+
+	passphrase = "Wrong"
+	st = &Settings{Password: "vault:work-relay", VaultFile: types.FilePath(path)}
+	if err := resolveVaultReferences(st); !errors.Is(err, vault.ErrWrongPassphrase) {
+		t.Errorf("Expected error %s, got %v", vault.ErrWrongPassphrase, err)
+	}
+}
@@ -6,22 +6,82 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/Sternisaea/gosend/src/types"
+	"github.com/Sternisaea/gosend/src/vault"
 )
 
 const (
 	flagServerFile = "server-file"
 	flagSmtpHost   = "smtp-host"
 	flagSmtpPort   = "smtp-port"
+	flagProxy      = "proxy"
+
+	flagBindAddress = "bind-address"
+	flagIpFamily    = "ip-family"
+	flagEhloName    = "ehlo-name"
+
 	flagRootCA     = "rootca"
+	flagClientCert = "client-cert"
+	flagClientKey  = "client-key"
+
+	flagTlsMinVersion = "tls-min-version"
+	flagTlsMaxVersion = "tls-max-version"
+	flagTlsCiphers    = "tls-ciphers"
+	flagTlsServerName = "tls-server-name"
+	flagTlsPin        = "tls-pin"
+	flagTlsVerify     = "tls-verify"
+
+	flagLmtpAddress     = "lmtp-address"
+	flagSendmailCommand = "sendmail-command"
+
+	flagMtaStsDomain = "mta-sts-domain"
+	flagMtaStsCache  = "mta-sts-cache"
+
+	flagConnectTimeout = "connect-timeout"
+	flagCommandTimeout = "command-timeout"
+	flagTotalTimeout   = "total-timeout"
+
+	flagRetryAttempts   = "retry-attempts"
+	flagRetryDelay      = "retry-delay"
+	flagRetryJitter     = "retry-jitter"
+	flagRetryMaxElapsed = "retry-max-elapsed"
+
+	flagRecipientPolicy = "recipient-policy"
+	flagMinAccepted     = "min-accepted"
+
+	flagDsnReturn     = "dsn-ret"
+	flagDsnEnvelopeId = "dsn-envid"
+	flagDsnNotify     = "dsn-notify"
+	flagDsnOrcpt      = "dsn-orcpt"
+
 	flagSecurity   = "security"
+	flagDeliver    = "deliver"
 	flagAuthFile   = "auth-file"
 	flagAuthMethod = "auth-method"
 	flagLogin      = "login"
 	flagPassword   = "password"
+	flagToken      = "token"
+
+	flagPasswordSource  = "password-source"
+	flagPasswordCommand = "password-command"
+	flagTokenSource     = "token-source"
+	flagTokenCommand    = "token-command"
+	flagVaultFile       = "vault-file"
+
+	flagTokenExpiry       = "token-expiry"
+	flagOAuthTokenUrl     = "oauth-token-url"
+	flagOAuthDeviceUrl    = "oauth-device-url"
+	flagOAuthClientId     = "oauth-client-id"
+	flagOAuthClientSecret = "oauth-client-secret"
+	flagOAuthScope        = "oauth-scope"
+	flagOAuthRefreshToken = "oauth-refresh-token"
+
 	flagSender     = "sender"
 	flagReplyTo    = "reply-to"
 	flagTo         = "to"
@@ -40,24 +100,133 @@ const (
 var allowedInFile = []string{
 	flagSmtpHost,
 	flagSmtpPort,
+	flagProxy,
+	flagBindAddress,
+	flagIpFamily,
+	flagEhloName,
 	flagRootCA,
+	flagClientCert,
+	flagClientKey,
+	flagTlsMinVersion,
+	flagTlsMaxVersion,
+	flagTlsCiphers,
+	flagTlsServerName,
+	flagTlsPin,
+	flagTlsVerify,
 	flagSecurity,
+	flagDeliver,
+	flagLmtpAddress,
+	flagMtaStsDomain,
+	flagMtaStsCache,
+	flagConnectTimeout,
+	flagCommandTimeout,
+	flagTotalTimeout,
+	flagRetryAttempts,
+	flagRetryDelay,
+	flagRetryJitter,
+	flagRetryMaxElapsed,
+	flagRecipientPolicy,
+	flagMinAccepted,
+	flagDsnReturn,
+	flagDsnEnvelopeId,
+	flagDsnNotify,
+	flagDsnOrcpt,
 	flagAuthMethod,
 	flagLogin,
 	flagPassword,
+	flagPasswordSource,
+	flagToken,
+	flagTokenSource,
+	flagVaultFile,
+	flagTokenExpiry,
+	flagOAuthDeviceUrl,
+	flagOAuthClientId,
+	flagOAuthScope,
+	flagOAuthRefreshToken,
 	flagSender,
 }
 
-var ErrIllegalFlagOption = errors.New("illegal flag option in settings file")
+// Options that run a command are only allowed in the authentication file, as a shared server file must not execute commands.
+// The same holds for the OAuth2 token endpoint and client secret, as a shared server file must not redirect the refresh token.
+var allowedInAuthFile = append([]string{
+	flagSendmailCommand,
+	flagPasswordCommand,
+	flagTokenCommand,
+	flagOAuthTokenUrl,
+	flagOAuthClientSecret,
+}, allowedInFile...)
+
+// Keys written back to a settings file by UpdateOptionsOfFile
+const (
+	KeyToken             = flagToken
+	KeyTokenExpiry       = flagTokenExpiry
+	KeyOAuthRefreshToken = flagOAuthRefreshToken
+)
+
+var (
+	ErrIllegalFlagOption = errors.New("illegal flag option in settings file")
+	ErrNoSettingsFile    = errors.New("no settings file provided")
+)
 
 type Settings struct {
 	SmtpHost       types.DomainName
 	SmtpPort       types.TCPPort
+	Proxy          types.ProxyUrl
+	BindAddress    types.IpAddress
+	IpFamily       types.IpFamily
+	EhloName       types.DomainName
 	RootCA         types.FilePath
+	ClientCert     types.FilePath
+	ClientKey      types.FilePath
+	TlsMinVersion  types.TlsVersion
+	TlsMaxVersion  types.TlsVersion
+	TlsCiphers     types.TlsCiphers
+	TlsServerName  types.DomainName
+	TlsPins        types.TlsPins
+	TlsVerify      types.TlsVerify
 	Security       types.Security
+	Deliver        types.Delivery
+	LmtpAddress    types.LmtpAddress
+	Sendmail       types.Command
+	MtaStsDomain   types.DomainName
+	MtaStsCache    string
+	ConnectTimeout types.Duration
+	CommandTimeout types.Duration
+	TotalTimeout   types.Duration
+
+	RetryAttempts   types.Attempts
+	RetryDelay      types.Duration
+	RetryJitter     types.Duration
+	RetryMaxElapsed types.Duration
+
+	RecipientPolicy types.RecipientPolicy
+	MinAccepted     types.Count
+
+	DsnReturn     types.DsnReturn
+	DsnEnvelopeId types.DsnEnvelopeId
+	DsnNotify     types.DsnNotify
+	DsnOrcpt      types.Switch
+
 	Authentication types.AuthenticationMethod
 	Login          string
 	Password       string
+	Token          string
+
+	PasswordSource  types.CredentialSource
+	PasswordCommand string
+	TokenSource     types.CredentialSource
+	TokenCommand    string
+	VaultFile       types.FilePath
+
+	TokenExpiry types.Timestamp
+	AuthFile    types.FilePath
+
+	OAuthTokenUrl     types.Url
+	OAuthDeviceUrl    types.Url
+	OAuthClientId     string
+	OAuthClientSecret string
+	OAuthScope        string
+	OAuthRefreshToken string
 
 	Sender        types.Email
 	ReplyTo       types.EmailAddresses
@@ -82,13 +251,14 @@ func GetSettings(output io.Writer, version string) (*Settings, error) {
 	if settings == nil {
 		return nil, nil
 	}
+	(*settings).AuthFile = authFilePath
 
 	opts := make(map[string]string)
-	opts, err = appendOptionsOfFile(opts, serverFilePath)
+	opts, err = appendOptionsOfFile(opts, serverFilePath, allowedInFile)
 	if err != nil {
 		return nil, err
 	}
-	opts, err = appendOptionsOfFile(opts, authFilePath)
+	opts, err = appendOptionsOfFile(opts, authFilePath, allowedInAuthFile)
 	if err != nil {
 		return nil, err
 	}
@@ -107,6 +277,34 @@ func GetSettings(output io.Writer, version string) (*Settings, error) {
 			}
 		}
 	}
+	if (*settings).Proxy == "" {
+		if opts[flagProxy] != "" {
+			if err := (*settings).Proxy.Set(opts[flagProxy]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).BindAddress == "" {
+		if opts[flagBindAddress] != "" {
+			if err := (*settings).BindAddress.Set(opts[flagBindAddress]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).IpFamily == "" {
+		if opts[flagIpFamily] != "" {
+			if err := (*settings).IpFamily.Set(opts[flagIpFamily]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).EhloName == "" {
+		if opts[flagEhloName] != "" {
+			if err := (*settings).EhloName.Set(opts[flagEhloName]); err != nil {
+				return nil, err
+			}
+		}
+	}
 	if (*settings).RootCA == "" {
 		if opts[flagRootCA] != "" {
 			if err := (*settings).RootCA.Set(opts[flagRootCA]); err != nil {
@@ -114,6 +312,62 @@ func GetSettings(output io.Writer, version string) (*Settings, error) {
 			}
 		}
 	}
+	if (*settings).ClientCert == "" {
+		if opts[flagClientCert] != "" {
+			if err := (*settings).ClientCert.Set(opts[flagClientCert]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).ClientKey == "" {
+		if opts[flagClientKey] != "" {
+			if err := (*settings).ClientKey.Set(opts[flagClientKey]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).TlsMinVersion == 0 {
+		if opts[flagTlsMinVersion] != "" {
+			if err := (*settings).TlsMinVersion.Set(opts[flagTlsMinVersion]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).TlsMaxVersion == 0 {
+		if opts[flagTlsMaxVersion] != "" {
+			if err := (*settings).TlsMaxVersion.Set(opts[flagTlsMaxVersion]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len((*settings).TlsCiphers) == 0 {
+		if opts[flagTlsCiphers] != "" {
+			if err := (*settings).TlsCiphers.Set(opts[flagTlsCiphers]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).TlsServerName == "" {
+		if opts[flagTlsServerName] != "" {
+			if err := (*settings).TlsServerName.Set(opts[flagTlsServerName]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len((*settings).TlsPins) == 0 {
+		if opts[flagTlsPin] != "" {
+			if err := (*settings).TlsPins.Set(opts[flagTlsPin]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).TlsVerify == "" {
+		if opts[flagTlsVerify] != "" {
+			if err := (*settings).TlsVerify.Set(opts[flagTlsVerify]); err != nil {
+				return nil, err
+			}
+		}
+	}
 	if (*settings).Security == types.NoSecurity {
 		if opts[flagSecurity] != "" {
 			if err := (*settings).Security.Set(opts[flagSecurity]); err != nil {
@@ -121,6 +375,129 @@ func GetSettings(output io.Writer, version string) (*Settings, error) {
 			}
 		}
 	}
+	if (*settings).Deliver == "" {
+		if opts[flagDeliver] != "" {
+			if err := (*settings).Deliver.Set(opts[flagDeliver]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).LmtpAddress == "" {
+		if opts[flagLmtpAddress] != "" {
+			if err := (*settings).LmtpAddress.Set(opts[flagLmtpAddress]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len((*settings).Sendmail) == 0 {
+		if opts[flagSendmailCommand] != "" {
+			if err := (*settings).Sendmail.Set(opts[flagSendmailCommand]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).MtaStsDomain == "" {
+		if opts[flagMtaStsDomain] != "" {
+			if err := (*settings).MtaStsDomain.Set(opts[flagMtaStsDomain]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).MtaStsCache == "" {
+		(*settings).MtaStsCache = opts[flagMtaStsCache]
+	}
+	if (*settings).ConnectTimeout == 0 {
+		if opts[flagConnectTimeout] != "" {
+			if err := (*settings).ConnectTimeout.Set(opts[flagConnectTimeout]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).CommandTimeout == 0 {
+		if opts[flagCommandTimeout] != "" {
+			if err := (*settings).CommandTimeout.Set(opts[flagCommandTimeout]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).TotalTimeout == 0 {
+		if opts[flagTotalTimeout] != "" {
+			if err := (*settings).TotalTimeout.Set(opts[flagTotalTimeout]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).RetryAttempts == 0 {
+		if opts[flagRetryAttempts] != "" {
+			if err := (*settings).RetryAttempts.Set(opts[flagRetryAttempts]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).RetryDelay == 0 {
+		if opts[flagRetryDelay] != "" {
+			if err := (*settings).RetryDelay.Set(opts[flagRetryDelay]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).RetryJitter == 0 {
+		if opts[flagRetryJitter] != "" {
+			if err := (*settings).RetryJitter.Set(opts[flagRetryJitter]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).RetryMaxElapsed == 0 {
+		if opts[flagRetryMaxElapsed] != "" {
+			if err := (*settings).RetryMaxElapsed.Set(opts[flagRetryMaxElapsed]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).RecipientPolicy == "" {
+		if opts[flagRecipientPolicy] != "" {
+			if err := (*settings).RecipientPolicy.Set(opts[flagRecipientPolicy]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).MinAccepted == 0 {
+		if opts[flagMinAccepted] != "" {
+			if err := (*settings).MinAccepted.Set(opts[flagMinAccepted]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).DsnReturn == "" {
+		if opts[flagDsnReturn] != "" {
+			if err := (*settings).DsnReturn.Set(opts[flagDsnReturn]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).DsnEnvelopeId == "" {
+		if opts[flagDsnEnvelopeId] != "" {
+			if err := (*settings).DsnEnvelopeId.Set(opts[flagDsnEnvelopeId]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len((*settings).DsnNotify) == 0 {
+		if opts[flagDsnNotify] != "" {
+			if err := (*settings).DsnNotify.Set(opts[flagDsnNotify]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !(*settings).DsnOrcpt {
+		if opts[flagDsnOrcpt] != "" {
+			if err := (*settings).DsnOrcpt.Set(opts[flagDsnOrcpt]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	if (*settings).Authentication == types.NoAuthentication {
 		if opts[flagAuthMethod] != "" {
 			if err := (*settings).Authentication.Set(opts[flagAuthMethod]); err != nil {
@@ -134,6 +511,69 @@ func GetSettings(output io.Writer, version string) (*Settings, error) {
 	if (*settings).Password == "" {
 		(*settings).Password = opts[flagPassword]
 	}
+	if (*settings).Token == "" {
+		(*settings).Token = opts[flagToken]
+	}
+	if (*settings).PasswordSource == types.NoCredentialSource {
+		if opts[flagPasswordSource] != "" {
+			if err := (*settings).PasswordSource.Set(opts[flagPasswordSource]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).PasswordCommand == "" {
+		(*settings).PasswordCommand = opts[flagPasswordCommand]
+	}
+	if (*settings).TokenSource == types.NoCredentialSource {
+		if opts[flagTokenSource] != "" {
+			if err := (*settings).TokenSource.Set(opts[flagTokenSource]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).TokenCommand == "" {
+		(*settings).TokenCommand = opts[flagTokenCommand]
+	}
+	if (*settings).VaultFile == "" {
+		if opts[flagVaultFile] != "" {
+			if err := (*settings).VaultFile.Set(opts[flagVaultFile]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).TokenExpiry.GetTime().IsZero() {
+		if opts[flagTokenExpiry] != "" {
+			if err := (*settings).TokenExpiry.Set(opts[flagTokenExpiry]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).OAuthTokenUrl == "" {
+		if opts[flagOAuthTokenUrl] != "" {
+			if err := (*settings).OAuthTokenUrl.Set(opts[flagOAuthTokenUrl]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).OAuthDeviceUrl == "" {
+		if opts[flagOAuthDeviceUrl] != "" {
+			if err := (*settings).OAuthDeviceUrl.Set(opts[flagOAuthDeviceUrl]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (*settings).OAuthClientId == "" {
+		(*settings).OAuthClientId = opts[flagOAuthClientId]
+	}
+	if (*settings).OAuthClientSecret == "" {
+		(*settings).OAuthClientSecret = opts[flagOAuthClientSecret]
+	}
+	if (*settings).OAuthScope == "" {
+		(*settings).OAuthScope = opts[flagOAuthScope]
+	}
+	if (*settings).OAuthRefreshToken == "" {
+		(*settings).OAuthRefreshToken = opts[flagOAuthRefreshToken]
+	}
 	if (*settings).Sender.Address == "" {
 		if opts[flagSender] != "" {
 			if err := (*settings).Sender.Set(opts[flagSender]); err != nil {
@@ -141,6 +581,16 @@ func GetSettings(output io.Writer, version string) (*Settings, error) {
 			}
 		}
 	}
+
+	// The netrc entry and the prompt depend on the SMTP host, so with a host to discover they are resolved by the discovery
+	if !(*settings).SmtpHost.IsDiscover() {
+		if err := resolveCredentials(settings); err != nil {
+			return nil, err
+		}
+	}
+	if err := resolveVaultReferences(settings); err != nil {
+		return nil, err
+	}
 	return settings, nil
 }
 
@@ -153,15 +603,58 @@ func getFlagSettings(output io.Writer, version string) (*Settings, types.FilePat
 	fs.Usage = func() {}     // Disable flags usage output
 	fs.SetOutput(io.Discard) // Disable text output
 	fs.Var(&serverFilePath, flagServerFile, "Path to settings file.")
-	fs.Var(&settings.SmtpHost, flagSmtpHost, "Hostname of SMTP server.")
+	fs.Var(&settings.SmtpHost, flagSmtpHost, "Hostname of SMTP server, or auto to discover the submission server of the sender domain.")
 	fs.Var(&settings.SmtpPort, flagSmtpPort, "TCP port of SMTP server.")
+	fs.Var(&settings.Proxy, flagProxy, "URL of SOCKS5 or HTTP CONNECT proxy to connect through (socks5://, socks5h://, http://), with optional user:password@.")
+	fs.Var(&settings.BindAddress, flagBindAddress, "Local IP address to connect from, e.g. the address whitelisted by the SMTP server.")
+	fs.Var(&settings.IpFamily, flagIpFamily, fmt.Sprintf("IP version to connect with (%s, %s, %s). Default is %s, which tries IPv6 and IPv4 (Happy Eyeballs).", types.Ipv4Family, types.Ipv6Family, types.AutoIpFamily, types.AutoIpFamily))
+	fs.Var(&settings.EhloName, flagEhloName, "Host name sent with EHLO. Default is the FQDN of the system, or the local IP address when it has none.")
 	fs.Var(&settings.RootCA, flagRootCA, "File path to X.509 certificate in PEM format for the Root CA when using a self-signed certificate on the mail server.")
-	fs.Var(&settings.Security, flagSecurity, fmt.Sprintf("Security protocol (%s, %s).", types.StartTlsSec, types.SslTlsSec))
+	fs.Var(&settings.ClientCert, flagClientCert, "File path to X.509 client certificate in PEM format for mutual TLS.")
+	fs.Var(&settings.ClientKey, flagClientKey, "File path to private key in PEM format of the client certificate.")
+	fs.Var(&settings.TlsMinVersion, flagTlsMinVersion, "Minimum TLS version (1.0, 1.1, 1.2, 1.3).")
+	fs.Var(&settings.TlsMaxVersion, flagTlsMaxVersion, "Maximum TLS version (1.0, 1.1, 1.2, 1.3).")
+	fs.Var(&settings.TlsCiphers, flagTlsCiphers, "Allowed TLS 1.0-1.2 cipher suites by IANA name. Comma separate multiple cipher suites.")
+	fs.Var(&settings.TlsServerName, flagTlsServerName, "Server name for SNI and certificate verification when it differs from the SMTP host.")
+	fs.Var(&settings.TlsPins, flagTlsPin, fmt.Sprintf("SHA-256 fingerprint of the server public key (spki:<hash>) or certificate (cert:<hash>) that must be in the verified chain. Comma separate multiple pins or use multiple %s options.", flagTlsPin))
+	fs.Var(&settings.TlsVerify, flagTlsVerify, "Verification of the server certificate (pkix, dane). Default is pkix.")
+	fs.Var(&settings.Security, flagSecurity, fmt.Sprintf("Security protocol (%s, %s, %s).", types.StartTlsSec, types.SslTlsSec, types.OpportunisticSec))
+	fs.Var(&settings.Deliver, flagDeliver, fmt.Sprintf("Delivery by the SMTP server (%s), directly to the MX hosts of the recipient domains (%s), into a mail store with LMTP (%s) or by the local sendmail command (%s). Default is %s.", types.RelayDelivery, types.MxDelivery, types.LmtpDelivery, types.SendmailDelivery, types.RelayDelivery))
+	fs.Var(&settings.LmtpAddress, flagLmtpAddress, fmt.Sprintf("Address of the LMTP server for -%s %s: %s<path> of a unix socket or <host>:<port>.", flagDeliver, types.LmtpDelivery, types.UnixSocketPrefix))
+	fs.Var(&settings.Sendmail, flagSendmailCommand, fmt.Sprintf("Command for -%s %s, which reads the message from standard input. The sender and recipients are appended. Default is /usr/sbin/sendmail -oi. Only allowed on the command line and in the authentication file.", flagDeliver, types.SendmailDelivery))
+	fs.Var(&settings.MtaStsDomain, flagMtaStsDomain, "Mail domain of the SMTP server whose MTA-STS policy must be applied. MTA-STS is always applied to MX hosts.")
+	fs.StringVar(&settings.MtaStsCache, flagMtaStsCache, "", "Path to MTA-STS policy cache (default gosend/mta-sts.json in the user cache directory).")
+	fs.Var(&settings.ConnectTimeout, flagConnectTimeout, "Maximum time to connect to the SMTP server, including the proxy (e.g. 30s). Default is no timeout.")
+	fs.Var(&settings.CommandTimeout, flagCommandTimeout, "Maximum time for each SMTP command and its reply (e.g. 5m). Default is no timeout.")
+	fs.Var(&settings.TotalTimeout, flagTotalTimeout, "Maximum time for the complete SMTP session (e.g. 10m). Default is no timeout.")
+	fs.Var(&settings.RetryAttempts, flagRetryAttempts, "Maximum number of attempts to send the message when the server reports a temporary failure (4xx) or the connection fails. Default is 1.")
+	fs.Var(&settings.RetryDelay, flagRetryDelay, "Delay before the first retry, doubled for every next retry up to 24h (e.g. 30s). Default is 5s.")
+	fs.Var(&settings.RetryJitter, flagRetryJitter, "Maximum random time added to every retry delay (e.g. 5s). Default is none.")
+	fs.Var(&settings.RetryMaxElapsed, flagRetryMaxElapsed, "No retry is started after this time since the first attempt (e.g. 10m). Default is no limit.")
+	fs.Var(&settings.RecipientPolicy, flagRecipientPolicy, fmt.Sprintf("Handling of recipients rejected by the server: fail at the first rejection (%s) or send to the accepted recipients (%s). Default is %s.", types.FailFastPolicy, types.SkipRejectedPolicy, types.FailFastPolicy))
+	fs.Var(&settings.MinAccepted, flagMinAccepted, fmt.Sprintf("Minimum number of accepted recipients to send the message with -%s %s. Default is 1.", flagRecipientPolicy, types.SkipRejectedPolicy))
+	fs.Var(&settings.DsnReturn, flagDsnReturn, "Part of the message returned in a failure notification: the complete message (full) or only its headers (hdrs). Sent when the server supports DSN.")
+	fs.Var(&settings.DsnEnvelopeId, flagDsnEnvelopeId, "Identifier of the message returned in delivery status notifications. Sent when the server supports DSN.")
+	fs.Var(&settings.DsnNotify, flagDsnNotify, "Delivery status notifications requested for every recipient: never, or comma separated success, failure and delay. Sent when the server supports DSN.")
+	fs.Var(&settings.DsnOrcpt, flagDsnOrcpt, "Send the address of every recipient as original recipient (ORCPT) in delivery status notifications. Sent when the server supports DSN.")
 
 	fs.Var(&authFilePath, flagAuthFile, "Path to authentication file.")
-	fs.Var(&settings.Authentication, flagAuthMethod, fmt.Sprintf("Authentication Method (%s, %s).", types.PlainAuth, types.CramMd5Auth))
-	fs.StringVar(&settings.Login, flagLogin, "", "Login username")
+	fs.Var(&settings.Authentication, flagAuthMethod, fmt.Sprintf("Authentication Method (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s).", types.AutoAuth, types.PlainAuth, types.LoginAuth, types.CramMd5Auth, types.ScramSha1Auth, types.ScramSha1PlusAuth, types.ScramSha256Auth, types.ScramSha256PlusAuth, types.XOAuth2Auth, types.OAuthBearerAuth, types.ExternalAuth))
+	fs.StringVar(&settings.Login, flagLogin, "", fmt.Sprintf("Login username. With authentication method %s it is sent as authorization identity.", types.ExternalAuth))
 	fs.StringVar(&settings.Password, flagPassword, "", "Login password.")
+	fs.Var(&settings.PasswordSource, flagPasswordSource, fmt.Sprintf("Source of the login password when not provided with -%s (%s, %s, %s, %s).", flagPassword, types.CommandCredentialSource, types.NetrcCredentialSource, types.EnvCredentialSource, types.PromptCredentialSource))
+	fs.StringVar(&settings.PasswordCommand, flagPasswordCommand, "", "Shell command that prints the login password. Only allowed on the command line and in the authentication file.")
+	fs.StringVar(&settings.Token, flagToken, "", "OAuth2 access token.")
+	fs.Var(&settings.TokenSource, flagTokenSource, fmt.Sprintf("Source of the OAuth2 access token when not provided with -%s (%s, %s, %s, %s).", flagToken, types.CommandCredentialSource, types.NetrcCredentialSource, types.EnvCredentialSource, types.PromptCredentialSource))
+	fs.StringVar(&settings.TokenCommand, flagTokenCommand, "", "Shell command that prints the OAuth2 access token. Only allowed on the command line and in the authentication file.")
+	fs.Var(&settings.VaultFile, flagVaultFile, fmt.Sprintf("Path to credential vault for %s<name> values (default $%s or gosend/vault.json in the user configuration directory).", vault.ReferencePrefix, vault.EnvVaultFile))
+	fs.Var(&settings.TokenExpiry, flagTokenExpiry, "Expiry time of the OAuth2 access token (RFC 3339).")
+	fs.Var(&settings.OAuthTokenUrl, flagOAuthTokenUrl, "OAuth2 token endpoint to refresh the access token. Only allowed on the command line and in the authentication file.")
+	fs.Var(&settings.OAuthDeviceUrl, flagOAuthDeviceUrl, "OAuth2 device authorization endpoint for the first login.")
+	fs.StringVar(&settings.OAuthClientId, flagOAuthClientId, "", "OAuth2 client ID.")
+	fs.StringVar(&settings.OAuthClientSecret, flagOAuthClientSecret, "", "OAuth2 client secret. Only allowed on the command line and in the authentication file.")
+	fs.StringVar(&settings.OAuthScope, flagOAuthScope, "", "OAuth2 scope.")
+	fs.StringVar(&settings.OAuthRefreshToken, flagOAuthRefreshToken, "", "OAuth2 refresh token.")
 
 	fs.Var(&settings.Sender, flagSender, "Email address of sender.")
 	fs.Var(&settings.ReplyTo, flagReplyTo, fmt.Sprintf("Reply-To address. Comma separate multiple email addresses or use multiple %s options.", flagReplyTo))
@@ -199,7 +692,7 @@ func getFlagSettings(output io.Writer, version string) (*Settings, types.FilePat
 	return &settings, serverFilePath, authFilePath, nil
 }
 
-func appendOptionsOfFile(opts map[string]string, filePath types.FilePath) (map[string]string, error) {
+func appendOptionsOfFile(opts map[string]string, filePath types.FilePath, allowed []string) (map[string]string, error) {
 	if filePath == "" {
 		return opts, nil
 	}
@@ -219,7 +712,7 @@ func appendOptionsOfFile(opts map[string]string, filePath types.FilePath) (map[s
 		}
 		key := strings.ToLower(strings.TrimSpace(line[:equalIndex]))
 		value := strings.Trim(strings.TrimSpace(line[equalIndex+1:]), "\"")
-		if !contains(allowedInFile, key) {
+		if !contains(allowed, key) {
 			return nil, fmt.Errorf("%w: %s in %s)", ErrIllegalFlagOption, key, filePath)
 		}
 		opts[key] = value
@@ -230,6 +723,79 @@ func appendOptionsOfFile(opts map[string]string, filePath types.FilePath) (map[s
 	return opts, nil
 }
 
+// ReadOptionsOfFile returns the options in an authentication file as written, e.g. without resolving vault references
+func ReadOptionsOfFile(filePath types.FilePath) (map[string]string, error) {
+	return appendOptionsOfFile(make(map[string]string), filePath, allowedInAuthFile)
+}
+
+// UpdateOptionsOfFile replaces or appends the given options in a settings file. The file is rewritten
+// atomically and is only readable by its owner, as it may contain credentials.
+func UpdateOptionsOfFile(filePath types.FilePath, opts map[string]string) error {
+	if filePath == "" {
+		return ErrNoSettingsFile
+	}
+	for key := range opts {
+		if !contains(allowedInFile, key) {
+			return fmt.Errorf("%w: %s in %s)", ErrIllegalFlagOption, key, filePath)
+		}
+	}
+
+	info, err := os.Stat(filePath.String())
+	if err != nil {
+		return fmt.Errorf("failed to open file: %s", err)
+	}
+	content, err := os.ReadFile(filePath.String())
+	if err != nil {
+		return fmt.Errorf("failed to open file: %s", err)
+	}
+
+	var lines []string
+	if text := strings.TrimRight(string(content), "\n"); text != "" {
+		lines = strings.Split(text, "\n")
+	}
+	written := make(map[string]bool)
+	for i, line := range lines {
+		equalIndex := strings.Index(line, "=")
+		if equalIndex == -1 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:equalIndex]))
+		if value, ok := opts[key]; ok {
+			lines[i] = fmt.Sprintf("%s=\"%s\"", key, value)
+			written[key] = true
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(opts)) {
+		if !written[key] {
+			lines = append(lines, fmt.Sprintf("%s=\"%s\"", key, opts[key]))
+		}
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(filePath.String()), "."+filepath.Base(filePath.String())+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if err := tmpFile.Chmod(info.Mode().Perm() & 0600); err != nil {
+		return fmt.Errorf("failed to write file: %s", err)
+	}
+	if _, err := tmpFile.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		return fmt.Errorf("failed to write file: %s", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("failed to write file: %s", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %s", err)
+	}
+	if err := os.Rename(tmpFile.Name(), filePath.String()); err != nil {
+		return fmt.Errorf("failed to write file: %s", err)
+	}
+	return nil
+}
+
 func contains(slice []string, item string) bool {
 	for _, str := range slice {
 		if str == item {
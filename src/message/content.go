@@ -18,7 +18,8 @@ type content struct {
 	parts    *[]content
 }
 
-func (msg *Message) getContentText() (string, error) {
+// getContentText returns the headers and body of the message. The Bcc header is only added for a transport that removes it, like sendmail -t.
+func (msg *Message) getContentText(withBcc bool) (string, error) {
 	cnt, err := (*msg).getContentTree()
 	if err != nil {
 		return "", err
@@ -30,6 +31,9 @@ func (msg *Message) getContentText() (string, error) {
 		if len((*msg).cc) != 0 {
 			result += fmt.Sprintf("Cc: %s\r\n", getMailAddressesAsString((*msg).cc))
 		}
+		if withBcc && len((*msg).bcc) != 0 {
+			result += fmt.Sprintf("Bcc: %s\r\n", getMailAddressesAsString((*msg).bcc))
+		}
 		result += fmt.Sprintf("Subject: %s\r\n", (*msg).subject)
 		if len((*msg).replyTo) != 0 {
 			result += fmt.Sprintf("Reply-To: %s\r\n", getMailAddressesAsString((*msg).replyTo))
@@ -0,0 +1,141 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+// Extension of the server for delivery status notifications (RFC 3461)
+const DsnExtension = "DSN"
+
+var ErrSenderLine = errors.New("sender contains CR or LF")
+
+// dsnParameters are the parameters of delivery status notifications, sent only when the server supports DSN
+type dsnParameters struct {
+	ret        string   // FULL or HDRS
+	envelopeId string   // Returned in the notifications to identify the transaction
+	notify     []string // NEVER, or SUCCESS, FAILURE and DELAY
+	orcpt      bool     // The address of every recipient is sent as original recipient
+}
+
+// SetDsnReturn requests the complete message (FULL) or only its headers (HDRS) in a failure notification
+func (msg *Message) SetDsnReturn(ret string) {
+	(*msg).dsn.ret = strings.ToUpper(ret)
+}
+
+// SetDsnEnvelopeId sets the identifier of the transaction that is returned in the notifications
+func (msg *Message) SetDsnEnvelopeId(id string) {
+	(*msg).dsn.envelopeId = id
+}
+
+// SetDsnNotify requests notifications for every recipient on SUCCESS, FAILURE and DELAY, or none with NEVER
+func (msg *Message) SetDsnNotify(notify []string) {
+	(*msg).dsn.notify = nil
+	for _, n := range notify {
+		(*msg).dsn.notify = append((*msg).dsn.notify, strings.ToUpper(n))
+	}
+}
+
+// SetDsnOriginalRecipient sends the address of every recipient as original recipient (ORCPT), which is shown in the notifications
+func (msg *Message) SetDsnOriginalRecipient(orcpt bool) {
+	(*msg).dsn.orcpt = orcpt
+}
+
+func (d dsnParameters) check() error {
+	var errMsgs []error
+	if d.ret != "" {
+		var ret types.DsnReturn
+		errMsgs = append(errMsgs, ret.Set(d.ret))
+	}
+	if d.envelopeId != "" {
+		var id types.DsnEnvelopeId
+		errMsgs = append(errMsgs, id.Set(d.envelopeId))
+	}
+	if len(d.notify) > 0 {
+		var notify types.DsnNotify
+		errMsgs = append(errMsgs, notify.Set(strings.Join(d.notify, ",")))
+	}
+	return errors.Join(errMsgs...)
+}
+
+// mailParameters returns the parameters of MAIL FROM, starting with a space
+func (d dsnParameters) mailParameters() string {
+	var params string
+	if d.ret != "" {
+		params += " RET=" + d.ret
+	}
+	if d.envelopeId != "" {
+		params += " ENVID=" + xtext(d.envelopeId)
+	}
+	return params
+}
+
+// rcptParameters returns the parameters of RCPT TO for recipient, starting with a space.
+// ORCPT is only sent for an ASCII address, as the rfc822 address type requires.
+func (d dsnParameters) rcptParameters(recipient string) string {
+	var params string
+	if len(d.notify) > 0 {
+		params += " NOTIFY=" + strings.Join(d.notify, ",")
+	}
+	if d.orcpt && isAscii(recipient) {
+		params += " ORCPT=rfc822;" + xtext(recipient)
+	}
+	return params
+}
+
+// mailFrom sends MAIL FROM like smtp.Client.Mail, followed by params
+func mailFrom(client *smtp.Client, from string, params string) error {
+	if params == "" {
+		return client.Mail(from)
+	}
+	if strings.ContainsAny(from, "\r\n") {
+		return ErrSenderLine
+	}
+	line := fmt.Sprintf("MAIL FROM:<%s>", from)
+	if ok, _ := client.Extension("8BITMIME"); ok {
+		line += " BODY=8BITMIME"
+	}
+	if ok, _ := client.Extension("SMTPUTF8"); ok {
+		line += " SMTPUTF8"
+	}
+	_, err := cmd(client, 250, line+params)
+	return err
+}
+
+// cmd sends a command line, which is not a format, and returns the code of the reply
+func cmd(client *smtp.Client, expectCode int, line string) (int, error) {
+	id, err := client.Text.Cmd("%s", line)
+	if err != nil {
+		return 0, err
+	}
+	client.Text.StartResponse(id)
+	defer client.Text.EndResponse(id)
+	code, _, err := client.Text.ReadResponse(expectCode)
+	return code, err
+}
+
+// xtext encodes text for a parameter value: "+", "=" and characters that are not printable ASCII are sent as "+" with their hexadecimal value (RFC 3461 section 4)
+func xtext(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if c := text[i]; c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isAscii(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package message
+
+import (
+	"errors"
+	"net/mail"
+	"testing"
+
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+func Test_DsnParameters(t *testing.T) {
+	type dsnCheck struct {
+		name           string
+		ret            string
+		envelopeId     string
+		notify         []string
+		orcpt          bool
+		recipient      string
+		expectedMail   string
+		expectedRcpt   string
+		expectedErrors *[]error
+	}
+	checklist := []dsnCheck{
+		{name: "none", recipient: "alice@domain.local"},
+		{name: "all", ret: "full", envelopeId: "Q+1=2 \\", notify: []string{"success", "Delay"}, orcpt: true, recipient: "alice@domain.local", expectedMail: " RET=FULL ENVID=Q+2B1+3D2+20\\", expectedRcpt: " NOTIFY=SUCCESS,DELAY ORCPT=rfc822;alice@domain.local"},
+		{name: "orcpt not ascii", notify: []string{"failure"}, orcpt: true, recipient: "jürgen@domain.local", expectedRcpt: " NOTIFY=FAILURE"},
+		{name: "invalid return", ret: "body", recipient: "alice@domain.local", expectedErrors: &[]error{types.ErrDsnReturnInvalid}},
+		{name: "invalid notify", notify: []string{"never", "failure"}, recipient: "alice@domain.local", expectedErrors: &[]error{types.ErrDsnNotifyInvalid}},
+		{name: "invalid envelope id", envelopeId: "Q\r\n", recipient: "alice@domain.local", expectedErrors: &[]error{types.ErrDsnEnvelopeIdInvalid}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			msg := NewMessage()
+			msg.SetSender(mail.Address{Address: "sender@domain.local"})
+			msg.SetRecipientTo([]mail.Address{{Address: c.recipient}})
+			msg.SetSubject(c.name)
+			msg.SetDsnReturn(c.ret)
+			msg.SetDsnEnvelopeId(c.envelopeId)
+			msg.SetDsnNotify(c.notify)
+			msg.SetDsnOriginalRecipient(c.orcpt)
+
+			err := msg.CheckMessage()
+			if c.expectedErrors != nil {
+				for _, exp := range *c.expectedErrors {
+					if !errors.Is(err, exp) {
+						t.Errorf("Expected error %s, got %v", exp, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := (*msg).dsn.mailParameters(); got != c.expectedMail {
+				t.Errorf("Expected MAIL parameters %q, got %q", c.expectedMail, got)
+			}
+			if got := (*msg).dsn.rcptParameters(c.recipient); got != c.expectedRcpt {
+				t.Errorf("Expected RCPT parameters %q, got %q", c.expectedRcpt, got)
+			}
+		})
+	}
+}
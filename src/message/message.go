@@ -1,12 +1,15 @@
 package message
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/mail"
 	"net/smtp"
 	"os"
 	"path/filepath"
+
+	"github.com/Sternisaea/gosend/src/types"
 )
 
 type Message struct {
@@ -19,6 +22,7 @@ type Message struct {
 	htmlText      string
 	customHeaders []string
 	attachments   []attachment
+	dsn           dsnParameters
 
 	idPrefix  string
 	idCounter int
@@ -115,48 +119,94 @@ func (msg *Message) CheckMessage() error {
 			errMsgs = append(errMsgs, fmt.Errorf("attachment file %s does not exist", a.filePath))
 		}
 	}
+	errMsgs = append(errMsgs, (*msg).dsn.check())
 	return errors.Join(errMsgs...)
 }
 
-func (msg *Message) SendContent(client *smtp.Client) error {
+// GetRecipients returns the addresses of all To, Cc and Bcc recipients
+func (msg *Message) GetRecipients() []string {
+	recipients := make([]string, 0, len((*msg).to)+len((*msg).cc)+len((*msg).bcc))
+	for _, list := range [][]mail.Address{(*msg).to, (*msg).cc, (*msg).bcc} {
+		for _, e := range list {
+			recipients = append(recipients, e.Address)
+		}
+	}
+	return recipients
+}
+
+// GetSender returns the address of the sender for the envelope
+func (msg *Message) GetSender() string {
+	return (*msg).from.Address
+}
+
+// GetContent returns the headers and body of the message, for protocols that are not sent with an smtp.Client
+func (msg *Message) GetContent() (string, error) {
 	if err := msg.CheckMessage(); err != nil {
-		return err
+		return "", err
 	}
+	return msg.getContentText(false)
+}
 
-	if err := client.Mail(msg.from.Address); err != nil {
-		return err
+// GetContentWithBcc returns the message with a Bcc header, for a transport that takes the recipients from the headers and removes the Bcc header
+func (msg *Message) GetContentWithBcc() (string, error) {
+	if err := msg.CheckMessage(); err != nil {
+		return "", err
 	}
+	return msg.getContentText(true)
+}
 
-	for _, e := range msg.to {
-		if err := client.Rcpt(e.Address); err != nil {
-			return err
-		}
+// SendContent sends the message to all recipients.
+// A rejection of the message data by the server is returned as error, as the reply is read when the data is closed.
+func (msg *Message) SendContent(ctx context.Context, client *smtp.Client, policy RecipientPolicy) ([]RecipientResult, error) {
+	return msg.SendContentTo(ctx, client, msg.GetRecipients(), policy)
+}
+
+// SendContentTo sends the message to a part of the recipients, e.g. the recipients of one domain. The headers still show all To and Cc recipients.
+// The results of RCPT are returned for the recipients that were tried, also when the message is not sent.
+// The DSN parameters are only sent when the server supports DSN.
+// The session is not started or continued with the content when ctx is done.
+func (msg *Message) SendContentTo(ctx context.Context, client *smtp.Client, recipients []string, policy RecipientPolicy) ([]RecipientResult, error) {
+	if err := msg.CheckMessage(); err != nil {
+		return nil, err
 	}
-	for _, e := range msg.cc {
-		if err := client.Rcpt(e.Address); err != nil {
-			return err
-		}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	for _, e := range msg.bcc {
-		if err := client.Rcpt(e.Address); err != nil {
-			return err
-		}
+
+	var dsn dsnParameters
+	if ok, _ := client.Extension(DsnExtension); ok {
+		dsn = (*msg).dsn
+	}
+	if err := mailFrom(client, msg.from.Address, dsn.mailParameters()); err != nil {
+		return nil, &types.PhaseError{Phase: types.MailPhase, Err: err}
 	}
 
-	wc, err := client.Data()
+	results, err := addRecipients(client, recipients, policy, dsn)
 	if err != nil {
-		return err
+		return results, &types.PhaseError{Phase: types.RcptPhase, Err: err}
 	}
-	defer wc.Close()
 
-	text, err := msg.getContentText()
+	if err := ctx.Err(); err != nil {
+		return results, err
+	}
+	wc, err := client.Data()
 	if err != nil {
-		return err
+		return results, &types.PhaseError{Phase: types.DataPhase, Err: err}
 	}
 
-	_, err = wc.Write([]byte(text))
+	text, err := msg.getContentText(false)
 	if err != nil {
-		return err
+		wc.Close()
+		return results, err
+	}
+
+	if _, err = wc.Write([]byte(text)); err != nil {
+		wc.Close()
+		return results, &types.PhaseError{Phase: types.DataPhase, Err: err}
+	}
+	// The reply of the server to the complete message is read when closing
+	if err := wc.Close(); err != nil {
+		return results, &types.PhaseError{Phase: types.DataPhase, Err: err}
 	}
-	return nil
+	return results, nil
 }
@@ -526,7 +526,7 @@ func Test_Message(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		cl, close, addr, err := sc.ClientConnect()
+		cl, close, addr, err := sc.ClientConnect(context.Background())
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -536,7 +536,7 @@ func Test_Message(t *testing.T) {
 		for _, c := range checklist {
 			t.Run(c.name, func(t *testing.T) {
 				c.message.SetDeterministicIDs("BOUNDARY_ID_")
-				err := c.message.SendContent(cl)
+				_, err := c.message.SendContent(context.Background(), cl, RecipientPolicy{})
 				if cont, err := checkError(err, c.expectedErrors); !cont || err != nil {
 					if err != nil {
 						t.Fatal(err)
@@ -0,0 +1,89 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+var (
+	ErrTooFewAccepted = errors.New("too few recipients accepted")
+	ErrRecipientLine  = errors.New("recipient contains CR or LF")
+)
+
+// RecipientPolicy decides how recipients rejected by the server are handled
+type RecipientPolicy struct {
+	SkipRejected bool // Send to the accepted recipients, instead of failing at the first rejection
+	MinAccepted  int  // Minimum number of accepted recipients to send the message with SkipRejected, at least 1
+}
+
+// RecipientResult is the reply of the server for one recipient. Code is 0 when there was no reply.
+// Err is marked with the phase of the session in which the recipient was rejected.
+type RecipientResult struct {
+	Recipient string
+	Code      int
+	Err       error
+}
+
+func (r RecipientResult) Accepted() bool {
+	return r.Err == nil
+}
+
+// addRecipients sends RCPT for the recipients as allowed by the policy. The results of the recipients that were tried are returned,
+// with an error when the message must not be sent.
+func addRecipients(client *smtp.Client, recipients []string, policy RecipientPolicy, dsn dsnParameters) ([]RecipientResult, error) {
+	results := make([]RecipientResult, 0, len(recipients))
+	var firstErr error
+	accepted := 0
+	for _, r := range recipients {
+		result := rcpt(client, r, dsn.rcptParameters(r))
+		results = append(results, result)
+		if result.Accepted() {
+			accepted++
+			continue
+		}
+		if !policy.SkipRejected {
+			return results, result.Err
+		}
+		if firstErr == nil {
+			firstErr = result.Err
+		}
+	}
+
+	if err := policy.CheckAccepted(accepted, len(recipients), firstErr); err != nil {
+		// The accepted recipients are dropped with the transaction
+		client.Reset()
+		return results, err
+	}
+	return results, nil
+}
+
+// CheckAccepted returns ErrTooFewAccepted, with firstErr the first rejection, when fewer than the minimum of the recipients were accepted
+func (p RecipientPolicy) CheckAccepted(accepted int, total int, firstErr error) error {
+	minAccepted := max(p.MinAccepted, 1)
+	if accepted >= minAccepted {
+		return nil
+	}
+	err := fmt.Errorf("%w: %d of %d, %d required", ErrTooFewAccepted, accepted, total, minAccepted)
+	if firstErr != nil {
+		err = fmt.Errorf("%w: %w", err, firstErr)
+	}
+	return err
+}
+
+// rcpt sends RCPT TO like smtp.Client.Rcpt, followed by params, but keeps the code of the reply
+func rcpt(client *smtp.Client, recipient string, params string) RecipientResult {
+	result := RecipientResult{Recipient: recipient}
+	if strings.ContainsAny(recipient, "\r\n") {
+		result.Err = ErrRecipientLine
+		return result
+	}
+	var err error
+	if result.Code, err = cmd(client, 25, "RCPT TO:<"+recipient+">"+params); err != nil {
+		result.Err = &types.PhaseError{Phase: types.RcptPhase, Err: err}
+	}
+	return result
+}
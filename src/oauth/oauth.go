@@ -0,0 +1,280 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	grantRefreshToken = "refresh_token"
+	grantDeviceCode   = "urn:ietf:params:oauth:grant-type:device_code"
+
+	errAuthorizationPending = "authorization_pending"
+	errSlowDown             = "slow_down"
+)
+
+var (
+	ErrNoTokenUrl        = errors.New("no OAuth2 token endpoint provided")
+	ErrNoDeviceUrl       = errors.New("no OAuth2 device authorization endpoint provided")
+	ErrNoClientId        = errors.New("no OAuth2 client ID provided")
+	ErrNoRefreshToken    = errors.New("no OAuth2 refresh token provided")
+	ErrTokenEndpoint     = errors.New("token endpoint error")
+	ErrDeviceEndpoint    = errors.New("device authorization endpoint error")
+	ErrNoAccessToken     = errors.New("no access token received")
+	ErrDeviceCodeExpired = errors.New("device code expired before authorization was completed")
+)
+
+var (
+	// Margin before the expiry time at which an access token is considered expired
+	expiryMargin = time.Minute
+	// Polling interval of the device flow when the server does not provide one (RFC 8628 section 3.2)
+	defaultInterval = 5 * time.Second
+	// Time to wait for the authorization of the device flow when the server does not provide the expiry of the device code
+	maxDeviceWait = 15 * time.Minute
+)
+
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+// Valid reports whether the access token is present and not about to expire. A token without expiry time is assumed valid.
+func (t *Token) Valid() bool {
+	if t == nil || (*t).AccessToken == "" {
+		return false
+	}
+	return (*t).Expiry.IsZero() || time.Now().Add(expiryMargin).Before((*t).Expiry)
+}
+
+type Client struct {
+	tokenUrl     string
+	deviceUrl    string
+	clientId     string
+	clientSecret string
+	scope        string
+	httpClient   *http.Client
+}
+
+func NewClient(tokenUrl, deviceUrl, clientId, clientSecret, scope string) *Client {
+	return &Client{
+		tokenUrl:     tokenUrl,
+		deviceUrl:    deviceUrl,
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		scope:        scope,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *Client) Check() error {
+	var errMsgs []error
+	if (*c).tokenUrl == "" {
+		errMsgs = append(errMsgs, ErrNoTokenUrl)
+	}
+	if (*c).clientId == "" {
+		errMsgs = append(errMsgs, ErrNoClientId)
+	}
+	return errors.Join(errMsgs...)
+}
+
+// Refresh exchanges a refresh token for a new access token (RFC 6749 section 6). If the server does not
+// rotate the refresh token, the given refresh token is returned in the token.
+func (c *Client) Refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+	if refreshToken == "" {
+		return nil, ErrNoRefreshToken
+	}
+
+	values := url.Values{}
+	values.Set("grant_type", grantRefreshToken)
+	values.Set("refresh_token", refreshToken)
+	if (*c).scope != "" {
+		values.Set("scope", (*c).scope)
+	}
+	tr, err := c.requestToken(ctx, values)
+	if err != nil {
+		return nil, err
+	}
+	if tr.Error != "" {
+		return nil, fmt.Errorf("%w: %s", ErrTokenEndpoint, tr.errorText())
+	}
+	token, err := tr.getToken()
+	if err != nil {
+		return nil, err
+	}
+	if (*token).RefreshToken == "" {
+		(*token).RefreshToken = refreshToken
+	}
+	return token, nil
+}
+
+// DeviceLogin performs the device authorization grant (RFC 8628). The user is asked via output
+// to authorize gosend in a browser, while the token endpoint is polled for the result.
+// Polling stops when ctx is done or the device code expires, after maxDeviceWait when the server does not provide the expiry.
+func (c *Client) DeviceLogin(ctx context.Context, output io.Writer) (*Token, error) {
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+	if (*c).deviceUrl == "" {
+		return nil, ErrNoDeviceUrl
+	}
+
+	values := url.Values{}
+	values.Set("client_id", (*c).clientId)
+	if (*c).scope != "" {
+		values.Set("scope", (*c).scope)
+	}
+	var dr deviceResponse
+	status, err := c.post(ctx, (*c).deviceUrl, values, &dr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDeviceEndpoint, err)
+	}
+	if status != http.StatusOK || dr.DeviceCode == "" {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceEndpoint, dr.errorText(status))
+	}
+
+	verificationUri := dr.VerificationUri
+	if verificationUri == "" {
+		verificationUri = dr.VerificationUrl
+	}
+	fmt.Fprintf(output, "To authorize gosend, open %s and enter the code %s\n", verificationUri, dr.UserCode)
+
+	interval := time.Duration(dr.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	wait := time.Duration(dr.ExpiresIn) * time.Second
+	if wait <= 0 {
+		wait = maxDeviceWait
+	}
+	deadline := time.Now().Add(wait)
+
+	values = url.Values{}
+	values.Set("grant_type", grantDeviceCode)
+	values.Set("device_code", dr.DeviceCode)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrDeviceCodeExpired
+		}
+
+		tr, err := c.requestToken(ctx, values)
+		if err != nil {
+			return nil, err
+		}
+		switch tr.Error {
+		case "":
+			return tr.getToken()
+		case errAuthorizationPending:
+			continue
+		case errSlowDown:
+			interval += 5 * time.Second
+			continue
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrTokenEndpoint, tr.errorText())
+		}
+	}
+}
+
+func (c *Client) requestToken(ctx context.Context, values url.Values) (*tokenResponse, error) {
+	values.Set("client_id", (*c).clientId)
+	if (*c).clientSecret != "" {
+		values.Set("client_secret", (*c).clientSecret)
+	}
+	var tr tokenResponse
+	status, err := c.post(ctx, (*c).tokenUrl, values, &tr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenEndpoint, err)
+	}
+	if status != http.StatusOK && tr.Error == "" {
+		return nil, fmt.Errorf("%w: HTTP status %d", ErrTokenEndpoint, status)
+	}
+	return &tr, nil
+}
+
+func (c *Client) post(ctx context.Context, endpoint string, values url.Values, result any) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := (*c).httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return resp.StatusCode, fmt.Errorf("HTTP status %d: invalid response: %w", resp.StatusCode, err)
+	}
+	return resp.StatusCode, nil
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (tr *tokenResponse) getToken() (*Token, error) {
+	if (*tr).AccessToken == "" {
+		return nil, ErrNoAccessToken
+	}
+	token := &Token{AccessToken: (*tr).AccessToken, RefreshToken: (*tr).RefreshToken}
+	if (*tr).ExpiresIn > 0 {
+		(*token).Expiry = time.Now().Add(time.Duration((*tr).ExpiresIn) * time.Second).Truncate(time.Second)
+	}
+	return token, nil
+}
+
+func (tr *tokenResponse) errorText() string {
+	if (*tr).ErrorDescription != "" {
+		return fmt.Sprintf("%s (%s)", (*tr).Error, (*tr).ErrorDescription)
+	}
+	return (*tr).Error
+}
+
+type deviceResponse struct {
+	DeviceCode       string `json:"device_code"`
+	UserCode         string `json:"user_code"`
+	VerificationUri  string `json:"verification_uri"`
+	VerificationUrl  string `json:"verification_url"` // Used by Google instead of verification_uri
+	ExpiresIn        int    `json:"expires_in"`
+	Interval         int    `json:"interval"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (dr *deviceResponse) errorText(status int) string {
+	switch {
+	case (*dr).Error != "" && (*dr).ErrorDescription != "":
+		return fmt.Sprintf("%s (%s)", (*dr).Error, (*dr).ErrorDescription)
+	case (*dr).Error != "":
+		return (*dr).Error
+	default:
+		return fmt.Sprintf("HTTP status %d", status)
+	}
+}
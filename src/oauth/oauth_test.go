@@ -0,0 +1,272 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+const (
+	testClientId     = "gosend-client"
+	testRefreshToken = "refresh-1"
+	testDeviceCode   = "device-1"
+)
+
+// tokenServer is a stand-in for an OAuth2 authorization server
+type tokenServer struct {
+	lock          sync.Mutex
+	rotate        bool
+	pendingPolls  int
+	noExpiry      bool
+	tokenRequests int
+}
+
+func (ts *tokenServer) handleToken(w http.ResponseWriter, r *http.Request) {
+	(*ts).lock.Lock()
+	defer (*ts).lock.Unlock()
+	(*ts).tokenRequests++
+
+	if err := r.ParseForm(); err != nil || r.Form.Get("client_id") != testClientId {
+		writeJson(w, http.StatusUnauthorized, map[string]any{"error": "invalid_client"})
+		return
+	}
+	switch r.Form.Get("grant_type") {
+	case grantRefreshToken:
+		if r.Form.Get("refresh_token") != testRefreshToken {
+			writeJson(w, http.StatusBadRequest, map[string]any{"error": "invalid_grant", "error_description": "refresh token revoked"})
+			return
+		}
+		resp := map[string]any{"access_token": fmt.Sprintf("access-%d", (*ts).tokenRequests), "token_type": "Bearer", "expires_in": 3600}
+		if (*ts).rotate {
+			resp["refresh_token"] = "refresh-2"
+		}
+		writeJson(w, http.StatusOK, resp)
+	case grantDeviceCode:
+		if r.Form.Get("device_code") != testDeviceCode {
+			writeJson(w, http.StatusBadRequest, map[string]any{"error": "invalid_grant"})
+			return
+		}
+		if (*ts).pendingPolls > 0 {
+			(*ts).pendingPolls--
+			writeJson(w, http.StatusBadRequest, map[string]any{"error": errAuthorizationPending})
+			return
+		}
+		writeJson(w, http.StatusOK, map[string]any{"access_token": "access-device", "token_type": "Bearer", "expires_in": 3600, "refresh_token": "refresh-device"})
+	default:
+		writeJson(w, http.StatusBadRequest, map[string]any{"error": "unsupported_grant_type"})
+	}
+}
+
+func (ts *tokenServer) handleDevice(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("client_id") != testClientId {
+		writeJson(w, http.StatusUnauthorized, map[string]any{"error": "invalid_client"})
+		return
+	}
+	resp := map[string]any{"device_code": testDeviceCode, "user_code": "ABCD-EFGH", "verification_uri": "https://login.domain.local/device", "expires_in": 60}
+	if (*ts).noExpiry {
+		delete(resp, "expires_in")
+	}
+	writeJson(w, http.StatusOK, resp)
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func startTokenServer(ts *tokenServer) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", ts.handleToken)
+	mux.HandleFunc("/device", ts.handleDevice)
+	return httptest.NewServer(mux)
+}
+
+func Test_Client(t *testing.T) {
+	defaultInterval = 10 * time.Millisecond
+	maxDeviceWait = 100 * time.Millisecond
+
+	type check struct {
+		name                 string
+		server               *tokenServer
+		clientId             string
+		refreshToken         string
+		device               bool
+		cancel               bool
+		expectedAccessToken  string
+		expectedRefreshToken string
+		expectedErrors       *[]error
+	}
+	checklist := []check{
+		{name: "refresh", server: &tokenServer{}, clientId: testClientId, refreshToken: testRefreshToken, expectedAccessToken: "access-1", expectedRefreshToken: testRefreshToken},
+		{name: "refresh rotated", server: &tokenServer{rotate: true}, clientId: testClientId, refreshToken: testRefreshToken, expectedAccessToken: "access-1", expectedRefreshToken: "refresh-2"},
+		{name: "refresh revoked", server: &tokenServer{}, clientId: testClientId, refreshToken: "revoked", expectedErrors: &[]error{ErrTokenEndpoint, errors.New("invalid_grant (refresh token revoked)")}},
+		{name: "refresh unknown client", server: &tokenServer{}, clientId: "unknown", refreshToken: testRefreshToken, expectedErrors: &[]error{ErrTokenEndpoint, errors.New("invalid_client")}},
+		{name: "refresh no client", server: &tokenServer{}, clientId: "", refreshToken: testRefreshToken, expectedErrors: &[]error{ErrNoClientId}},
+		{name: "refresh no token", server: &tokenServer{}, clientId: testClientId, refreshToken: "", expectedErrors: &[]error{ErrNoRefreshToken}},
+		{name: "device", server: &tokenServer{}, clientId: testClientId, device: true, expectedAccessToken: "access-device", expectedRefreshToken: "refresh-device"},
+		{name: "device pending", server: &tokenServer{pendingPolls: 2}, clientId: testClientId, device: true, expectedAccessToken: "access-device", expectedRefreshToken: "refresh-device"},
+		{name: "device without expiry", server: &tokenServer{pendingPolls: 1000, noExpiry: true}, clientId: testClientId, device: true, expectedErrors: &[]error{ErrDeviceCodeExpired}},
+		{name: "device cancelled", server: &tokenServer{pendingPolls: 1000}, clientId: testClientId, device: true, cancel: true, expectedErrors: &[]error{context.Canceled}},
+	}
+
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			srv := startTokenServer(c.server)
+			defer srv.Close()
+
+			client := NewClient(srv.URL+"/token", srv.URL+"/device", c.clientId, "", "https://mail.domain.local/")
+			var token *Token
+			var err error
+			var output strings.Builder
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if c.cancel {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+			if c.device {
+				token, err = client.DeviceLogin(ctx, &output)
+			} else {
+				token, err = client.Refresh(ctx, c.refreshToken)
+			}
+			if cont, err := checkError(err, c.expectedErrors); !cont || err != nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			if (*token).AccessToken != c.expectedAccessToken {
+				t.Errorf("Expected access token %s, got %s", c.expectedAccessToken, (*token).AccessToken)
+			}
+			if (*token).RefreshToken != c.expectedRefreshToken {
+				t.Errorf("Expected refresh token %s, got %s", c.expectedRefreshToken, (*token).RefreshToken)
+			}
+			if !token.Valid() {
+				t.Errorf("Expected valid token, got expiry %s", (*token).Expiry)
+			}
+			if c.device && !strings.Contains(output.String(), "ABCD-EFGH") {
+				t.Errorf("Expected user code in output, got %q", output.String())
+			}
+		})
+	}
+}
+
+func Test_GetAccessToken(t *testing.T) {
+	defaultInterval = 10 * time.Millisecond
+
+	type check struct {
+		name                  string
+		server                *tokenServer
+		fileContent           string
+		settings              cmdflags.Settings
+		expectedToken         string
+		expectedTokenRequests int
+		expectedFileContent   []string
+		unexpectedContent     []string
+	}
+	validExpiry := types.Timestamp(time.Now().Add(time.Hour).Truncate(time.Second))
+	expiredExpiry := types.Timestamp(time.Now().Add(-time.Hour).Truncate(time.Second))
+	checklist := []check{
+		{name: "cached", server: &tokenServer{}, fileContent: "token=cached\n",
+			settings:      cmdflags.Settings{Authentication: types.XOAuth2Auth, Token: "cached", TokenExpiry: validExpiry, OAuthClientId: testClientId, OAuthRefreshToken: testRefreshToken},
+			expectedToken: "cached", expectedTokenRequests: 0, expectedFileContent: []string{"token=cached"}},
+		{name: "expired", server: &tokenServer{rotate: true}, fileContent: "login=user@domain.local\ntoken=cached\noauth-refresh-token=" + testRefreshToken + "\n",
+			settings:      cmdflags.Settings{Authentication: types.OAuthBearerAuth, Token: "cached", TokenExpiry: expiredExpiry, OAuthClientId: testClientId, OAuthRefreshToken: testRefreshToken},
+			expectedToken: "access-1", expectedTokenRequests: 1, expectedFileContent: []string{"login=user@domain.local", "token=\"access-1\"", "oauth-refresh-token=\"refresh-2\"", "token-expiry=\""}},
+		{name: "device login", server: &tokenServer{}, fileContent: "",
+			settings:      cmdflags.Settings{Authentication: types.XOAuth2Auth, OAuthClientId: testClientId},
+			expectedToken: "access-device", expectedTokenRequests: 1, expectedFileContent: []string{"token=\"access-device\"", "oauth-refresh-token=\"refresh-device\""}},
+		{name: "vault references", server: &tokenServer{rotate: true}, fileContent: "token=vault:access\noauth-refresh-token=vault:refresh\n",
+			settings:      cmdflags.Settings{Authentication: types.XOAuth2Auth, Token: "cached", TokenExpiry: expiredExpiry, OAuthClientId: testClientId, OAuthRefreshToken: testRefreshToken},
+			expectedToken: "access-1", expectedTokenRequests: 1, expectedFileContent: []string{"token=vault:access", "oauth-refresh-token=vault:refresh"}, unexpectedContent: []string{"access-1", "refresh-2", "token-expiry"}},
+		{name: "token source", server: &tokenServer{rotate: true}, fileContent: "token-source=env\noauth-refresh-token=" + testRefreshToken + "\n",
+			settings:      cmdflags.Settings{Authentication: types.XOAuth2Auth, Token: "from-env", TokenSource: types.EnvCredentialSource, TokenExpiry: expiredExpiry, OAuthClientId: testClientId, OAuthRefreshToken: testRefreshToken},
+			expectedToken: "access-1", expectedTokenRequests: 1, expectedFileContent: []string{"token-source=env", "oauth-refresh-token=\"refresh-2\""}, unexpectedContent: []string{"access-1", "token-expiry"}},
+		{name: "other method", server: &tokenServer{}, fileContent: "",
+			settings:      cmdflags.Settings{Authentication: types.PlainAuth, OAuthClientId: testClientId, OAuthRefreshToken: testRefreshToken},
+			expectedToken: "", expectedTokenRequests: 0, expectedFileContent: []string{}},
+	}
+
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			srv := startTokenServer(c.server)
+			defer srv.Close()
+
+			authFile, err := os.CreateTemp(os.TempDir(), "auth")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(authFile.Name())
+			if _, err := authFile.WriteString(c.fileContent); err != nil {
+				t.Fatal(err)
+			}
+			authFile.Close()
+
+			st := c.settings
+			st.AuthFile = types.FilePath(authFile.Name())
+			st.OAuthTokenUrl = types.Url(srv.URL + "/token")
+			st.OAuthDeviceUrl = types.Url(srv.URL + "/device")
+			if err := GetAccessToken(context.Background(), &st, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+
+			if st.Token != c.expectedToken {
+				t.Errorf("Expected token %s, got %s", c.expectedToken, st.Token)
+			}
+			if (*c.server).tokenRequests != c.expectedTokenRequests {
+				t.Errorf("Expected %d token requests, got %d", c.expectedTokenRequests, (*c.server).tokenRequests)
+			}
+			content, err := os.ReadFile(authFile.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range c.expectedFileContent {
+				if !strings.Contains(string(content), line) {
+					t.Errorf("Expected %q in settings file, got %q", line, content)
+				}
+			}
+			for _, text := range c.unexpectedContent {
+				if strings.Contains(string(content), text) {
+					t.Errorf("Expected no %q in settings file, got %q", text, content)
+				}
+			}
+		})
+	}
+}
+
+func checkError(occuredErr error, expectedErr *[]error) (bool, error) {
+	if expectedErr == nil || len(*expectedErr) == 0 {
+		if occuredErr != nil {
+			return false, fmt.Errorf("Expected no error, got %s", occuredErr)
+		}
+	} else {
+		if occuredErr == nil {
+			if len(*expectedErr) == 1 {
+				return false, fmt.Errorf("Expected error %s, got no error", (*expectedErr)[0])
+			} else {
+				return false, fmt.Errorf("Expected errors %s, got no error", errors.Join(*expectedErr...))
+			}
+		} else {
+			for _, exp := range *expectedErr {
+				if !strings.Contains(occuredErr.Error(), exp.Error()) {
+					return false, fmt.Errorf("Expected error %s, got %s", exp, occuredErr)
+				}
+			}
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,84 @@
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+	"github.com/Sternisaea/gosend/src/vault"
+)
+
+// GetAccessToken provides the access token in the settings when an OAuth2 token endpoint is configured
+// for authentication method XOAUTH2 or OAUTHBEARER.
+// A cached access token that has not expired is kept. Otherwise the refresh token is exchanged for a new
+// access token, or the device flow is started when there is no refresh token yet. New tokens are written
+// back to the authentication file, except over vault references and a token that is read from a token source.
+// The requests to the endpoints end when ctx is done.
+func GetAccessToken(ctx context.Context, st *cmdflags.Settings, output io.Writer) error {
+	if (*st).OAuthTokenUrl == "" {
+		return nil
+	}
+	switch (*st).Authentication {
+	case types.XOAuth2Auth, types.OAuthBearerAuth, types.AutoAuth:
+	default:
+		return nil
+	}
+	cached := &Token{AccessToken: (*st).Token, Expiry: (*st).TokenExpiry.GetTime()}
+	if cached.Valid() {
+		return nil
+	}
+
+	client := NewClient((*st).OAuthTokenUrl.String(), (*st).OAuthDeviceUrl.String(), (*st).OAuthClientId, (*st).OAuthClientSecret, (*st).OAuthScope)
+	var token *Token
+	var err error
+	switch {
+	case (*st).OAuthRefreshToken != "":
+		token, err = client.Refresh(ctx, (*st).OAuthRefreshToken)
+	case (*st).OAuthDeviceUrl != "":
+		token, err = client.DeviceLogin(ctx, output)
+	default:
+		err = fmt.Errorf("%w (%w)", ErrNoRefreshToken, ErrNoDeviceUrl)
+	}
+	if err != nil {
+		return err
+	}
+
+	rotated := (*token).RefreshToken != (*st).OAuthRefreshToken
+	(*st).Token = (*token).AccessToken
+	(*st).TokenExpiry = types.Timestamp((*token).Expiry)
+	(*st).OAuthRefreshToken = (*token).RefreshToken
+
+	if (*st).AuthFile == "" {
+		fmt.Fprintf(output, "No authentication file provided, OAuth2 tokens are not stored\n")
+		return nil
+	}
+	written, err := cmdflags.ReadOptionsOfFile((*st).AuthFile)
+	if err != nil {
+		return err
+	}
+	opts := make(map[string]string)
+	// Without a token in the file, the token may come from a token source, which is asked again next time
+	if isLiteral(written, cmdflags.KeyToken) && (written[cmdflags.KeyToken] != "" || (*st).TokenSource == types.NoCredentialSource) {
+		opts[cmdflags.KeyToken] = (*token).AccessToken
+		opts[cmdflags.KeyTokenExpiry] = (*st).TokenExpiry.String()
+	}
+	if (*token).RefreshToken != "" {
+		if isLiteral(written, cmdflags.KeyOAuthRefreshToken) {
+			opts[cmdflags.KeyOAuthRefreshToken] = (*token).RefreshToken
+		} else if rotated {
+			fmt.Fprintf(output, "New OAuth2 refresh token is not stored, %s refers to the vault\n", cmdflags.KeyOAuthRefreshToken)
+		}
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	return cmdflags.UpdateOptionsOfFile((*st).AuthFile, opts)
+}
+
+// isLiteral reports whether the option in the file may be overwritten: it is absent or holds the value itself instead of a vault reference
+func isLiteral(opts map[string]string, key string) bool {
+	return !strings.HasPrefix(opts[key], vault.ReferencePrefix)
+}
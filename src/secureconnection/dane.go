@@ -0,0 +1,126 @@
+package secureconnection
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TLSA certificate usages, selectors and matching types (RFC 6698)
+const (
+	tlsaUsageDaneTa  = 2
+	tlsaUsageDaneEe  = 3
+	tlsaSelectorCert = 0
+	tlsaSelectorSpki = 1
+	tlsaMatchFull    = 0
+	tlsaMatchSha256  = 1
+	tlsaMatchSha512  = 2
+)
+
+var (
+	ErrDaneNotAuthenticated = errors.New("TLSA records are not authenticated by DNSSEC")
+	ErrDaneNoRecords        = errors.New("no TLSA records found")
+	ErrDaneNoUsableRecords  = errors.New("no usable TLSA records (DANE-TA or DANE-EE expected)")
+	ErrDaneMismatch         = errors.New("server certificate does not match any TLSA record")
+)
+
+// getDaneRecords looks up the TLSA records of the server and keeps the usages that apply to SMTP (RFC 7672 section 3.1)
+func getDaneRecords(ctx context.Context, hostname string, port int) ([]tlsaRecord, error) {
+	records, authenticated, err := lookupTLSA(ctx, hostname, port)
+	if err != nil {
+		return nil, err
+	}
+	if !authenticated {
+		return nil, fmt.Errorf("%w: _%d._tcp.%s", ErrDaneNotAuthenticated, port, hostname)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%w: _%d._tcp.%s", ErrDaneNoRecords, port, hostname)
+	}
+
+	usable := make([]tlsaRecord, 0, len(records))
+	for _, r := range records {
+		if (r.Usage != tlsaUsageDaneTa && r.Usage != tlsaUsageDaneEe) || r.Selector > tlsaSelectorSpki || r.MatchingType > tlsaMatchSha512 {
+			continue
+		}
+		usable = append(usable, r)
+	}
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("%w: _%d._tcp.%s", ErrDaneNoUsableRecords, port, hostname)
+	}
+	return usable, nil
+}
+
+// verifyDane is used as VerifyConnection callback instead of the verification by certificate authorities.
+// A DANE-EE record must match the server certificate, whose names and validity are not checked (RFC 7672 section 3.1.1).
+// A DANE-TA record must match a certificate in the presented chain, which must be a valid issuer of the server certificate for serverName.
+func verifyDane(records []tlsaRecord, serverName string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return ErrDaneMismatch
+		}
+		leaf := state.PeerCertificates[0]
+		for _, r := range records {
+			switch r.Usage {
+			case tlsaUsageDaneEe:
+				if r.matches(leaf) {
+					return nil
+				}
+			case tlsaUsageDaneTa:
+				for _, cert := range state.PeerCertificates[1:] {
+					if r.matches(cert) && verifyTrustAnchor(leaf, cert, state.PeerCertificates[1:], serverName) == nil {
+						return nil
+					}
+				}
+			}
+		}
+		return fmt.Errorf("%w: server presented %s", ErrDaneMismatch, leaf.Subject)
+	}
+}
+
+func verifyTrustAnchor(leaf, anchor *x509.Certificate, chain []*x509.Certificate, serverName string) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(anchor)
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain {
+		if cert != anchor {
+			intermediates.AddCert(cert)
+		}
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+	})
+	return err
+}
+
+func (r tlsaRecord) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case tlsaSelectorCert:
+		data = cert.Raw
+	case tlsaSelectorSpki:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch r.MatchingType {
+	case tlsaMatchFull:
+		return bytes.Equal(r.Data, data)
+	case tlsaMatchSha256:
+		hash := sha256.Sum256(data)
+		return bytes.Equal(r.Data, hash[:])
+	case tlsaMatchSha512:
+		hash := sha512.Sum512(data)
+		return bytes.Equal(r.Data, hash[:])
+	default:
+		return false
+	}
+}
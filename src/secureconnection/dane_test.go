@@ -0,0 +1,301 @@
+package secureconnection
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Sternisaea/dnsservermock/src/dnsconst"
+	"github.com/Sternisaea/dnsservermock/src/dnsstorage/dnsstoragememory"
+	"github.com/Sternisaea/gosend/src/certificates"
+	"github.com/Sternisaea/gosend/src/types"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func Test_Dane(t *testing.T) {
+	selfCert, selfKey, err := certificates.CreateCertificate("Domain Local", "mail.domain.local")
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	defer os.Remove(selfKey)
+	defer os.Remove(selfCert)
+	caCert, caKey, err := certificates.CreateCA("Domain Local")
+	if err != nil {
+		t.Fatalf("Error creating CA: %s", err)
+	}
+	defer os.Remove(caKey)
+	defer os.Remove(caCert)
+	signedCert, signedKey, err := certificates.CreateServerCertificate("Domain Local", "mail.domain.local", caCert, caKey)
+	if err != nil {
+		t.Fatalf("Error creating server certificate: %s", err)
+	}
+	defer os.Remove(signedKey)
+	defer os.Remove(signedCert)
+
+	self, selfPair := loadChain(t, selfKey, selfCert)
+	ca, _ := loadChain(t, caKey, caCert)
+	_, signedPair := loadChain(t, signedKey, signedCert, caCert)
+
+	store := dnsstoragememory.NewMemoryStore()
+	(*store).Set("mail.domain.local", dnsconst.Type_A, "127.0.0.1")
+	dns, err := startDnsFixture(store)
+	if err != nil {
+		t.Fatalf("Cannot start DNS server: %s", err)
+	}
+	defer dns.stop()
+	defaultResolver := net.DefaultResolver
+	setDefaultResolver(dns.address)
+	defer func() { net.DefaultResolver = defaultResolver }()
+
+	selfTlsPort, stopSelfTls, err := startStandInServer(true, &tls.Config{Certificates: []tls.Certificate{selfPair}})
+	if err != nil {
+		t.Fatalf("Cannot start SMTP server with TLS: %s", err)
+	}
+	defer stopSelfTls()
+	selfStarttlsPort, stopSelfStarttls, err := startStandInServer(false, &tls.Config{Certificates: []tls.Certificate{selfPair}})
+	if err != nil {
+		t.Fatalf("Cannot start SMTP server with STARTTLS: %s", err)
+	}
+	defer stopSelfStarttls()
+	signedTlsPort, stopSignedTls, err := startStandInServer(true, &tls.Config{Certificates: []tls.Certificate{signedPair}})
+	if err != nil {
+		t.Fatalf("Cannot start SMTP server with TLS: %s", err)
+	}
+	defer stopSignedTls()
+
+	spkiSha256 := sha256.Sum256(self.RawSubjectPublicKeyInfo)
+	certSha256 := sha256.Sum256(self.Raw)
+	spkiSha512 := sha512.Sum512(self.RawSubjectPublicKeyInfo)
+	caSha256 := sha256.Sum256(ca.Raw)
+	otherSha256 := sha256.Sum256([]byte("other"))
+	daneEeSpki := tlsaRecord{Usage: tlsaUsageDaneEe, Selector: tlsaSelectorSpki, MatchingType: tlsaMatchSha256, Data: spkiSha256[:]}
+	daneTaCert := tlsaRecord{Usage: tlsaUsageDaneTa, Selector: tlsaSelectorCert, MatchingType: tlsaMatchSha256, Data: caSha256[:]}
+
+	dane := TlsPolicy{Verify: types.DaneVerify}
+	type daneCheck struct {
+		name                  string
+		connection            SecureConnection
+		records               []tlsaRecord
+		authenticated         bool
+		expectedConnectErrors *[]error
+	}
+	checklist := []daneCheck{
+		{name: "ssl/tls dane-ee spki sha256", connection: NewConnectSslTls("mail.domain.local", selfTlsPort, dane), records: []tlsaRecord{daneEeSpki}, authenticated: true},
+		{name: "starttls dane-ee spki sha256", connection: NewConnectStarttls("mail.domain.local", selfStarttlsPort, dane), records: []tlsaRecord{daneEeSpki}, authenticated: true},
+		{name: "ssl/tls dane-ee cert sha256", connection: NewConnectSslTls("mail.domain.local", selfTlsPort, dane), records: []tlsaRecord{{Usage: tlsaUsageDaneEe, Selector: tlsaSelectorCert, MatchingType: tlsaMatchSha256, Data: certSha256[:]}}, authenticated: true},
+		{name: "ssl/tls dane-ee spki sha512", connection: NewConnectSslTls("mail.domain.local", selfTlsPort, dane), records: []tlsaRecord{{Usage: tlsaUsageDaneEe, Selector: tlsaSelectorSpki, MatchingType: tlsaMatchSha512, Data: spkiSha512[:]}}, authenticated: true},
+		{name: "ssl/tls dane-ee spki full", connection: NewConnectSslTls("mail.domain.local", selfTlsPort, dane), records: []tlsaRecord{{Usage: tlsaUsageDaneEe, Selector: tlsaSelectorSpki, MatchingType: tlsaMatchFull, Data: self.RawSubjectPublicKeyInfo}}, authenticated: true},
+		{name: "ssl/tls dane-ee ignores name", connection: NewConnectSslTls("localhost", selfTlsPort, dane), records: []tlsaRecord{daneEeSpki}, authenticated: true},
+		{name: "ssl/tls dane-ee second record", connection: NewConnectSslTls("mail.domain.local", selfTlsPort, dane), records: []tlsaRecord{{Usage: tlsaUsageDaneEe, Selector: tlsaSelectorSpki, MatchingType: tlsaMatchSha256, Data: otherSha256[:]}, daneEeSpki}, authenticated: true},
+		{name: "ssl/tls dane-ee mismatch", connection: NewConnectSslTls("mail.domain.local", selfTlsPort, dane), records: []tlsaRecord{{Usage: tlsaUsageDaneEe, Selector: tlsaSelectorSpki, MatchingType: tlsaMatchSha256, Data: otherSha256[:]}}, authenticated: true, expectedConnectErrors: &[]error{ErrDaneMismatch}},
+		{name: "starttls dane-ee mismatch", connection: NewConnectStarttls("mail.domain.local", selfStarttlsPort, dane), records: []tlsaRecord{{Usage: tlsaUsageDaneEe, Selector: tlsaSelectorCert, MatchingType: tlsaMatchSha256, Data: spkiSha256[:]}}, authenticated: true, expectedConnectErrors: &[]error{ErrDaneMismatch}},
+		{name: "ssl/tls dane-ta", connection: NewConnectSslTls("mail.domain.local", signedTlsPort, dane), records: []tlsaRecord{daneTaCert}, authenticated: true},
+		{name: "ssl/tls dane-ta wrong name", connection: NewConnectSslTls("localhost", signedTlsPort, dane), records: []tlsaRecord{daneTaCert}, authenticated: true, expectedConnectErrors: &[]error{ErrDaneMismatch}},
+		{name: "ssl/tls dane-ta server name", connection: NewConnectSslTls("localhost", signedTlsPort, TlsPolicy{Verify: types.DaneVerify, ServerName: "mail.domain.local"}), records: []tlsaRecord{daneTaCert}, authenticated: true},
+		{name: "ssl/tls dane-ta self-signed", connection: NewConnectSslTls("mail.domain.local", selfTlsPort, dane), records: []tlsaRecord{daneTaCert}, authenticated: true, expectedConnectErrors: &[]error{ErrDaneMismatch}},
+		{name: "ssl/tls dane with pin", connection: NewConnectSslTls("mail.domain.local", selfTlsPort, TlsPolicy{Verify: types.DaneVerify, Pins: types.TlsPins{{Kind: types.PinSpki, Hash: otherSha256}}}), records: []tlsaRecord{daneEeSpki}, authenticated: true, expectedConnectErrors: &[]error{ErrPinMismatch}},
+		{name: "ssl/tls not authenticated", connection: NewConnectSslTls("mail.domain.local", selfTlsPort, dane), records: []tlsaRecord{daneEeSpki}, authenticated: false, expectedConnectErrors: &[]error{ErrDaneNotAuthenticated}},
+		{name: "ssl/tls no records", connection: NewConnectSslTls("mail.domain.local", selfTlsPort, dane), authenticated: true, expectedConnectErrors: &[]error{ErrDaneNoRecords}},
+		{name: "ssl/tls pkix-ee unusable", connection: NewConnectSslTls("mail.domain.local", selfTlsPort, dane), records: []tlsaRecord{{Usage: 1, Selector: tlsaSelectorSpki, MatchingType: tlsaMatchSha256, Data: spkiSha256[:]}}, authenticated: true, expectedConnectErrors: &[]error{ErrDaneNoUsableRecords}},
+		{name: "ssl/tls pkix without dane", connection: NewConnectSslTls("mail.domain.local", selfTlsPort, TlsPolicy{}), records: []tlsaRecord{daneEeSpki}, authenticated: true, expectedConnectErrors: &[]error{ErrX509UnknownAuthority}},
+	}
+
+	// The records apply to every server of the test
+	setTlsa := func(records []tlsaRecord, authenticated bool) {
+		var texts []string
+		for _, r := range records {
+			texts = append(texts, fmt.Sprintf("%d %d %d %x", r.Usage, r.Selector, r.MatchingType, r.Data))
+		}
+		for _, host := range []string{"mail.domain.local", "localhost"} {
+			for _, port := range []int{selfTlsPort, selfStarttlsPort, signedTlsPort} {
+				dns.set(fmt.Sprintf("_%d._tcp.%s", port, host), dnsconst.Type_TLSA, texts...)
+			}
+		}
+		dns.setAuthenticated(authenticated)
+	}
+
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			setTlsa(c.records, c.authenticated)
+			client, close, _, err := c.connection.ClientConnect(context.Background())
+			if cont, err := checkError(err, c.expectedConnectErrors); !cont || err != nil {
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			close()
+			if _, ok := client.TLSConnectionState(); !ok {
+				t.Errorf("Expected TLS connection")
+			}
+		})
+	}
+}
+
+func Test_TlsaAnswer(t *testing.T) {
+	name := dnsmessage.MustNewName("_25._tcp.mail.domain.local.")
+	record := tlsaRecord{Usage: tlsaUsageDaneEe, Selector: tlsaSelectorSpki, MatchingType: tlsaMatchSha256, Data: make([]byte, sha256.Size)}
+	answer, err := buildRecordAnswer(1234, dnsmessage.Question{Name: name, Type: typeTLSA, Class: dnsmessage.ClassINET}, []string{fmt.Sprintf("3 1 1 %x", record.Data)}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, authenticated, err := parseTlsaAnswer(answer, 1234, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !authenticated || len(records) != 1 || records[0].Usage != record.Usage || records[0].Selector != record.Selector || records[0].MatchingType != record.MatchingType || len(records[0].Data) != sha256.Size {
+		t.Errorf("Expected %v (authenticated), got %v (authenticated %t)", record, records, authenticated)
+	}
+	if _, _, err := parseTlsaAnswer(answer, 4321, name); !errors.Is(err, ErrDnsInvalidAnswer) {
+		t.Errorf("Expected error %s, got %v", ErrDnsInvalidAnswer, err)
+	}
+	if _, _, err := parseTlsaAnswer(answer[:len(answer)-1], 1234, name); !errors.Is(err, ErrDnsInvalidAnswer) {
+		t.Errorf("Expected error %s, got %v", ErrDnsInvalidAnswer, err)
+	}
+}
+
+// loadChain returns the first certificate and the key pair with all certificates in certFiles as chain
+func loadChain(t *testing.T, keyFile string, certFiles ...string) (*x509.Certificate, tls.Certificate) {
+	t.Helper()
+	var chainPem []byte
+	for _, certFile := range certFiles {
+		certPem, err := os.ReadFile(certFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chainPem = append(chainPem, certPem...)
+	}
+	keyPem, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.X509KeyPair(chainPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(chainPem)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, pair
+}
+
+func Test_TrustAd(t *testing.T) {
+	defaultResolvConf := resolvConf
+	defer func() { resolvConf = defaultResolvConf }()
+	resolvConf = filepath.Join(t.TempDir(), "resolv.conf")
+
+	type trustCheck struct {
+		name            string
+		content         string
+		expectedServers []string
+		expectedTrustAd bool
+	}
+	checklist := []trustCheck{
+		{name: "no configuration", expectedServers: []string{"127.0.0.1:53"}},
+		{name: "remote resolver", content: "nameserver 192.0.2.1\nnameserver 192.0.2.2\n", expectedServers: []string{"192.0.2.1:53", "192.0.2.2:53"}},
+		{name: "trust-ad", content: "nameserver 192.0.2.1\noptions edns0 trust-ad\n", expectedServers: []string{"192.0.2.1:53"}, expectedTrustAd: true},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			if c.content == "" {
+				os.Remove(resolvConf)
+			} else if err := os.WriteFile(resolvConf, []byte(c.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			servers, trustAd := getNameServers()
+			if !slices.Equal(servers, c.expectedServers) || trustAd != c.expectedTrustAd {
+				t.Errorf("Expected %v %t, got %v %t", c.expectedServers, c.expectedTrustAd, servers, trustAd)
+			}
+		})
+	}
+
+	// The AD bit is accepted from a local resolver without trust-ad
+	for ip, expected := range map[string]bool{"127.0.0.1": true, "::1": true, "192.0.2.1": false, "2001:db8::1": false} {
+		if got := isLoopback(&net.UDPAddr{IP: net.ParseIP(ip), Port: 53}); got != expected {
+			t.Errorf("Expected loopback %t for %s, got %t", expected, ip, got)
+		}
+	}
+}
+
+func Test_TlsaNameServers(t *testing.T) {
+	defaultResolvConf := resolvConf
+	defer func() { resolvConf = defaultResolvConf }()
+	resolvConf = filepath.Join(t.TempDir(), "resolv.conf")
+
+	store := dnsstoragememory.NewMemoryStore()
+	dns, err := startDnsFixture(store)
+	if err != nil {
+		t.Fatalf("Cannot start DNS server: %s", err)
+	}
+	defer dns.stop()
+	digest := sha256.Sum256([]byte("server"))
+	dns.set("_25._tcp.mail.domain.local", dnsconst.Type_TLSA, fmt.Sprintf("3 1 1 %x", digest))
+	dns.setAuthenticated(true)
+
+	// Name servers in the documentation range cannot be reached, the loopback name server is the DNS fixture
+	defaultResolver := net.DefaultResolver
+	defer func() { net.DefaultResolver = defaultResolver }()
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, server string) (net.Conn, error) {
+			if !strings.HasPrefix(server, "127.0.0.1:") {
+				return nil, fmt.Errorf("dial %s: network unreachable", server)
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", dns.address)
+		},
+	}
+
+	type nameServerCheck struct {
+		name           string
+		content        string
+		cancel         bool
+		expectedErrors *[]error
+	}
+	checklist := []nameServerCheck{
+		{name: "first name server", content: "nameserver 127.0.0.1\nnameserver 192.0.2.1\n"},
+		{name: "second name server", content: "nameserver 192.0.2.1\nnameserver 127.0.0.1\n"},
+		{name: "no name server", content: "nameserver 192.0.2.1\nnameserver 192.0.2.2\n", expectedErrors: &[]error{ErrDnsLookup, errors.New("192.0.2.1:53"), errors.New("192.0.2.2:53")}},
+		{name: "cancelled", content: "nameserver 127.0.0.1\n", cancel: true, expectedErrors: &[]error{ErrDnsLookup, context.Canceled}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			if err := os.WriteFile(resolvConf, []byte(c.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			if c.cancel {
+				cancel()
+			}
+			defer cancel()
+			records, authenticated, err := lookupTLSA(ctx, "mail.domain.local", 25)
+			if cont, err := checkError(err, c.expectedErrors); !cont || err != nil {
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if len(records) != 1 || !bytes.Equal(records[0].Data, digest[:]) {
+				t.Errorf("Expected TLSA record %x, got %v", digest, records)
+			}
+			if !authenticated {
+				t.Errorf("Expected authenticated answer of the local name server")
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package secureconnection
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+// Values of smtp-host to discover the submission server of the sender domain
+const (
+	DiscoverAuto = types.DiscoverAuto
+	DiscoverHost = types.DiscoverHost
+)
+
+var (
+	ErrDiscoveryNoSender = errors.New("sender is required to discover the SMTP server")
+	ErrDiscoveryNoServer = errors.New("no submission server found")
+	ErrDiscoveryOutside  = errors.New("discovered submission server is outside of the sender domain")
+	ErrDiscoverySecurity = errors.New("security protocol cannot be used to discover the SMTP server")
+)
+
+// Source of randomness for the selection by weight
+var srvRandom = rand.IntN
+
+// Submission services in order of preference: implicit TLS before STARTTLS (RFC 8314 section 5.1)
+var submissionServices = []struct {
+	name     string
+	security types.Security
+}{
+	{"submissions", types.SslTlsSec},
+	{"submission", types.StartTlsSec},
+}
+
+type srvCandidate struct {
+	security types.Security
+	record   *net.SRV
+}
+
+// IsDiscover reports whether host asks to discover the submission server
+func IsDiscover(host types.DomainName) bool {
+	return host.IsDiscover()
+}
+
+// Discover looks up the submission server of the sender domain by the SRV records of _submissions._tcp and _submission._tcp (RFC 6186).
+// The SMTP host, port and security of the settings are replaced by the selected server. When a security protocol is set, only the matching service is looked up.
+// A server outside of the sender domain is only used when the user confirms, as the SRV records are not authenticated (RFC 6186 section 6).
+// The credentials that depend on the SMTP host, e.g. from netrc or the prompt, are resolved for the selected server.
+func Discover(st *cmdflags.Settings) error {
+	address := st.Sender.GetMailAddress().Address
+	i := strings.LastIndex(address, "@")
+	if i < 0 || i == len(address)-1 {
+		return ErrDiscoveryNoSender
+	}
+	domain := strings.ToLower(address[i+1:])
+	// The submission services always use TLS (RFC 8314), so a fallback without TLS does not apply
+	if st.Security == types.OpportunisticSec {
+		return fmt.Errorf("%w: %s, use %s, %s or no -security", ErrDiscoverySecurity, st.Security, types.SslTlsSec, types.StartTlsSec)
+	}
+
+	var candidates []srvCandidate
+	var errMsgs []error
+	for _, service := range submissionServices {
+		if st.Security != types.NoSecurity && st.Security != service.security {
+			continue
+		}
+		_, records, err := net.LookupSRV(service.name, "tcp", domain)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				errMsgs = append(errMsgs, err)
+			}
+			continue
+		}
+		for _, r := range records {
+			// Target "." means that the service is not available at this domain
+			if r.Target != "." && r.Target != "" {
+				candidates = append(candidates, srvCandidate{security: service.security, record: r})
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return errors.Join(append([]error{fmt.Errorf("%w: %s", ErrDiscoveryNoServer, domain)}, errMsgs...)...)
+	}
+
+	selected := pickSrv(candidates)
+	host := strings.ToLower(strings.TrimSuffix((*selected.record).Target, "."))
+	if host != domain && !strings.HasSuffix(host, "."+domain) {
+		ok, err := cmdflags.Confirm(fmt.Sprintf("Submission server %s port %d is outside of the sender domain %s. Use it?", host, (*selected.record).Port, domain))
+		if err != nil {
+			return fmt.Errorf("%w: %s for %s: %w", ErrDiscoveryOutside, host, domain, err)
+		}
+		if !ok {
+			return fmt.Errorf("%w: %s for %s", ErrDiscoveryOutside, host, domain)
+		}
+	}
+	(*st).SmtpHost = types.DomainName(host)
+	(*st).SmtpPort = types.TCPPort((*selected.record).Port)
+	(*st).Security = selected.security
+	return cmdflags.ResolveCredentials(st)
+}
+
+// pickSrv selects a server with the lowest priority. Among these the most preferred service is used, and its servers are selected randomly by weight (RFC 2782).
+func pickSrv(candidates []srvCandidate) srvCandidate {
+	lowest := candidates[0]
+	for _, c := range candidates[1:] {
+		if (*c.record).Priority < (*lowest.record).Priority {
+			lowest = c
+		}
+	}
+	var group []srvCandidate
+	total := 0
+	for _, c := range candidates {
+		// Candidates are ordered by service, so the first one with the lowest priority has the preferred service
+		if (*c.record).Priority == (*lowest.record).Priority && c.security == lowest.security {
+			group = append(group, c)
+			total += int((*c.record).Weight)
+		}
+	}
+	if total == 0 {
+		return group[srvRandom(len(group))]
+	}
+	n := srvRandom(total)
+	for _, c := range group {
+		if n < int((*c.record).Weight) {
+			return c
+		}
+		n -= int((*c.record).Weight)
+	}
+	return group[len(group)-1]
+}
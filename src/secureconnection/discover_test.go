@@ -0,0 +1,140 @@
+package secureconnection
+
+import (
+	"errors"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sternisaea/dnsservermock/src/dnsconst"
+	"github.com/Sternisaea/dnsservermock/src/dnsstorage/dnsstoragememory"
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+func Test_Discover(t *testing.T) {
+	store := dnsstoragememory.NewMemoryStore()
+	(*store).Set("_submissions._tcp.domain.local", dnsconst.Type_SRV, "10 1 465 mail.domain.local.")
+	(*store).Set("_submission._tcp.domain.local", dnsconst.Type_SRV, "0 1 587 smtp.domain.local.")
+	(*store).Set("_submission._tcp.starttls.local", dnsconst.Type_SRV, "0 0 587 Mail.Starttls.local.")
+	(*store).Set("_submissions._tcp.equal.local", dnsconst.Type_SRV, "5 0 465 tls.equal.local.")
+	(*store).Set("_submission._tcp.equal.local", dnsconst.Type_SRV, "5 100 587 starttls.equal.local.")
+	(*store).Set("_submissions._tcp.unavailable.local", dnsconst.Type_SRV, "0 0 0 .")
+	(*store).Set("_submissions._tcp.hosted.local", dnsconst.Type_SRV, "0 0 465 smtp.provider.local.")
+	(*store).Set("_submissions._tcp.provider.local", dnsconst.Type_SRV, "0 0 465 provider.local.")
+	dns, err := startDnsFixture(store)
+	if err != nil {
+		t.Fatalf("Cannot start DNS server: %s", err)
+	}
+	defer dns.stop()
+	defaultResolver := net.DefaultResolver
+	setDefaultResolver(dns.address)
+	defer func() { net.DefaultResolver = defaultResolver }()
+
+	defaultConfirm := cmdflags.Confirm
+	defer func() { cmdflags.Confirm = defaultConfirm }()
+	confirmed := false
+	cmdflags.Confirm = func(string) (bool, error) { return confirmed, nil }
+
+	type discoverCheck struct {
+		name             string
+		sender           string
+		security         types.Security
+		confirm          bool
+		expectedHost     types.DomainName
+		expectedPort     types.TCPPort
+		expectedSecurity types.Security
+		expectedErrors   *[]error
+	}
+	checklist := []discoverCheck{
+		{name: "lowest priority", sender: "alice@domain.local", expectedHost: "smtp.domain.local", expectedPort: 587, expectedSecurity: types.StartTlsSec},
+		{name: "security ssl/tls", sender: "alice@Domain.Local", security: types.SslTlsSec, expectedHost: "mail.domain.local", expectedPort: 465, expectedSecurity: types.SslTlsSec},
+		{name: "only starttls", sender: "bob@starttls.local", expectedHost: "mail.starttls.local", expectedPort: 587, expectedSecurity: types.StartTlsSec},
+		{name: "equal priority prefers implicit tls", sender: "carol@equal.local", expectedHost: "tls.equal.local", expectedPort: 465, expectedSecurity: types.SslTlsSec},
+		{name: "security not offered", sender: "bob@starttls.local", security: types.SslTlsSec, expectedErrors: &[]error{ErrDiscoveryNoServer}},
+		{name: "service not available", sender: "dave@unavailable.local", expectedErrors: &[]error{ErrDiscoveryNoServer}},
+		{name: "no records", sender: "erin@missing.local", expectedErrors: &[]error{ErrDiscoveryNoServer}},
+		{name: "security opportunistic", sender: "alice@domain.local", security: types.OpportunisticSec, expectedErrors: &[]error{ErrDiscoverySecurity, errors.New("opportunistic")}},
+		{name: "no sender", expectedErrors: &[]error{ErrDiscoveryNoSender}},
+		{name: "server is sender domain", sender: "frank@provider.local", expectedHost: "provider.local", expectedPort: 465, expectedSecurity: types.SslTlsSec},
+		{name: "outside domain confirmed", sender: "grace@hosted.local", confirm: true, expectedHost: "smtp.provider.local", expectedPort: 465, expectedSecurity: types.SslTlsSec},
+		{name: "outside domain not confirmed", sender: "grace@hosted.local", expectedErrors: &[]error{ErrDiscoveryOutside, errors.New("smtp.provider.local for hosted.local")}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			confirmed = c.confirm
+			st := &cmdflags.Settings{SmtpHost: DiscoverAuto, Sender: types.Email(mail.Address{Address: c.sender}), Security: c.security}
+			if cont, err := checkError(Discover(st), c.expectedErrors); !cont {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if st.SmtpHost != c.expectedHost || st.SmtpPort != c.expectedPort || st.Security != c.expectedSecurity {
+				t.Errorf("Expected %s port %d (%s), got %s port %d (%s)", c.expectedHost, c.expectedPort, c.expectedSecurity, st.SmtpHost, st.SmtpPort, st.Security)
+			}
+		})
+	}
+
+	// The discovered server is used as if given explicitly
+	st := &cmdflags.Settings{SmtpHost: DiscoverHost, Sender: types.Email(mail.Address{Address: "alice@domain.local"})}
+	sc, err := GetSecureConnection(st)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if sc.GetType() != types.StartTlsSec || sc.GetHostName() != "smtp.domain.local" {
+		t.Errorf("Expected STARTTLS connection to smtp.domain.local, got %s to %s", sc.GetType(), sc.GetHostName())
+	}
+
+	// Credentials from netrc are looked up for the discovered server
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(netrc, []byte("machine auto login wrong password Wrong\nmachine smtp.domain.local login alice password Secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(cmdflags.EnvNetrc, netrc)
+	st = &cmdflags.Settings{SmtpHost: DiscoverAuto, Sender: types.Email(mail.Address{Address: "alice@domain.local"}), PasswordSource: types.NetrcCredentialSource}
+	if err := Discover(st); err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if st.Login != "alice" || st.Password != "Secret" {
+		t.Errorf("Expected credentials of smtp.domain.local, got %s %s", st.Login, st.Password)
+	}
+}
+
+func Test_PickSrv(t *testing.T) {
+	defaultRandom := srvRandom
+	defer func() { srvRandom = defaultRandom }()
+	candidates := []srvCandidate{
+		{security: types.SslTlsSec, record: &net.SRV{Target: "a", Priority: 20, Weight: 50}},
+		{security: types.StartTlsSec, record: &net.SRV{Target: "b", Priority: 10, Weight: 10}},
+		{security: types.StartTlsSec, record: &net.SRV{Target: "c", Priority: 10, Weight: 30}},
+		{security: types.StartTlsSec, record: &net.SRV{Target: "d", Priority: 10, Weight: 0}},
+	}
+	checklist := []struct {
+		random   int
+		expected string
+	}{
+		{0, "b"},
+		{9, "b"},
+		{10, "c"},
+		{39, "c"},
+	}
+	for _, c := range checklist {
+		srvRandom = func(n int) int {
+			if n != 40 {
+				t.Errorf("Expected total weight 40, got %d", n)
+			}
+			return c.random
+		}
+		if got := pickSrv(candidates); (*got.record).Target != c.expected {
+			t.Errorf("Random %d: expected %s, got %s", c.random, c.expected, (*got.record).Target)
+		}
+	}
+
+	srvRandom = func(n int) int { return n - 1 }
+	if got := pickSrv(candidates[3:]); (*got.record).Target != "d" {
+		t.Errorf("Expected d without weights, got %s", (*got.record).Target)
+	}
+}
@@ -0,0 +1,76 @@
+package secureconnection
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+// Host name of the system, can be replaced by tests
+var systemHostname = os.Hostname
+
+// GetEhloName returns the name of the ehlo-name setting, or an empty string for the default name
+func GetEhloName(st *cmdflags.Settings) string {
+	return st.EhloName.String()
+}
+
+// newClient reads the greeting of the server and introduces the client with EHLO, or HELO when the server does not support EHLO.
+// Without ehloName the FQDN of the system is used, or the address literal of the local socket when it has none (RFC 5321 section 4.1.4).
+func newClient(ctx context.Context, conn net.Conn, hostname string, ehloName string) (*smtp.Client, error) {
+	client, err := smtp.NewClient(conn, hostname)
+	if err != nil {
+		return nil, inPhase(types.ConnectPhase, err)
+	}
+	if err := client.Hello(helloName(ctx, conn, ehloName)); err != nil {
+		client.Close()
+		return nil, inPhase(types.EhloPhase, err)
+	}
+	return client, nil
+}
+
+// helloName returns ehloName, or the default name for EHLO and LHLO when it is empty
+func helloName(ctx context.Context, conn net.Conn, ehloName string) string {
+	if ehloName != "" {
+		return ehloName
+	}
+	if fqdn := systemFqdn(ctx); fqdn != "" {
+		return fqdn
+	}
+	return addressLiteral(conn.LocalAddr())
+}
+
+// systemFqdn returns the fully qualified domain name of the system, or an empty string when it has none
+func systemFqdn(ctx context.Context) string {
+	hostname, err := systemHostname()
+	if err != nil || hostname == "" {
+		return ""
+	}
+	if !strings.Contains(hostname, ".") {
+		cname, err := net.DefaultResolver.LookupCNAME(ctx, hostname)
+		if err != nil {
+			return ""
+		}
+		hostname = strings.TrimSuffix(cname, ".")
+	}
+	if !strings.Contains(hostname, ".") || strings.HasPrefix(hostname, "localhost") {
+		return ""
+	}
+	return hostname
+}
+
+// addressLiteral returns the address of a TCP endpoint as in [192.0.2.1] or [IPv6:2001:db8::1]
+func addressLiteral(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "localhost"
+	}
+	if ip := (*tcpAddr).IP.To4(); ip != nil {
+		return "[" + ip.String() + "]"
+	}
+	return "[IPv6:" + (*tcpAddr).IP.String() + "]"
+}
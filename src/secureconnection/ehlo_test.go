@@ -0,0 +1,69 @@
+package secureconnection
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func Test_EhloName(t *testing.T) {
+	server, err := startSlowServer(true)
+	if err != nil {
+		t.Fatalf("Cannot start stand-in server: %s", err)
+	}
+	defer server.stop()
+	defer func(h func() (string, error)) { systemHostname = h }(systemHostname)
+
+	type ehloCheck struct {
+		name        string
+		ehloName    string
+		hostname    string
+		hostnameErr error
+		source      Source
+		expected    string
+	}
+	checklist := []ehloCheck{
+		{name: "setting", ehloName: "client.domain.local", hostname: "host.domain.local", expected: "EHLO CLIENT.DOMAIN.LOCAL"},
+		{name: "system fqdn", hostname: "host.domain.local", expected: "EHLO HOST.DOMAIN.LOCAL"},
+		{name: "system without domain", hostname: "localhost", expected: "EHLO [127.0.0.1]"},
+		{name: "system without hostname", hostnameErr: errors.New("no hostname"), expected: "EHLO [127.0.0.1]"},
+		{name: "bind address", hostname: "localhost", source: Source{Address: net.ParseIP("127.0.0.2")}, expected: "EHLO [127.0.0.2]"},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			systemHostname = func() (string, error) { return c.hostname, c.hostnameErr }
+			conn := NewConnectNone("127.0.0.1", server.port)
+			conn.SetSource(c.source)
+			conn.SetEhloName(c.ehloName)
+			_, close, _, err := conn.ClientConnect(context.Background())
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			defer close()
+			if got := server.lastCommand(); got != c.expected {
+				t.Errorf("Expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
+
+func Test_AddressLiteral(t *testing.T) {
+	type literalCheck struct {
+		name     string
+		addr     net.Addr
+		expected string
+	}
+	checklist := []literalCheck{
+		{name: "ipv4", addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}, expected: "[192.0.2.1]"},
+		{name: "ipv6", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}, expected: "[IPv6:2001:db8::1]"},
+		{name: "no tcp", addr: &net.UnixAddr{Name: "/tmp/socket", Net: "unix"}, expected: "localhost"},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			if got := addressLiteral(c.addr); got != c.expected {
+				t.Errorf("Expected %s, got %s", c.expected, got)
+			}
+		})
+	}
+}
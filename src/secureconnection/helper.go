@@ -31,3 +31,10 @@ func getPemCertificate(path string) (*x509.CertPool, error) {
 	}
 	return rootCAs, nil
 }
+
+func checkClientCertificate(clientCertPath, clientKeyPath string) error {
+	if (clientCertPath == "") != (clientKeyPath == "") {
+		return ErrClientCertificateIncomplete
+	}
+	return errors.Join(checkPath(clientCertPath), checkPath(clientKeyPath))
+}
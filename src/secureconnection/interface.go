@@ -1,8 +1,10 @@
 package secureconnection
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log"
 	"net/smtp"
 
 	"github.com/Sternisaea/gosend/src/cmdflags"
@@ -10,31 +12,80 @@ import (
 )
 
 var (
-	ErrNoHostname              = errors.New("no hostname provided")
-	ErrNoPort                  = errors.New("no tcp-port provided")
-	ErrFileDoesNotExist        = errors.New("file does not exist")
-	ErrFile                    = errors.New("error file")
-	ErrFailedAppendCertificate = errors.New("failed to append PEM certificate")
-	ErrStarttlsNotSupported    = errors.New("server does not support STARTTLS")
-	ErrSslTlsNotSupported      = errors.New("server does not support SSL/TLS")
-	ErrUnknownProtocol         = errors.New("unkown security protocol")
+	ErrNoHostname                  = errors.New("no hostname provided")
+	ErrNoPort                      = errors.New("no tcp-port provided")
+	ErrFileDoesNotExist            = errors.New("file does not exist")
+	ErrFile                        = errors.New("error file")
+	ErrFailedAppendCertificate     = errors.New("failed to append PEM certificate")
+	ErrClientCertificate           = errors.New("cannot load client certificate")
+	ErrClientCertificateIncomplete = errors.New("client certificate and client key must be provided together")
+	ErrStarttlsNotSupported        = errors.New("server does not support STARTTLS")
+	ErrSslTlsNotSupported          = errors.New("server does not support SSL/TLS")
+	ErrUnknownProtocol             = errors.New("unkown security protocol")
 )
 
 type SecureConnection interface {
 	Check() error
-	ClientConnect() (*smtp.Client, func() error, string, error)
+	ClientConnect(ctx context.Context) (*smtp.Client, func() error, string, error)
 	GetType() types.Security
 	GetHostName() string
 }
 
 func GetSecureConnection(st *cmdflags.Settings) (SecureConnection, error) {
+	if IsDiscover(st.SmtpHost) {
+		if err := Discover(st); err != nil {
+			return nil, err
+		}
+	}
+
+	policy := GetTlsPolicy(st)
+	if st.MtaStsDomain != "" {
+		var err error
+		if policy, err = getStsTlsPolicy(st, policy); err != nil {
+			return nil, err
+		}
+	}
+	proxy, err := GetProxy(st)
+	if err != nil {
+		return nil, err
+	}
+	timeouts := GetTimeouts(st)
+	source := GetSource(st)
+	ehloName := GetEhloName(st)
+
 	switch st.Security {
 	case types.NoSecurity:
-		return NewConnectNone(st.SmtpHost.String(), int(st.SmtpPort)), nil
+		if policy.Require {
+			return nil, fmt.Errorf("%w: %s", ErrStsTlsRequired, st.MtaStsDomain)
+		}
+		conn := NewConnectNone(st.SmtpHost.String(), int(st.SmtpPort))
+		conn.SetProxy(proxy)
+		conn.SetTimeouts(timeouts)
+		conn.SetSource(source)
+		conn.SetEhloName(ehloName)
+		return conn, nil
 	case types.StartTlsSec:
-		return NewConnectStarttls(st.SmtpHost.String(), int(st.SmtpPort), st.RootCA.String()), nil
+		conn := NewConnectStarttls(st.SmtpHost.String(), int(st.SmtpPort), policy)
+		conn.SetProxy(proxy)
+		conn.SetTimeouts(timeouts)
+		conn.SetSource(source)
+		conn.SetEhloName(ehloName)
+		return conn, nil
 	case types.SslTlsSec:
-		return NewConnectSslTls(st.SmtpHost.String(), int(st.SmtpPort), st.RootCA.String()), nil
+		conn := NewConnectSslTls(st.SmtpHost.String(), int(st.SmtpPort), policy)
+		conn.SetProxy(proxy)
+		conn.SetTimeouts(timeouts)
+		conn.SetSource(source)
+		conn.SetEhloName(ehloName)
+		return conn, nil
+	case types.OpportunisticSec:
+		conn := NewConnectOpportunistic(st.SmtpHost.String(), int(st.SmtpPort), policy)
+		conn.SetProxy(proxy)
+		conn.SetTimeouts(timeouts)
+		conn.SetSource(source)
+		conn.SetEhloName(ehloName)
+		conn.SetWarning(log.Printf)
+		return conn, nil
 	default:
 		return nil, fmt.Errorf("%w : %s", ErrUnknownProtocol, st.Security)
 	}
@@ -0,0 +1,205 @@
+package secureconnection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+var (
+	ErrNoLmtpAddress = errors.New("no lmtp-address provided")
+	ErrLmtpSecurity  = errors.New("LMTP is supported without security protocol only")
+)
+
+// ConnectLmtp connects to an LMTP server (RFC 2033) on a unix socket or on a TCP port, as offered by mail stores on the local system
+type ConnectLmtp struct {
+	address  types.LmtpAddress
+	timeouts Timeouts
+	source   Source
+	ehloName string
+}
+
+func NewConnectLmtp(address types.LmtpAddress) *ConnectLmtp {
+	return &ConnectLmtp{address: address}
+}
+
+func GetLmtpConnection(st *cmdflags.Settings) (*ConnectLmtp, error) {
+	if st.Security != types.NoSecurity {
+		return nil, fmt.Errorf("%w: %s", ErrLmtpSecurity, st.Security)
+	}
+	conn := NewConnectLmtp(st.LmtpAddress)
+	conn.SetTimeouts(GetTimeouts(st))
+	conn.SetSource(GetSource(st))
+	conn.SetEhloName(GetEhloName(st))
+	return conn, nil
+}
+
+// SetTimeouts limits connecting and every command of the session
+func (c *ConnectLmtp) SetTimeouts(t Timeouts) {
+	(*c).timeouts = t
+}
+
+// SetSource sets the local address and IP version of a TCP connection
+func (c *ConnectLmtp) SetSource(s Source) {
+	(*c).source = s
+}
+
+// SetEhloName sets the name sent with LHLO, or the default name when empty
+func (c *ConnectLmtp) SetEhloName(name string) {
+	(*c).ehloName = name
+}
+
+func (c *ConnectLmtp) Check() error {
+	var errMsgs []error
+	if (*c).address == "" {
+		errMsgs = append(errMsgs, ErrNoLmtpAddress)
+	}
+	errMsgs = append(errMsgs, (*c).source.Check())
+	return errors.Join(errMsgs...)
+}
+
+func (c *ConnectLmtp) GetAddress() string {
+	return (*c).address.String()
+}
+
+// LmtpConnect dials the LMTP server, reads its greeting and introduces the client with LHLO
+func (c *ConnectLmtp) LmtpConnect(ctx context.Context) (*LmtpClient, func() error, error) {
+	if err := c.Check(); err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := &LmtpClient{text: textproto.NewConn(conn)}
+	if _, _, err := (*client).text.ReadResponse(220); err != nil {
+		client.Close()
+		return nil, nil, inPhase(types.ConnectPhase, err)
+	}
+	if err := client.hello(helloName(ctx, conn, (*c).ehloName)); err != nil {
+		client.Close()
+		return nil, nil, inPhase(types.EhloPhase, err)
+	}
+	return client, conn.closeSession(client), nil
+}
+
+func (c *ConnectLmtp) dial(ctx context.Context) (*sessionConn, error) {
+	dialCtx, cancel := connectContext(ctx, (*c).timeouts)
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+	if path, ok := strings.CutPrefix((*c).address.String(), types.UnixSocketPrefix); ok {
+		conn, err = (&net.Dialer{}).DialContext(dialCtx, "unix", path)
+	} else {
+		conn, err = (*c).source.dialer().DialContext(dialCtx, (*c).source.network(), (*c).address.String())
+	}
+	if err != nil {
+		return nil, inPhase(types.ConnectPhase, err)
+	}
+	return newSessionConn(ctx, conn, (*c).timeouts.Command), nil
+}
+
+// LmtpClient is an LMTP session. Unlike SMTP, the server replies to the message for every accepted recipient.
+type LmtpClient struct {
+	text       *textproto.Conn
+	extensions map[string]string
+}
+
+// cmd sends the command and reads the reply, which is an error when the code does not start with expectCode
+func (c *LmtpClient) cmd(expectCode int, format string, args ...any) (int, string, error) {
+	id, err := (*c).text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	(*c).text.StartResponse(id)
+	defer (*c).text.EndResponse(id)
+	return (*c).text.ReadResponse(expectCode)
+}
+
+func (c *LmtpClient) hello(name string) error {
+	_, msg, err := c.cmd(250, "LHLO %s", name)
+	if err != nil {
+		return err
+	}
+	(*c).extensions = make(map[string]string)
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		keyword, args, _ := strings.Cut(line, " ")
+		(*c).extensions[strings.ToUpper(keyword)] = args
+	}
+	return nil
+}
+
+// Extension reports whether the server supports the extension, and its parameters
+func (c *LmtpClient) Extension(name string) (bool, string) {
+	args, ok := (*c).extensions[strings.ToUpper(name)]
+	return ok, args
+}
+
+func (c *LmtpClient) Mail(from string) error {
+	cmd := "MAIL FROM:<%s>"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	_, _, err := c.cmd(250, cmd, from)
+	return err
+}
+
+// Rcpt returns the code of the reply, also when the recipient is rejected
+func (c *LmtpClient) Rcpt(to string) (int, error) {
+	code, _, err := c.cmd(25, "RCPT TO:<%s>", to)
+	return code, err
+}
+
+func (c *LmtpClient) Reset() error {
+	_, _, err := c.cmd(250, "RSET")
+	return err
+}
+
+// Data sends the message and reads the reply for each of the accepted recipients in the order of RCPT (RFC 2033 section 4.2).
+// The codes and errors are the replies per recipient, the last error ends the session.
+// When the session ends while reading the replies, the replies read so far are returned with the error.
+func (c *LmtpClient) Data(content string, accepted int) ([]int, []error, error) {
+	if _, _, err := c.cmd(354, "DATA"); err != nil {
+		return nil, nil, err
+	}
+	wc := (*c).text.DotWriter()
+	if _, err := wc.Write([]byte(content)); err != nil {
+		wc.Close()
+		return nil, nil, err
+	}
+	if err := wc.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	codes := make([]int, accepted)
+	replies := make([]error, accepted)
+	for i := range replies {
+		code, _, err := (*c).text.ReadResponse(250)
+		var protoErr *textproto.Error
+		if err != nil && !errors.As(err, &protoErr) {
+			return codes[:i], replies[:i], err
+		}
+		codes[i], replies[i] = code, err
+	}
+	return codes, replies, nil
+}
+
+func (c *LmtpClient) Quit() error {
+	if _, _, err := c.cmd(221, "QUIT"); err != nil {
+		return err
+	}
+	return (*c).text.Close()
+}
+
+func (c *LmtpClient) Close() error {
+	return (*c).text.Close()
+}
@@ -0,0 +1,327 @@
+package secureconnection
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+)
+
+// MTA-STS policy modes (RFC 8461)
+const (
+	StsEnforce = "enforce"
+	StsTesting = "testing"
+	StsNone    = "none"
+
+	stsVersion      = "STSv1"
+	stsMaxAge       = 31557600 // One year
+	stsMaxPolicy    = 64 * 1024
+	stsFetchTimeout = 10 * time.Second
+)
+
+var (
+	ErrStsRecordInvalid = errors.New("invalid MTA-STS TXT record")
+	ErrStsPolicyInvalid = errors.New("invalid MTA-STS policy")
+	ErrStsFetch         = errors.New("cannot fetch MTA-STS policy")
+	ErrStsHostMismatch  = errors.New("host does not match the MTA-STS policy")
+	ErrStsNoMatchingMx  = errors.New("no MX host matches the MTA-STS policy")
+	ErrStsTlsRequired   = errors.New("MTA-STS policy requires TLS")
+	ErrStsCacheSave     = errors.New("cannot save MTA-STS cache")
+)
+
+// URL of the policy of a domain, and the HTTP client to fetch it. Redirects are not followed (RFC 8461 section 3.3).
+var (
+	stsPolicyUrl   = "https://mta-sts.%s/.well-known/mta-sts.txt"
+	stsHttpClient  = &http.Client{Timeout: stsFetchTimeout, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	stsCurrentTime = time.Now
+)
+
+type StsPolicy struct {
+	Id      string    `json:"id"`
+	Mode    string    `json:"mode"`
+	Mx      []string  `json:"mx"`
+	MaxAge  int       `json:"max_age"`
+	Expires time.Time `json:"expires"`
+}
+
+// Matches reports whether host matches an mx pattern of the policy. A wildcard only matches the leftmost label.
+func (p *StsPolicy) Matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range (*p).Mx {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			label, rest, found := strings.Cut(host, ".")
+			if found && label != "" && rest == suffix {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterHosts returns the MX hosts that may be used. In enforce mode these are the hosts that match the policy.
+func (p *StsPolicy) FilterHosts(hosts []string) ([]string, error) {
+	if p == nil || (*p).Mode != StsEnforce {
+		return hosts, nil
+	}
+	matching := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if p.Matches(host) {
+			matching = append(matching, host)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrStsNoMatchingMx, strings.Join(hosts, ", "))
+	}
+	return matching, nil
+}
+
+// Apply checks hostname against the policy and returns the TLS policy for the connection.
+// In enforce mode a verified TLS connection of at least TLS 1.2 is required.
+func (p *StsPolicy) Apply(hostname string, policy TlsPolicy) (TlsPolicy, error) {
+	if p == nil || (*p).Mode != StsEnforce {
+		return policy, nil
+	}
+	if !p.Matches(hostname) {
+		return policy, fmt.Errorf("%w: %s", ErrStsHostMismatch, hostname)
+	}
+	policy.Require = true
+	if policy.MinVersion < tls.VersionTLS12 {
+		policy.MinVersion = tls.VersionTLS12
+	}
+	return policy, nil
+}
+
+// StsCache keeps the MTA-STS policies of domains in a file until they expire
+type StsCache struct {
+	path     string
+	policies map[string]StsPolicy
+}
+
+// GetStsCache loads the policy cache of the settings, or the default cache
+func GetStsCache(st *cmdflags.Settings) (*StsCache, error) {
+	path := st.MtaStsCache
+	if path == "" {
+		var err error
+		if path, err = DefaultStsCachePath(); err != nil {
+			return nil, err
+		}
+	}
+	return LoadStsCache(path)
+}
+
+// DefaultStsCachePath returns gosend/mta-sts.json in the user cache directory
+func DefaultStsCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gosend", "mta-sts.json"), nil
+}
+
+// LoadStsCache reads the policy cache at path. A missing file results in an empty cache.
+func LoadStsCache(path string) (*StsCache, error) {
+	cache := &StsCache{path: path, policies: make(map[string]StsPolicy)}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return cache, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &(*cache).policies); err != nil {
+		return nil, fmt.Errorf("invalid MTA-STS cache %s: %w", path, err)
+	}
+	if (*cache).policies == nil {
+		(*cache).policies = make(map[string]StsPolicy)
+	}
+	return cache, nil
+}
+
+// GetPolicy returns the MTA-STS policy of domain, or nil when the domain has no policy.
+// A cached policy is used until it expires, unless the policy id in DNS has changed (RFC 8461 section 5.1).
+// When the fetched policy cannot be saved in cache, it is returned together with ErrStsCacheSave.
+// When the policy cannot be fetched and no valid policy is cached, nil is returned with ErrStsFetch.
+func (c *StsCache) GetPolicy(domain string) (*StsPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	cached, ok := (*c).policies[domain]
+	valid := ok && stsCurrentTime().Before(cached.Expires)
+
+	id, err := lookupStsId(domain)
+	if err != nil {
+		if valid {
+			return &cached, nil
+		}
+		return nil, nil
+	}
+	if valid && cached.Id == id {
+		return &cached, nil
+	}
+
+	policy, err := fetchStsPolicy(domain)
+	if err != nil {
+		if valid {
+			return &cached, nil
+		}
+		return nil, err
+	}
+	(*policy).Id = id
+	(*policy).Expires = stsCurrentTime().Add(time.Duration((*policy).MaxAge) * time.Second)
+	(*c).policies[domain] = *policy
+	if err := c.save(); err != nil {
+		return policy, fmt.Errorf("%w: %w", ErrStsCacheSave, err)
+	}
+	return policy, nil
+}
+
+// getStsTlsPolicy applies the MTA-STS policy of the mail domain of the SMTP server to policy.
+// A policy that cannot be fetched and is not cached counts as no policy (RFC 8461 section 5).
+func getStsTlsPolicy(st *cmdflags.Settings, policy TlsPolicy) (TlsPolicy, error) {
+	cache, err := GetStsCache(st)
+	if err != nil {
+		return policy, err
+	}
+	sts, err := cache.GetPolicy(st.MtaStsDomain.String())
+	if err != nil {
+		log.Printf("Warning: %s", err)
+	}
+	return sts.Apply(st.SmtpHost.String(), policy)
+}
+
+func (c *StsCache) save() error {
+	now := stsCurrentTime()
+	for domain, policy := range (*c).policies {
+		if now.After(policy.Expires) {
+			delete((*c).policies, domain)
+		}
+	}
+	content, err := json.MarshalIndent((*c).policies, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir((*c).path), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile((*c).path, append(content, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write file: %s", err)
+	}
+	return nil
+}
+
+// lookupStsId returns the policy id of the _mta-sts TXT record of domain
+func lookupStsId(domain string) (string, error) {
+	records, err := net.LookupTXT("_mta-sts." + domain)
+	if err != nil {
+		return "", err
+	}
+	var ids []string
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v="+stsVersion) {
+			continue
+		}
+		fields := parseStsRecord(record)
+		if fields["v"] != stsVersion || fields["id"] == "" {
+			return "", fmt.Errorf("%w: %s", ErrStsRecordInvalid, record)
+		}
+		ids = append(ids, fields["id"])
+	}
+	if len(ids) != 1 {
+		// No record, or multiple records which must be treated as no record
+		return "", fmt.Errorf("%w: %d records for _mta-sts.%s", ErrStsRecordInvalid, len(ids), domain)
+	}
+	return ids[0], nil
+}
+
+func fetchStsPolicy(domain string) (*StsPolicy, error) {
+	resp, err := stsHttpClient.Get(fmt.Sprintf(stsPolicyUrl, domain))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStsFetch, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s: %s", ErrStsFetch, domain, resp.Status)
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || mediaType != "text/plain" {
+		return nil, fmt.Errorf("%w: %s: content type %q", ErrStsFetch, domain, resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, stsMaxPolicy+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStsFetch, err)
+	}
+	if len(body) > stsMaxPolicy {
+		return nil, fmt.Errorf("%w: %s: policy too large", ErrStsFetch, domain)
+	}
+	return parseStsPolicy(string(body))
+}
+
+func parseStsPolicy(text string) (*StsPolicy, error) {
+	policy := &StsPolicy{}
+	var version string
+	var maxAge bool
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "version":
+			version = value
+		case "mode":
+			(*policy).Mode = value
+		case "mx":
+			(*policy).Mx = append((*policy).Mx, value)
+		case "max_age":
+			age, err := strconv.Atoi(value)
+			if err != nil || age < 0 {
+				return nil, fmt.Errorf("%w: max_age %s", ErrStsPolicyInvalid, value)
+			}
+			(*policy).MaxAge, maxAge = min(age, stsMaxAge), true
+		}
+	}
+
+	var errMsgs []error
+	if version != stsVersion {
+		errMsgs = append(errMsgs, fmt.Errorf("%w: version %q", ErrStsPolicyInvalid, version))
+	}
+	if (*policy).Mode != StsEnforce && (*policy).Mode != StsTesting && (*policy).Mode != StsNone {
+		errMsgs = append(errMsgs, fmt.Errorf("%w: mode %q", ErrStsPolicyInvalid, (*policy).Mode))
+	}
+	if !maxAge {
+		errMsgs = append(errMsgs, fmt.Errorf("%w: no max_age", ErrStsPolicyInvalid))
+	}
+	if len((*policy).Mx) == 0 && (*policy).Mode != StsNone {
+		errMsgs = append(errMsgs, fmt.Errorf("%w: no mx", ErrStsPolicyInvalid))
+	}
+	if err := errors.Join(errMsgs...); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// parseStsRecord splits e.g. "v=STSv1; id=20240101T000000;" into its fields
+func parseStsRecord(text string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(text, ";") {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			fields[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,409 @@
+package secureconnection
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sternisaea/dnsservermock/src/dnsconst"
+	"github.com/Sternisaea/dnsservermock/src/dnsstorage/dnsstoragememory"
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+func Test_StsMatches(t *testing.T) {
+	policy := StsPolicy{Mode: StsEnforce, Mx: []string{"mail.domain.local", "*.mx.domain.local."}}
+	checklist := []struct {
+		host     string
+		expected bool
+	}{
+		{"mail.domain.local", true},
+		{"MAIL.domain.local.", true},
+		{"a.mx.domain.local", true},
+		{"mx.domain.local", false},
+		{"a.b.mx.domain.local", false},
+		{"other.domain.local", false},
+	}
+	for _, c := range checklist {
+		if got := policy.Matches(c.host); got != c.expected {
+			t.Errorf("%s: expected %t, got %t", c.host, c.expected, got)
+		}
+	}
+}
+
+func Test_StsPolicyParse(t *testing.T) {
+	checklist := []struct {
+		name           string
+		text           string
+		expectedPolicy *StsPolicy
+		expectedErrors *[]error
+	}{
+		{
+			name:           "enforce",
+			text:           "version: STSv1\r\nmode: enforce\r\nmx: mail.domain.local\r\nmx: *.mx.domain.local\r\nmax_age: 86400\r\n",
+			expectedPolicy: &StsPolicy{Mode: StsEnforce, Mx: []string{"mail.domain.local", "*.mx.domain.local"}, MaxAge: 86400},
+		},
+		{
+			name:           "none without mx",
+			text:           "version: STSv1\nmode: none\nmax_age: 0\n",
+			expectedPolicy: &StsPolicy{Mode: StsNone, MaxAge: 0},
+		},
+		{
+			name:           "max_age limited to one year",
+			text:           "version: STSv1\nmode: testing\nmx: mail.domain.local\nmax_age: 99999999\nextension: ignored\n",
+			expectedPolicy: &StsPolicy{Mode: StsTesting, Mx: []string{"mail.domain.local"}, MaxAge: stsMaxAge},
+		},
+		{
+			name:           "missing fields",
+			text:           "version: STSv2\nmode: strict\n",
+			expectedErrors: &[]error{ErrStsPolicyInvalid, errors.New("version \"STSv2\""), errors.New("mode \"strict\""), errors.New("no max_age"), errors.New("no mx")},
+		},
+		{
+			name:           "invalid max_age",
+			text:           "version: STSv1\nmode: enforce\nmx: mail.domain.local\nmax_age: -1\n",
+			expectedErrors: &[]error{ErrStsPolicyInvalid, errors.New("max_age -1")},
+		},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			policy, err := parseStsPolicy(c.text)
+			if cont, err := checkError(err, c.expectedErrors); !cont {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if (*policy).Mode != (*c.expectedPolicy).Mode || (*policy).MaxAge != (*c.expectedPolicy).MaxAge || !slices.Equal((*policy).Mx, (*c.expectedPolicy).Mx) {
+				t.Errorf("Expected policy %v, got %v", *c.expectedPolicy, *policy)
+			}
+		})
+	}
+}
+
+func Test_StsApply(t *testing.T) {
+	enforce := &StsPolicy{Mode: StsEnforce, Mx: []string{"*.domain.local"}}
+	testingMode := &StsPolicy{Mode: StsTesting, Mx: []string{"*.domain.local"}}
+	hosts := []string{"mx.other.local", "mail.domain.local"}
+
+	if filtered, err := enforce.FilterHosts(hosts); err != nil || !slices.Equal(filtered, []string{"mail.domain.local"}) {
+		t.Errorf("Expected enforce to keep mail.domain.local, got %v %v", filtered, err)
+	}
+	if _, err := enforce.FilterHosts([]string{"mx.other.local"}); !errors.Is(err, ErrStsNoMatchingMx) {
+		t.Errorf("Expected error %s, got %v", ErrStsNoMatchingMx, err)
+	}
+	for _, p := range []*StsPolicy{testingMode, nil} {
+		if filtered, err := p.FilterHosts(hosts); err != nil || !slices.Equal(filtered, hosts) {
+			t.Errorf("Expected all hosts, got %v %v", filtered, err)
+		}
+	}
+
+	policy, err := enforce.Apply("mail.domain.local", TlsPolicy{MinVersion: tls.VersionTLS10})
+	if err != nil || !policy.Require || policy.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected required TLS 1.2, got %v %v", policy, err)
+	}
+	if _, err := enforce.Apply("mx.other.local", TlsPolicy{}); !errors.Is(err, ErrStsHostMismatch) {
+		t.Errorf("Expected error %s, got %v", ErrStsHostMismatch, err)
+	}
+	if policy, err := testingMode.Apply("mx.other.local", TlsPolicy{}); err != nil || policy.Require {
+		t.Errorf("Expected unchanged policy in testing mode, got %v %v", policy, err)
+	}
+}
+
+func Test_StsCache(t *testing.T) {
+	dns, err := startDnsFixture(dnsstoragememory.NewMemoryStore())
+	if err != nil {
+		t.Fatalf("Cannot start DNS server: %s", err)
+	}
+	defer dns.stop()
+	defaultResolver := net.DefaultResolver
+	setDefaultResolver(dns.address)
+	defer func() { net.DefaultResolver = defaultResolver }()
+
+	server := newStsServer()
+	defer (*server).Close()
+	defer useStsServer(server)()
+	now := time.Now()
+	defer func() { stsCurrentTime = time.Now }()
+	stsCurrentTime = func() time.Time { return now }
+
+	path := filepath.Join(t.TempDir(), "gosend", "mta-sts.json")
+	cache, err := LoadStsCache(path)
+	if err != nil {
+		t.Fatalf("Cannot load cache: %s", err)
+	}
+
+	type stsCheck struct {
+		name           string
+		record         []string
+		policy         string
+		elapsed        time.Duration
+		expectedMode   string
+		expectedId     string
+		expectedFetch  int
+		expectedErrors *[]error
+	}
+	checklist := []stsCheck{
+		{
+			name:   "no record",
+			policy: "version: STSv1\nmode: enforce\nmx: mail.domain.local\nmax_age: 3600\n",
+		},
+		{
+			name:          "fetch",
+			record:        []string{"v=spf1 -all", "v=STSv1; id=1;"},
+			policy:        "version: STSv1\nmode: enforce\nmx: mail.domain.local\nmax_age: 3600\n",
+			expectedMode:  StsEnforce,
+			expectedId:    "1",
+			expectedFetch: 1,
+		},
+		{
+			name:          "cached",
+			record:        []string{"v=STSv1; id=1;"},
+			policy:        "version: STSv1\nmode: testing\nmx: mail.domain.local\nmax_age: 3600\n",
+			expectedMode:  StsEnforce,
+			expectedId:    "1",
+			expectedFetch: 1,
+		},
+		{
+			name:          "changed id",
+			record:        []string{"v=STSv1; id=2;"},
+			policy:        "version: STSv1\nmode: testing\nmx: mail.domain.local\nmax_age: 3600\n",
+			expectedMode:  StsTesting,
+			expectedId:    "2",
+			expectedFetch: 2,
+		},
+		{
+			name:          "failed fetch uses cache",
+			record:        []string{"v=STSv1; id=3;"},
+			expectedMode:  StsTesting,
+			expectedId:    "2",
+			expectedFetch: 3,
+		},
+		{
+			name:          "lookup failure uses cache",
+			elapsed:       30 * time.Minute,
+			expectedMode:  StsTesting,
+			expectedId:    "2",
+			expectedFetch: 3,
+		},
+		{
+			name:           "failed fetch after expiry",
+			record:         []string{"v=STSv1; id=3;"},
+			elapsed:        2 * time.Hour,
+			expectedFetch:  4,
+			expectedErrors: &[]error{ErrStsFetch, errors.New("404")},
+		},
+		{
+			name:          "multiple records",
+			record:        []string{"v=STSv1; id=4;", "v=STSv1; id=5;"},
+			policy:        "version: STSv1\nmode: enforce\nmx: mail.domain.local\nmax_age: 3600\n",
+			elapsed:       2 * time.Hour,
+			expectedFetch: 4,
+		},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			dns.set("_mta-sts.domain.local", dnsconst.Type_TXT, c.record...)
+			server.set(c.policy)
+			stsCurrentTime = func() time.Time { return now.Add(c.elapsed) }
+
+			policy, err := cache.GetPolicy("domain.local")
+			if cont, err := checkError(err, c.expectedErrors); !cont && err != nil {
+				t.Fatal(err)
+			}
+			if server.count() != c.expectedFetch {
+				t.Errorf("Expected %d fetches, got %d", c.expectedFetch, server.count())
+			}
+			if c.expectedMode == "" {
+				if policy != nil {
+					t.Errorf("Expected no policy, got %v", *policy)
+				}
+				return
+			}
+			if policy == nil {
+				t.Fatalf("Expected policy with mode %s, got no policy", c.expectedMode)
+			}
+			if (*policy).Mode != c.expectedMode || (*policy).Id != c.expectedId {
+				t.Errorf("Expected mode %s and id %s, got %v", c.expectedMode, c.expectedId, *policy)
+			}
+		})
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Cache file not written: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected cache file mode 0600, got %s", info.Mode().Perm())
+	}
+}
+
+func Test_StsCacheUnwritable(t *testing.T) {
+	dns, err := startDnsFixture(dnsstoragememory.NewMemoryStore())
+	if err != nil {
+		t.Fatalf("Cannot start DNS server: %s", err)
+	}
+	defer dns.stop()
+	defaultResolver := net.DefaultResolver
+	setDefaultResolver(dns.address)
+	defer func() { net.DefaultResolver = defaultResolver }()
+
+	server := newStsServer()
+	defer (*server).Close()
+	defer useStsServer(server)()
+	dns.set("_mta-sts.domain.local", dnsconst.Type_TXT, "v=STSv1; id=1;")
+	server.set("version: STSv1\nmode: enforce\nmx: mail.domain.local\nmax_age: 3600\n")
+
+	// The directory of the cache is replaced by a regular file after loading, so the cache cannot be saved
+	dir := filepath.Join(t.TempDir(), "gosend")
+	cache, err := LoadStsCache(filepath.Join(dir, "mta-sts.json"))
+	if err != nil {
+		t.Fatalf("Cannot load cache: %s", err)
+	}
+	if err := os.WriteFile(dir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := cache.GetPolicy("domain.local")
+	if !errors.Is(err, ErrStsCacheSave) {
+		t.Errorf("Expected error %s, got %v", ErrStsCacheSave, err)
+	}
+	if policy == nil || (*policy).Mode != StsEnforce {
+		t.Fatalf("Expected fetched enforce policy, got %v", policy)
+	}
+	if _, err := policy.Apply("smtp.other.local", TlsPolicy{}); !errors.Is(err, ErrStsHostMismatch) {
+		t.Errorf("Expected error %s, got %v", ErrStsHostMismatch, err)
+	}
+}
+
+func Test_StsCacheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mta-sts.json")
+	content := fmt.Sprintf(`{"domain.local": {"id": "1", "mode": "enforce", "mx": ["mail.domain.local"], "max_age": 3600, "expires": %q}}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Cannot write cache: %s", err)
+	}
+	cache, err := LoadStsCache(path)
+	if err != nil {
+		t.Fatalf("Cannot load cache: %s", err)
+	}
+	if policy, ok := (*cache).policies["domain.local"]; !ok || policy.Mode != StsEnforce || !slices.Equal(policy.Mx, []string{"mail.domain.local"}) {
+		t.Errorf("Expected cached enforce policy, got %v", (*cache).policies)
+	}
+
+	if err := os.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatalf("Cannot write cache: %s", err)
+	}
+	if _, err := LoadStsCache(path); err == nil || !strings.Contains(err.Error(), "invalid MTA-STS cache") {
+		t.Errorf("Expected invalid cache error, got %v", err)
+	}
+}
+
+func Test_StsRelay(t *testing.T) {
+	dns, err := startDnsFixture(dnsstoragememory.NewMemoryStore())
+	if err != nil {
+		t.Fatalf("Cannot start DNS server: %s", err)
+	}
+	defer dns.stop()
+	defaultResolver := net.DefaultResolver
+	setDefaultResolver(dns.address)
+	defer func() { net.DefaultResolver = defaultResolver }()
+
+	server := newStsServer()
+	defer (*server).Close()
+	defer useStsServer(server)()
+	dns.set("_mta-sts.domain.local", dnsconst.Type_TXT, "v=STSv1; id=1;")
+	server.set("version: STSv1\nmode: enforce\nmx: mail.domain.local\nmax_age: 3600\n")
+
+	// The policy of other.local cannot be fetched
+	dns.set("_mta-sts.other.local", dnsconst.Type_TXT, "v=STSv1; id=1;")
+
+	type relayCheck struct {
+		name            string
+		domain          types.DomainName
+		host            string
+		security        types.Security
+		expectedRequire bool
+		expectedErrors  *[]error
+	}
+	checklist := []relayCheck{
+		{name: "matching host", domain: "domain.local", host: "mail.domain.local", security: types.StartTlsSec, expectedRequire: true},
+		{name: "other host", domain: "domain.local", host: "smtp.other.local", security: types.StartTlsSec, expectedErrors: &[]error{ErrStsHostMismatch}},
+		{name: "no security", domain: "domain.local", host: "mail.domain.local", security: types.NoSecurity, expectedErrors: &[]error{ErrStsTlsRequired}},
+		{name: "failed fetch without cache", domain: "other.local", host: "smtp.other.local", security: types.StartTlsSec},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			st := &cmdflags.Settings{SmtpHost: types.DomainName(c.host), SmtpPort: 587, Security: c.security, MtaStsDomain: c.domain, MtaStsCache: filepath.Join(t.TempDir(), "mta-sts.json")}
+			sc, err := GetSecureConnection(st)
+			if cont, err := checkError(err, c.expectedErrors); !cont {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			starttls, ok := sc.(*ConnectStarttls)
+			if !ok {
+				t.Fatalf("Expected STARTTLS connection, got %v", sc)
+			}
+			if c.expectedRequire && (!(*starttls).policy.Require || (*starttls).policy.MinVersion != tls.VersionTLS12) {
+				t.Errorf("Expected required TLS 1.2, got %v", (*starttls).policy)
+			}
+			if !c.expectedRequire && (*starttls).policy.Require {
+				t.Errorf("Expected no MTA-STS policy, got %v", (*starttls).policy)
+			}
+		})
+	}
+}
+
+// stsServer is an HTTPS stand-in for the mta-sts host of a domain. It serves the policy that is set, or 404 without a policy.
+type stsServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	policy  string
+	fetches int
+}
+
+func newStsServer() *stsServer {
+	server := &stsServer{}
+	(*server).Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		(*server).mutex.Lock()
+		defer (*server).mutex.Unlock()
+		(*server).fetches++
+		if r.URL.Path != "/domain.local/.well-known/mta-sts.txt" || (*server).policy == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, (*server).policy)
+	}))
+	return server
+}
+
+func (s *stsServer) set(policy string) {
+	(*s).mutex.Lock()
+	defer (*s).mutex.Unlock()
+	(*s).policy = policy
+}
+
+func (s *stsServer) count() int {
+	(*s).mutex.Lock()
+	defer (*s).mutex.Unlock()
+	return (*s).fetches
+}
+
+// useStsServer directs the policy fetches to server and returns a function to restore the defaults
+func useStsServer(server *stsServer) func() {
+	url, client := stsPolicyUrl, stsHttpClient
+	stsPolicyUrl = (*server).URL + "/%s/.well-known/mta-sts.txt"
+	stsHttpClient = (*server).Client()
+	return func() { stsPolicyUrl, stsHttpClient = url, client }
+}
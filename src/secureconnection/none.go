@@ -1,9 +1,8 @@
 package secureconnection
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"net"
 	"net/smtp"
 
 	"github.com/Sternisaea/gosend/src/types"
@@ -12,12 +11,36 @@ import (
 type ConnectNone struct {
 	hostname string
 	port     int
+	proxy    *Proxy
+	timeouts Timeouts
+	source   Source
+	ehloName string
 }
 
 func NewConnectNone(hostname string, port int) *ConnectNone {
 	return &ConnectNone{hostname: hostname, port: port}
 }
 
+// SetProxy connects through p, or directly when p is nil
+func (c *ConnectNone) SetProxy(p *Proxy) {
+	(*c).proxy = p
+}
+
+// SetTimeouts limits connecting and every command of the session
+func (c *ConnectNone) SetTimeouts(t Timeouts) {
+	(*c).timeouts = t
+}
+
+// SetSource sets the local address and IP version of the connection
+func (c *ConnectNone) SetSource(s Source) {
+	(*c).source = s
+}
+
+// SetEhloName sets the name sent with EHLO, or the default name when empty
+func (c *ConnectNone) SetEhloName(name string) {
+	(*c).ehloName = name
+}
+
 func (c *ConnectNone) Check() error {
 	var errMsgs []error
 	if (*c).hostname == "" {
@@ -26,6 +49,7 @@ func (c *ConnectNone) Check() error {
 	if (*c).port == 0 {
 		errMsgs = append(errMsgs, ErrNoPort)
 	}
+	errMsgs = append(errMsgs, (*c).source.Check())
 	return errors.Join(errMsgs...)
 }
 
@@ -37,20 +61,20 @@ func (c *ConnectNone) GetHostName() string {
 	return (*c).hostname
 }
 
-func (c *ConnectNone) ClientConnect() (*smtp.Client, func() error, string, error) {
+func (c *ConnectNone) ClientConnect(ctx context.Context) (*smtp.Client, func() error, string, error) {
 	if err := c.Check(); err != nil {
 		return nil, nil, "", err
 	}
 
 	// Not using smtp.Dial, because Source TCP Port need to be ascertained
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", (*c).hostname, (*c).port))
+	conn, err := dial(ctx, (*c).proxy, (*c).timeouts, (*c).source, (*c).hostname, (*c).port)
 	if err != nil {
 		return nil, nil, "", err
 	}
-	client, err := smtp.NewClient(conn, (*c).hostname)
+	client, err := newClient(ctx, conn, (*c).hostname, (*c).ehloName)
 	if err != nil {
 		return nil, nil, "", err
 	}
 
-	return client, client.Close, conn.LocalAddr().String(), nil
+	return client, conn.closeSession(client), conn.LocalAddr().String(), nil
 }
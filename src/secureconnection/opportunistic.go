@@ -0,0 +1,146 @@
+package secureconnection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+// ConnectOpportunistic upgrades the connection with STARTTLS when the server offers it, and continues in plaintext otherwise (RFC 7435).
+// The server certificate is verified, unless SetSkipVerify is used. TLS is required when the policy asks for DANE, TLS pins or a Root CA.
+type ConnectOpportunistic struct {
+	hostname   string
+	port       int
+	policy     TlsPolicy
+	skipVerify bool
+	warn       func(format string, v ...any)
+	proxy      *Proxy
+	timeouts   Timeouts
+	source     Source
+	ehloName   string
+}
+
+func NewConnectOpportunistic(hostname string, port int, policy TlsPolicy) *ConnectOpportunistic {
+	return &ConnectOpportunistic{hostname: hostname, port: port, policy: policy}
+}
+
+// SetSkipVerify accepts any server certificate when the policy does not ask to verify it, e.g. for delivery to MX hosts.
+// A failed TLS handshake then continues without TLS, while it ends the session when the certificate is verified.
+func (c *ConnectOpportunistic) SetSkipVerify(skip bool) {
+	(*c).skipVerify = skip
+}
+
+// SetWarning sets the function that reports a session continuing in plaintext, e.g. log.Printf
+func (c *ConnectOpportunistic) SetWarning(warn func(format string, v ...any)) {
+	(*c).warn = warn
+}
+
+// SetProxy connects through p, or directly when p is nil
+func (c *ConnectOpportunistic) SetProxy(p *Proxy) {
+	(*c).proxy = p
+}
+
+// SetTimeouts limits connecting and every command of the session
+func (c *ConnectOpportunistic) SetTimeouts(t Timeouts) {
+	(*c).timeouts = t
+}
+
+// SetSource sets the local address and IP version of the connection
+func (c *ConnectOpportunistic) SetSource(s Source) {
+	(*c).source = s
+}
+
+// SetEhloName sets the name sent with EHLO, or the default name when empty
+func (c *ConnectOpportunistic) SetEhloName(name string) {
+	(*c).ehloName = name
+}
+
+func (c *ConnectOpportunistic) Check() error {
+	var errMsgs []error
+	if (*c).hostname == "" {
+		errMsgs = append(errMsgs, ErrNoHostname)
+	}
+	if (*c).port == 0 {
+		errMsgs = append(errMsgs, ErrNoPort)
+	}
+	errMsgs = append(errMsgs, (*c).source.Check())
+	errMsgs = append(errMsgs, (*c).policy.Check())
+	return errors.Join(errMsgs...)
+}
+
+func (c *ConnectOpportunistic) GetType() types.Security {
+	return types.OpportunisticSec
+}
+
+func (c *ConnectOpportunistic) GetHostName() string {
+	return (*c).hostname
+}
+
+func (c *ConnectOpportunistic) ClientConnect(ctx context.Context) (*smtp.Client, func() error, string, error) {
+	if err := c.Check(); err != nil {
+		return nil, nil, "", err
+	}
+
+	client, conn, err := (*c).dial(ctx)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if ok, _ := client.Extension(StartTls); !ok {
+		if (*c).policy.authenticates() {
+			client.Close()
+			return nil, nil, "", inPhase(types.StartTlsPhase, fmt.Errorf("%w : %s", ErrStarttlsNotSupported, (*c).hostname))
+		}
+		c.warning("%s does not offer STARTTLS, continuing without TLS", (*c).hostname)
+		return client, conn.closeSession(client), conn.LocalAddr().String(), nil
+	}
+
+	config, err := (*c).policy.getConfig(ctx, (*c).hostname, (*c).port)
+	if err != nil {
+		client.Close()
+		return nil, nil, "", err
+	}
+	verify := !(*c).skipVerify || (*c).policy.authenticates()
+	if !verify {
+		// Unauthenticated encryption still protects against passive eavesdropping
+		(*config).InsecureSkipVerify = true
+	}
+	if err = client.StartTLS(config); err == nil {
+		return client, conn.closeSession(client), conn.LocalAddr().String(), nil
+	}
+	client.Close()
+	if verify {
+		// Continuing without TLS would hand the session to whoever presented the certificate
+		return nil, nil, "", inPhase(types.StartTlsPhase, err)
+	}
+
+	// A failed TLS handshake leaves the session unusable, so reconnect and continue without TLS
+	c.warning("TLS handshake with %s failed (%s), continuing without TLS", (*c).hostname, err)
+	client, conn, err = (*c).dial(ctx)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return client, conn.closeSession(client), conn.LocalAddr().String(), nil
+}
+
+func (c *ConnectOpportunistic) warning(format string, v ...any) {
+	if (*c).warn != nil {
+		(*c).warn("Warning: "+format, v...)
+	}
+}
+
+func (c *ConnectOpportunistic) dial(ctx context.Context) (*smtp.Client, *sessionConn, error) {
+	// Not using smtp.Dial, because Source TCP Port need to be ascertained
+	conn, err := dial(ctx, (*c).proxy, (*c).timeouts, (*c).source, (*c).hostname, (*c).port)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := newClient(ctx, conn, (*c).hostname, (*c).ehloName)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return client, conn, nil
+}
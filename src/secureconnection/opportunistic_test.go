@@ -0,0 +1,132 @@
+package secureconnection
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Sternisaea/gosend/src/certificates"
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+	"github.com/Sternisaea/smtpservermock/src/smtpservermock"
+)
+
+var (
+	smtpOpportunisticPort = types.TCPPort(40976)
+	smtpPlaintextPort     = types.TCPPort(40977)
+)
+
+func Test_Opportunistic(t *testing.T) {
+	cert, key, err := certificates.CreateCertificate("Domain Local", "localhost")
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	defer os.Remove(key)
+	defer os.Remove(cert)
+
+	mockStarttls, err := smtpservermock.NewSmtpServer(smtpservermock.StartTlsSec, "Mock SMTP Server with STARTTLS", getAddress("localhost", smtpOpportunisticPort), cert, key)
+	if err != nil {
+		t.Fatalf("Cannot initialise SMTP server with STARTTLS: %s", err)
+	}
+	if err := mockStarttls.ListenAndServe(); err != nil {
+		t.Fatalf("Cannot start SMTP server with STARTTLS: %s", err)
+	}
+	defer mockStarttls.Shutdown()
+
+	mockPlaintext, err := smtpservermock.NewSmtpServer(smtpservermock.NoSecurity, "Mock SMTP Server without security", getAddress("localhost", smtpPlaintextPort), "", "")
+	if err != nil {
+		t.Fatalf("Cannot initialise SMTP server without security: %s", err)
+	}
+	if err := mockPlaintext.ListenAndServe(); err != nil {
+		t.Fatalf("Cannot start SMTP server without security: %s", err)
+	}
+	defer mockPlaintext.Shutdown()
+
+	type opportunisticCheck struct {
+		name            string
+		settings        cmdflags.Settings
+		skipVerify      bool
+		expectedTls     bool
+		expectedWarning string
+		expectedErrors  *[]error
+	}
+	checklist := []opportunisticCheck{
+		{
+			name:        "starttls offered without verification",
+			settings:    cmdflags.Settings{SmtpPort: smtpOpportunisticPort},
+			skipVerify:  true,
+			expectedTls: true,
+		},
+		{
+			name:           "starttls offered with untrusted certificate",
+			settings:       cmdflags.Settings{SmtpPort: smtpOpportunisticPort},
+			expectedErrors: &[]error{errors.New("certificate signed by unknown authority")},
+		},
+		{
+			name:        "starttls offered with root ca",
+			settings:    cmdflags.Settings{SmtpPort: smtpOpportunisticPort, RootCA: types.FilePath(cert)},
+			expectedTls: true,
+		},
+		{
+			name:            "starttls not offered",
+			settings:        cmdflags.Settings{SmtpPort: smtpPlaintextPort},
+			expectedWarning: "Warning: localhost does not offer STARTTLS, continuing without TLS",
+		},
+		{
+			name:            "failed handshake without verification",
+			settings:        cmdflags.Settings{SmtpPort: smtpOpportunisticPort, TlsMaxVersion: tls.VersionTLS11},
+			skipVerify:      true,
+			expectedWarning: "Warning: TLS handshake with localhost failed",
+		},
+		{
+			name:           "failed handshake",
+			settings:       cmdflags.Settings{SmtpPort: smtpOpportunisticPort, TlsMaxVersion: tls.VersionTLS11},
+			expectedErrors: &[]error{errors.New("protocol version not supported")},
+		},
+		{
+			name:           "starttls not offered with root ca",
+			settings:       cmdflags.Settings{SmtpPort: smtpPlaintextPort, RootCA: types.FilePath(cert)},
+			expectedErrors: &[]error{ErrStarttlsNotSupported},
+		},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			st := c.settings
+			st.Security, st.SmtpHost = types.OpportunisticSec, "localhost"
+			sc, err := GetSecureConnection(&st)
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if sc.GetType() != types.OpportunisticSec {
+				t.Errorf("Expected SecurityType %s, got %s", types.OpportunisticSec, sc.GetType())
+			}
+			var warnings []string
+			sc.(*ConnectOpportunistic).SetSkipVerify(c.skipVerify)
+			sc.(*ConnectOpportunistic).SetWarning(func(format string, v ...any) {
+				warnings = append(warnings, fmt.Sprintf(format, v...))
+			})
+
+			client, close, _, err := sc.ClientConnect(context.Background())
+			if cont, err := checkError(err, c.expectedErrors); !cont {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			defer close()
+			if _, tls := client.TLSConnectionState(); tls != c.expectedTls {
+				t.Errorf("Expected TLS %t, got %t", c.expectedTls, tls)
+			}
+			if c.expectedWarning == "" && len(warnings) > 0 {
+				t.Errorf("Expected no warning, got %v", warnings)
+			}
+			if c.expectedWarning != "" && (len(warnings) != 1 || !strings.HasPrefix(warnings[0], c.expectedWarning)) {
+				t.Errorf("Expected warning %q, got %v", c.expectedWarning, warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package secureconnection
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+var (
+	ErrPinMismatch = errors.New("server certificate does not match any TLS pin")
+	ErrNoTls       = errors.New("connection is not secured by TLS")
+)
+
+// CertificateProber is implemented by the secure connection types that can show the certificate chain of the server
+type CertificateProber interface {
+	ProbeCertificates(ctx context.Context) ([]*x509.Certificate, error)
+}
+
+func SpkiFingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(hash[:])
+}
+
+func CertificateFingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(hash[:])
+}
+
+// verifyPins is used as VerifyConnection callback. It is called after the regular certificate verification
+// and requires one of the certificates in a verified chain to match a pin. The presented chain is not used,
+// because a server can append any certificate to it. Without verification by certificate authorities, e.g. with DANE,
+// only the server certificate is matched.
+func verifyPins(pins types.TlsPins) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return ErrPinMismatch
+		}
+		chains := state.VerifiedChains
+		if len(chains) == 0 {
+			chains = [][]*x509.Certificate{state.PeerCertificates[:1]}
+		}
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if matchesPin(pins, cert) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("%w: server presented %s:%s", ErrPinMismatch, types.PinSpki, SpkiFingerprint(state.PeerCertificates[0]))
+	}
+}
+
+func matchesPin(pins types.TlsPins, cert *x509.Certificate) bool {
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	full := sha256.Sum256(cert.Raw)
+	for _, pin := range pins {
+		if (pin.Kind == types.PinSpki && pin.Hash == spki) || (pin.Kind == types.PinCertificate && pin.Hash == full) {
+			return true
+		}
+	}
+	return false
+}
+
+// getProbeConfig returns a configuration that accepts any server certificate, so the chain can be shown even when it cannot be verified
+func (p *TlsPolicy) getProbeConfig(ctx context.Context, hostname string) (*tls.Config, error) {
+	probe := *p
+	probe.Pins = nil
+	probe.Verify = types.PkixVerify
+	config, err := probe.getConfig(ctx, hostname, 0)
+	if err != nil {
+		return nil, err
+	}
+	(*config).InsecureSkipVerify = true
+	return config, nil
+}
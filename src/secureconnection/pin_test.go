@@ -0,0 +1,91 @@
+package secureconnection
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/Sternisaea/gosend/src/certificates"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+func Test_VerifyPinsAppendedCertificate(t *testing.T) {
+	caCert, caKey, err := certificates.CreateCA("Trusted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caCert)
+	defer os.Remove(caKey)
+	leafCert, leafKey, err := certificates.CreateServerCertificate("Attacker", "mail.domain.local", caCert, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(leafCert)
+	defer os.Remove(leafKey)
+	pinnedCert, pinnedKey, err := certificates.CreateCertificate("Victim", "mail.domain.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(pinnedCert)
+	defer os.Remove(pinnedKey)
+
+	leaf, err := tls.LoadX509KeyPair(leafCert, leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned, err := tls.LoadX509KeyPair(pinnedCert, pinnedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spkiPin, caPin types.TlsPins
+	if err := spkiPin.Set(types.PinSpki + ":" + SpkiFingerprint(pinned.Leaf)); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.LoadX509KeyPair(caCert, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caPin.Set(types.PinSpki + ":" + SpkiFingerprint(ca.Leaf)); err != nil {
+		t.Fatal(err)
+	}
+
+	type pinCheck struct {
+		name           string
+		chain          [][]byte
+		pins           types.TlsPins
+		expectedErrors []error
+	}
+	checklist := []pinCheck{
+		// The server has a valid certificate and appends the public certificate that is pinned
+		{name: "pinned certificate appended", chain: [][]byte{leaf.Certificate[0], pinned.Certificate[0]}, pins: spkiPin, expectedErrors: []error{ErrPinMismatch}},
+		{name: "pinned certificate authority", chain: [][]byte{leaf.Certificate[0]}, pins: caPin},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			config, err := (&TlsPolicy{RootCaPath: caCert, Pins: c.pins}).getConfig(context.Background(), "mail.domain.local", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			server := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{{Certificate: c.chain, PrivateKey: leaf.PrivateKey}}})
+			go func() {
+				server.Handshake()
+				serverConn.Close()
+			}()
+
+			err = tls.Client(clientConn, config).Handshake()
+			if len(c.expectedErrors) == 0 && err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			for _, exp := range c.expectedErrors {
+				if !errors.Is(err, exp) {
+					t.Errorf("Expected error %s, got %v", exp, err)
+				}
+			}
+		})
+	}
+}
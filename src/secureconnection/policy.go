@@ -0,0 +1,120 @@
+package secureconnection
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+var (
+	ErrTlsVersionRange       = errors.New("minimum TLS version is higher than maximum TLS version")
+	ErrTlsCiphersNotForTls13 = errors.New("TLS cipher suites cannot be configured for TLS 1.3")
+)
+
+// TlsPolicy holds the TLS client settings shared by the secure connection types
+type TlsPolicy struct {
+	RootCaPath string
+	ClientCert string
+	ClientKey  string
+	MinVersion uint16
+	MaxVersion uint16
+	Ciphers    []uint16
+	ServerName string // Name to verify the server certificate against, when different from the hostname
+	Pins       types.TlsPins
+	Verify     types.TlsVerify
+	Require    bool // A verified TLS connection is required, also when TLS is optional
+}
+
+func GetTlsPolicy(st *cmdflags.Settings) TlsPolicy {
+	return TlsPolicy{
+		RootCaPath: st.RootCA.String(),
+		ClientCert: st.ClientCert.String(),
+		ClientKey:  st.ClientKey.String(),
+		MinVersion: uint16(st.TlsMinVersion),
+		MaxVersion: uint16(st.TlsMaxVersion),
+		Ciphers:    st.TlsCiphers,
+		ServerName: st.TlsServerName.String(),
+		Pins:       st.TlsPins,
+		Verify:     st.TlsVerify,
+	}
+}
+
+func (p *TlsPolicy) Check() error {
+	var errMsgs []error
+	if (*p).RootCaPath != "" {
+		errMsgs = append(errMsgs, checkPath((*p).RootCaPath))
+	}
+	errMsgs = append(errMsgs, checkClientCertificate((*p).ClientCert, (*p).ClientKey))
+	if (*p).MinVersion != 0 && (*p).MaxVersion != 0 && (*p).MinVersion > (*p).MaxVersion {
+		errMsgs = append(errMsgs, fmt.Errorf("%w: %s > %s", ErrTlsVersionRange, tls.VersionName((*p).MinVersion), tls.VersionName((*p).MaxVersion)))
+	}
+	if len((*p).Ciphers) > 0 && (*p).MinVersion == tls.VersionTLS13 {
+		// Go does not allow to configure the TLS 1.3 cipher suites
+		errMsgs = append(errMsgs, ErrTlsCiphersNotForTls13)
+	}
+	return errors.Join(errMsgs...)
+}
+
+// authenticates reports whether the policy asks to verify the server certificate when TLS is optional
+func (p *TlsPolicy) authenticates() bool {
+	return (*p).Require || (*p).Verify == types.DaneVerify || len((*p).Pins) > 0 || (*p).RootCaPath != ""
+}
+
+// getConfig returns the TLS client configuration for a connection to hostname and port. The lookup of TLSA records ends when ctx is done.
+func (p *TlsPolicy) getConfig(ctx context.Context, hostname string, port int) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:   hostname,
+		MinVersion:   (*p).MinVersion,
+		MaxVersion:   (*p).MaxVersion,
+		CipherSuites: (*p).Ciphers,
+	}
+	if (*p).MinVersion == 0 && (*p).MaxVersion != 0 && (*p).MaxVersion < tls.VersionTLS12 {
+		// The default minimum of the client is TLS 1.2, which would rule out any version
+		(*config).MinVersion = tls.VersionTLS10
+	}
+	if (*p).ServerName != "" {
+		(*config).ServerName = (*p).ServerName
+	}
+	var verifiers []func(tls.ConnectionState) error
+	if (*p).Verify == types.DaneVerify {
+		records, err := getDaneRecords(ctx, hostname, port)
+		if err != nil {
+			return nil, err
+		}
+		// The TLSA records replace the verification by certificate authorities
+		(*config).InsecureSkipVerify = true
+		verifiers = append(verifiers, verifyDane(records, (*config).ServerName))
+	}
+	if len((*p).Pins) > 0 {
+		verifiers = append(verifiers, verifyPins((*p).Pins))
+	}
+	if len(verifiers) > 0 {
+		(*config).VerifyConnection = func(state tls.ConnectionState) error {
+			for _, verify := range verifiers {
+				if err := verify(state); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	if (*p).RootCaPath != "" {
+		var err error
+		(*config).RootCAs, err = getPemCertificate((*p).RootCaPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if (*p).ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair((*p).ClientCert, (*p).ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrClientCertificate, err)
+		}
+		(*config).Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,185 @@
+package secureconnection
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+	"golang.org/x/net/proxy"
+)
+
+var ErrProxy = errors.New("proxy connection failed")
+
+// Default ports of the proxy protocols
+const (
+	socks5Port = "1080"
+	httpPort   = "80"
+)
+
+// Proxy connects to the SMTP server through a SOCKS5 or HTTP CONNECT proxy. The TLS handshake is done through the tunnel.
+type Proxy struct {
+	scheme   string
+	address  string
+	user     string
+	password string
+}
+
+// GetProxy returns the proxy of the settings, or nil without proxy
+func GetProxy(st *cmdflags.Settings) (*Proxy, error) {
+	if st.Proxy == "" {
+		return nil, nil
+	}
+	return NewProxy(st.Proxy.String())
+}
+
+func NewProxy(proxyUrl string) (*Proxy, error) {
+	var pu types.ProxyUrl
+	if err := pu.Set(proxyUrl); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(proxyUrl)
+	port := u.Port()
+	if port == "" {
+		port = socks5Port
+		if u.Scheme == types.HttpProxy {
+			port = httpPort
+		}
+	}
+	p := &Proxy{scheme: u.Scheme, address: net.JoinHostPort(u.Hostname(), port)}
+	if u.User != nil {
+		(*p).user = u.User.Username()
+		(*p).password, _ = u.User.Password()
+	}
+	return p, nil
+}
+
+// String returns the proxy URL without password
+func (p *Proxy) String() string {
+	u := url.URL{Scheme: (*p).scheme, Host: (*p).address}
+	if (*p).user != "" {
+		u.User = url.User((*p).user)
+	}
+	return u.String()
+}
+
+// dial connects to hostname and port from the source, through the proxy when set. Dialing is limited by the connect timeout.
+// The reads and writes of the connection are limited by the command timeout and by ctx.
+func dial(ctx context.Context, p *Proxy, timeouts Timeouts, source Source, hostname string, port int) (*sessionConn, error) {
+	dialCtx, cancel := connectContext(ctx, timeouts)
+	defer cancel()
+
+	address := net.JoinHostPort(hostname, strconv.Itoa(port))
+	var conn net.Conn
+	var err error
+	if p == nil {
+		if conn, err = source.dialer().DialContext(dialCtx, source.network(), address); err != nil {
+			return nil, inPhase(types.ConnectPhase, err)
+		}
+		return newSessionConn(ctx, conn, timeouts.Command), nil
+	}
+
+	switch (*p).scheme {
+	case types.Socks5Proxy:
+		conn, err = p.dialSocks5(dialCtx, source, hostname, port)
+	case types.Socks5hProxy:
+		conn, err = p.dialSocks5h(dialCtx, source, address)
+	case types.HttpProxy:
+		conn, err = p.dialHttp(dialCtx, source, address)
+	default:
+		err = fmt.Errorf("%w: scheme '%s'", types.ErrProxyInvalid, (*p).scheme)
+	}
+	if err != nil {
+		return nil, inPhase(types.ConnectPhase, fmt.Errorf("%w: %s: %w", ErrProxy, p, err))
+	}
+	return newSessionConn(ctx, conn, timeouts.Command), nil
+}
+
+// dialSocks5 resolves hostname locally and asks the proxy to connect to its addresses of the IP family in turn
+func (p *Proxy) dialSocks5(ctx context.Context, source Source, hostname string, port int) (net.Conn, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	err = fmt.Errorf("%w: %s", ErrNoFamilyAddress, hostname)
+	for _, ip := range source.filter(ips) {
+		var conn net.Conn
+		if conn, err = p.dialSocks5h(ctx, source, net.JoinHostPort(ip.IP.String(), strconv.Itoa(port))); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dialSocks5h asks the proxy to connect to address, which may contain a hostname that the proxy resolves
+func (p *Proxy) dialSocks5h(ctx context.Context, source Source, address string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if (*p).user != "" {
+		auth = &proxy.Auth{User: (*p).user, Password: (*p).password}
+	}
+	dialer, err := proxy.SOCKS5(source.network(), (*p).address, auth, source.dialer())
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+}
+
+// dialHttp opens a tunnel to address with the CONNECT method
+func (p *Proxy) dialHttp(ctx context.Context, source Source, address string) (net.Conn, error) {
+	conn, err := source.dialer().DialContext(ctx, source.network(), (*p).address)
+	if err != nil {
+		return nil, err
+	}
+	// The CONNECT request is part of dialing
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: address}, Host: address, Header: make(http.Header)}
+	if (*p).user != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte((*p).user + ":" + (*p).password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", address, resp.Status)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	// The SMTP greeting may already be buffered with the response
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return (*c).reader.Read(b)
+}
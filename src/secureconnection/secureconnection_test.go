@@ -1,13 +1,19 @@
 package secureconnection
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"net"
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,6 +24,7 @@ import (
 	"github.com/Sternisaea/gosend/src/cmdflags"
 	"github.com/Sternisaea/gosend/src/types"
 	"github.com/Sternisaea/smtpservermock/src/smtpservermock"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 var (
@@ -30,6 +37,9 @@ var (
 	smtpTlsPort        = types.TCPPort(40973)
 
 	ErrX509UnknownAuthority = errors.New("x509: certificate signed by unknown authority")
+	ErrX509WrongHost        = errors.New("x509: certificate is valid for mail.domain.local, not localhost")
+	ErrProtocolVersion      = errors.New("tls: protocol version not supported")
+	ErrHandshakeFailure     = errors.New("tls: handshake failure")
 )
 
 type check struct {
@@ -60,6 +70,10 @@ func Test_GetSecureConnection(t *testing.T) {
 	}
 	defer os.Remove(validKey)
 	defer os.Remove(validCert)
+	validCertificate, err := readCertificate(validCert)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	mockSmtpNoSecurity, err := smtpservermock.NewSmtpServer(
 		smtpservermock.NoSecurity,
@@ -112,13 +126,54 @@ func Test_GetSecureConnection(t *testing.T) {
 	addCheck(t, &checklist, NoSecurity+" no port", &cmdflags.Settings{Security: types.NoSecurity, SmtpHost: "mail.domain.local", SmtpPort: 0}, &ConnectNone{hostname: "mail.domain.local"}, nil, types.NoSecurity, "mail.domain.local", &[]error{ErrNoPort}, &[]error{ErrNoPort})
 
 	addCheck(t, &checklist, types.StartTlsSec.String()+" regular", &cmdflags.Settings{Security: types.StartTlsSec, SmtpHost: "mail.domain.local", SmtpPort: smtpStartTlsPort}, &ConnectStarttls{hostname: "mail.domain.local", port: int(smtpStartTlsPort)}, nil, types.StartTlsSec, "mail.domain.local", nil, &[]error{ErrX509UnknownAuthority})
-	addCheck(t, &checklist, types.StartTlsSec.String()+" certificate", &cmdflags.Settings{Security: types.StartTlsSec, SmtpHost: "mail.domain.local", SmtpPort: smtpStartTlsPort, RootCA: types.FilePath(validCert)}, &ConnectStarttls{hostname: "mail.domain.local", port: int(smtpStartTlsPort), rootCaPath: validCert}, nil, types.StartTlsSec, "mail.domain.local", nil, nil)
+	addCheck(t, &checklist, types.StartTlsSec.String()+" certificate", &cmdflags.Settings{Security: types.StartTlsSec, SmtpHost: "mail.domain.local", SmtpPort: smtpStartTlsPort, RootCA: types.FilePath(validCert)}, &ConnectStarttls{hostname: "mail.domain.local", port: int(smtpStartTlsPort), policy: TlsPolicy{RootCaPath: validCert}}, nil, types.StartTlsSec, "mail.domain.local", nil, nil)
 	addCheck(t, &checklist, types.StartTlsSec.String()+" no domain", &cmdflags.Settings{Security: types.StartTlsSec, SmtpHost: "", SmtpPort: smtpStartTlsPort}, &ConnectStarttls{port: int(smtpStartTlsPort)}, nil, types.StartTlsSec, "", &[]error{ErrNoHostname}, &[]error{ErrNoHostname})
 	addCheck(t, &checklist, types.StartTlsSec.String()+" no port", &cmdflags.Settings{Security: types.StartTlsSec, SmtpHost: "mail.domain.local", SmtpPort: 0}, &ConnectStarttls{hostname: "mail.domain.local"}, nil, types.StartTlsSec, "mail.domain.local", &[]error{ErrNoPort}, &[]error{ErrNoPort})
 
-	addCheck(t, &checklist, types.SslTlsSec.String()+" regular", &cmdflags.Settings{Security: types.SslTlsSec, SmtpHost: "mail.domain.local", SmtpPort: smtpTlsPort, RootCA: types.FilePath(validCert)}, &ConnectSslTls{hostname: "mail.domain.local", port: int(smtpTlsPort), rootCaPath: validCert}, nil, types.SslTlsSec, "mail.domain.local", nil, nil)
-	addCheck(t, &checklist, types.SslTlsSec.String()+" no domain", &cmdflags.Settings{Security: types.SslTlsSec, SmtpHost: "", SmtpPort: smtpTlsPort, RootCA: types.FilePath(validCert)}, &ConnectSslTls{port: int(smtpTlsPort), rootCaPath: validCert}, nil, types.SslTlsSec, "", &[]error{ErrNoHostname}, &[]error{ErrNoHostname})
-	addCheck(t, &checklist, types.SslTlsSec.String()+" no port", &cmdflags.Settings{Security: types.SslTlsSec, SmtpHost: "mail.domain.local", SmtpPort: 0, RootCA: types.FilePath(validCert)}, &ConnectSslTls{hostname: "mail.domain.local", rootCaPath: validCert}, nil, types.SslTlsSec, "mail.domain.local", &[]error{ErrNoPort}, &[]error{ErrNoPort})
+	addCheck(t, &checklist, types.SslTlsSec.String()+" regular", &cmdflags.Settings{Security: types.SslTlsSec, SmtpHost: "mail.domain.local", SmtpPort: smtpTlsPort, RootCA: types.FilePath(validCert)}, &ConnectSslTls{hostname: "mail.domain.local", port: int(smtpTlsPort), policy: TlsPolicy{RootCaPath: validCert}}, nil, types.SslTlsSec, "mail.domain.local", nil, nil)
+	addCheck(t, &checklist, types.SslTlsSec.String()+" no domain", &cmdflags.Settings{Security: types.SslTlsSec, SmtpHost: "", SmtpPort: smtpTlsPort, RootCA: types.FilePath(validCert)}, &ConnectSslTls{port: int(smtpTlsPort), policy: TlsPolicy{RootCaPath: validCert}}, nil, types.SslTlsSec, "", &[]error{ErrNoHostname}, &[]error{ErrNoHostname})
+	addCheck(t, &checklist, types.SslTlsSec.String()+" no port", &cmdflags.Settings{Security: types.SslTlsSec, SmtpHost: "mail.domain.local", SmtpPort: 0, RootCA: types.FilePath(validCert)}, &ConnectSslTls{hostname: "mail.domain.local", policy: TlsPolicy{RootCaPath: validCert}}, nil, types.SslTlsSec, "mail.domain.local", &[]error{ErrNoPort}, &[]error{ErrNoPort})
+
+	var spkiPin, certPin, otherPin types.TlsPins
+	if err := spkiPin.Set(types.PinSpki + ":" + SpkiFingerprint(validCertificate)); err != nil {
+		t.Fatal(err)
+	}
+	if err := certPin.Set(types.PinCertificate + ":" + CertificateFingerprint(validCertificate)); err != nil {
+		t.Fatal(err)
+	}
+	if err := otherPin.Set("spki:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="); err != nil {
+		t.Fatal(err)
+	}
+
+	ecdsaCipher, rsaCipher := types.TlsCiphers{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, types.TlsCiphers{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	for _, sec := range []types.Security{types.StartTlsSec, types.SslTlsSec} {
+		port := smtpStartTlsPort
+		if sec == types.SslTlsSec {
+			port = smtpTlsPort
+		}
+		newConnection := func(hostname string, policy TlsPolicy) SecureConnection {
+			if sec == types.SslTlsSec {
+				return &ConnectSslTls{hostname: hostname, port: int(port), policy: policy}
+			}
+			return &ConnectStarttls{hostname: hostname, port: int(port), policy: policy}
+		}
+		settings := func(hostname string, st cmdflags.Settings) *cmdflags.Settings {
+			st.Security, st.SmtpHost, st.SmtpPort, st.RootCA = sec, types.DomainName(hostname), port, types.FilePath(validCert)
+			return &st
+		}
+
+		addCheck(t, &checklist, sec.String()+" tls 1.3", settings("mail.domain.local", cmdflags.Settings{TlsMinVersion: tls.VersionTLS13}), newConnection("mail.domain.local", TlsPolicy{RootCaPath: validCert, MinVersion: tls.VersionTLS13}), nil, sec, "mail.domain.local", nil, nil)
+		addCheck(t, &checklist, sec.String()+" tls 1.1 maximum", settings("mail.domain.local", cmdflags.Settings{TlsMaxVersion: tls.VersionTLS11}), newConnection("mail.domain.local", TlsPolicy{RootCaPath: validCert, MaxVersion: tls.VersionTLS11}), nil, sec, "mail.domain.local", nil, &[]error{ErrProtocolVersion})
+		addCheck(t, &checklist, sec.String()+" tls version range", settings("mail.domain.local", cmdflags.Settings{TlsMinVersion: tls.VersionTLS13, TlsMaxVersion: tls.VersionTLS12}), newConnection("mail.domain.local", TlsPolicy{RootCaPath: validCert, MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS12}), nil, sec, "mail.domain.local", &[]error{ErrTlsVersionRange}, &[]error{ErrTlsVersionRange})
+		addCheck(t, &checklist, sec.String()+" cipher", settings("mail.domain.local", cmdflags.Settings{TlsMaxVersion: tls.VersionTLS12, TlsCiphers: ecdsaCipher}), newConnection("mail.domain.local", TlsPolicy{RootCaPath: validCert, MaxVersion: tls.VersionTLS12, Ciphers: ecdsaCipher}), nil, sec, "mail.domain.local", nil, nil)
+		addCheck(t, &checklist, sec.String()+" cipher mismatch", settings("mail.domain.local", cmdflags.Settings{TlsMaxVersion: tls.VersionTLS12, TlsCiphers: rsaCipher}), newConnection("mail.domain.local", TlsPolicy{RootCaPath: validCert, MaxVersion: tls.VersionTLS12, Ciphers: rsaCipher}), nil, sec, "mail.domain.local", nil, &[]error{ErrHandshakeFailure})
+		addCheck(t, &checklist, sec.String()+" cipher tls 1.3", settings("mail.domain.local", cmdflags.Settings{TlsMinVersion: tls.VersionTLS13, TlsCiphers: ecdsaCipher}), newConnection("mail.domain.local", TlsPolicy{RootCaPath: validCert, MinVersion: tls.VersionTLS13, Ciphers: ecdsaCipher}), nil, sec, "mail.domain.local", &[]error{ErrTlsCiphersNotForTls13}, &[]error{ErrTlsCiphersNotForTls13})
+		addCheck(t, &checklist, sec.String()+" server name", settings("localhost", cmdflags.Settings{TlsServerName: "mail.domain.local"}), newConnection("localhost", TlsPolicy{RootCaPath: validCert, ServerName: "mail.domain.local"}), nil, sec, "localhost", nil, nil)
+		addCheck(t, &checklist, sec.String()+" pin spki", settings("mail.domain.local", cmdflags.Settings{TlsPins: spkiPin}), newConnection("mail.domain.local", TlsPolicy{RootCaPath: validCert, Pins: spkiPin}), nil, sec, "mail.domain.local", nil, nil)
+		addCheck(t, &checklist, sec.String()+" pin cert", settings("mail.domain.local", cmdflags.Settings{TlsPins: append(otherPin, certPin...)}), newConnection("mail.domain.local", TlsPolicy{RootCaPath: validCert, Pins: append(otherPin, certPin...)}), nil, sec, "mail.domain.local", nil, nil)
+		addCheck(t, &checklist, sec.String()+" pin mismatch", settings("mail.domain.local", cmdflags.Settings{TlsPins: otherPin}), newConnection("mail.domain.local", TlsPolicy{RootCaPath: validCert, Pins: otherPin}), nil, sec, "mail.domain.local", nil, &[]error{ErrPinMismatch, errors.New(spkiPin.String())})
+		addCheck(t, &checklist, sec.String()+" no server name", settings("localhost", cmdflags.Settings{}), newConnection("localhost", TlsPolicy{RootCaPath: validCert}), nil, sec, "localhost", nil, &[]error{ErrX509WrongHost})
+	}
 
 	addCheck(t, &checklist, "unkknown protocol", &cmdflags.Settings{Security: "UNKNOWN", SmtpHost: "mail.domain.local", SmtpPort: smtpNoSecurityPort}, nil, &[]error{ErrUnknownProtocol}, types.NoSecurity, "", nil, nil)
 
@@ -166,9 +221,22 @@ func Test_GetSecureConnection(t *testing.T) {
 				}
 			})
 
+			// Test ProbeCertificates, which does not depend on the verification of the server certificate
+			if prober, ok := sc.(CertificateProber); ok && c.expectedCheckErrors == nil && isVerificationOutcome(c.expectedConnectErrors) {
+				t.Run(c.name+" ProbeCertificates", func(t *testing.T) {
+					chain, err := prober.ProbeCertificates(context.Background())
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(chain) == 0 || CertificateFingerprint(chain[0]) != CertificateFingerprint(validCertificate) {
+						t.Errorf("Expected server certificate in probed chain")
+					}
+				})
+			}
+
 			// Test ClientConnect
 			t.Run(c.name+" ClientConnect", func(t *testing.T) {
-				_, close, _, err := sc.ClientConnect()
+				_, close, _, err := sc.ClientConnect(context.Background())
 				if err == nil {
 					defer close()
 				}
@@ -184,6 +252,173 @@ func Test_GetSecureConnection(t *testing.T) {
 	}
 }
 
+func Test_ClientCertificate(t *testing.T) {
+	serverCert, serverKey, err := certificates.CreateCertificate("Domain Local", "localhost")
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	defer os.Remove(serverKey)
+	defer os.Remove(serverCert)
+	caCert, caKey, err := certificates.CreateCA("Domain Local")
+	if err != nil {
+		t.Fatalf("Error creating CA: %s", err)
+	}
+	defer os.Remove(caKey)
+	defer os.Remove(caCert)
+	clientCert, clientKey, err := certificates.CreateClientCertificate("Domain Local", "user@domain.local", caCert, caKey)
+	if err != nil {
+		t.Fatalf("Error creating client certificate: %s", err)
+	}
+	defer os.Remove(clientKey)
+	defer os.Remove(clientCert)
+	otherCaCert, otherCaKey, err := certificates.CreateCA("Other")
+	if err != nil {
+		t.Fatalf("Error creating CA: %s", err)
+	}
+	defer os.Remove(otherCaKey)
+	defer os.Remove(otherCaCert)
+	otherCert, otherKey, err := certificates.CreateClientCertificate("Other", "user@domain.local", otherCaCert, otherCaKey)
+	if err != nil {
+		t.Fatalf("Error creating client certificate: %s", err)
+	}
+	defer os.Remove(otherKey)
+	defer os.Remove(otherCert)
+
+	tlsPort, stopTls, err := startClientCertServer(true, serverCert, serverKey, caCert)
+	if err != nil {
+		t.Fatalf("Cannot start SMTP server with TLS: %s", err)
+	}
+	defer stopTls()
+	starttlsPort, stopStarttls, err := startClientCertServer(false, serverCert, serverKey, caCert)
+	if err != nil {
+		t.Fatalf("Cannot start SMTP server with STARTTLS: %s", err)
+	}
+	defer stopStarttls()
+
+	type certCheck struct {
+		name                  string
+		connection            SecureConnection
+		expectedCheckErrors   *[]error
+		expectedConnectErrors *[]error
+	}
+	checklist := []certCheck{
+		{name: "ssl/tls client certificate", connection: NewConnectSslTls("localhost", tlsPort, TlsPolicy{RootCaPath: serverCert, ClientCert: clientCert, ClientKey: clientKey})},
+		{name: "ssl/tls no client certificate", connection: NewConnectSslTls("localhost", tlsPort, TlsPolicy{RootCaPath: serverCert}), expectedConnectErrors: &[]error{errors.New("tls: certificate required")}},
+		{name: "ssl/tls unknown client certificate", connection: NewConnectSslTls("localhost", tlsPort, TlsPolicy{RootCaPath: serverCert, ClientCert: otherCert, ClientKey: otherKey}), expectedConnectErrors: &[]error{errors.New("remote error: tls:")}},
+		{name: "starttls client certificate", connection: NewConnectStarttls("localhost", starttlsPort, TlsPolicy{RootCaPath: serverCert, ClientCert: clientCert, ClientKey: clientKey})},
+		{name: "starttls no client certificate", connection: NewConnectStarttls("localhost", starttlsPort, TlsPolicy{RootCaPath: serverCert}), expectedConnectErrors: &[]error{errors.New("tls: certificate required")}},
+		{name: "starttls no client key", connection: NewConnectStarttls("localhost", starttlsPort, TlsPolicy{RootCaPath: serverCert, ClientCert: clientCert}), expectedCheckErrors: &[]error{ErrClientCertificateIncomplete}, expectedConnectErrors: &[]error{ErrClientCertificateIncomplete}},
+		{name: "ssl/tls mismatching client key", connection: NewConnectSslTls("localhost", tlsPort, TlsPolicy{RootCaPath: serverCert, ClientCert: clientCert, ClientKey: otherKey}), expectedConnectErrors: &[]error{ErrClientCertificate}},
+	}
+
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			if cont, err := checkError(c.connection.Check(), c.expectedCheckErrors); !cont || err != nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			client, close, _, err := c.connection.ClientConnect(context.Background())
+			if cont, err := checkError(err, c.expectedConnectErrors); !cont || err != nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			defer close()
+			if err := client.Noop(); err != nil {
+				t.Errorf("Expected working connection, got %s", err)
+			}
+		})
+	}
+}
+
+// startClientCertServer starts a stand-in SMTP server that requires a client certificate signed by the CA in caFile
+func startClientCertServer(implicitTls bool, certFile, keyFile, caFile string) (int, func() error, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return 0, nil, err
+	}
+	caPem, err := os.ReadFile(caFile)
+	if err != nil {
+		return 0, nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caPem)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+
+	return startStandInServer(implicitTls, config)
+}
+
+// startStandInServer starts a minimal SMTP server on a free port that offers STARTTLS, or TLS from the start with implicitTls
+func startStandInServer(implicitTls bool, config *tls.Config) (int, func() error, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if implicitTls {
+				conn = tls.Server(conn, config)
+			}
+			go serveStandIn(conn, config)
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, listener.Close, nil
+}
+
+func serveStandIn(conn net.Conn, config *tls.Config) {
+	defer func() { conn.Close() }()
+	write := func(line string) error {
+		_, err := fmt.Fprintf(conn, "%s\r\n", line)
+		return err
+	}
+	if err := write("220 Stand-in SMTP Server"); err != nil {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		_, isTls := conn.(*tls.Conn)
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO") && !isTls:
+			err = write("250-Stand-in SMTP Server\r\n250 STARTTLS")
+		case strings.HasPrefix(cmd, "EHLO"):
+			err = write("250 Stand-in SMTP Server")
+		case cmd == "STARTTLS" && !isTls:
+			if err = write("220 Ready to start TLS"); err == nil {
+				tlsConn := tls.Server(conn, config)
+				if err = tlsConn.Handshake(); err == nil {
+					conn = tlsConn
+					reader = bufio.NewReader(conn)
+				}
+			}
+		case cmd == "NOOP":
+			err = write("250 OK")
+		case cmd == "QUIT":
+			write("221 Bye")
+			return
+		default:
+			err = write("500 Command not recognized")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 func addCheck(t testing.TB, checklist *[]check, name string, settings *cmdflags.Settings, expectedConnection SecureConnection, expectedConstructErrors *[]error, expectedSecurityType types.Security, expectedHostName string, expectedCheckErrors *[]error, expectedConnectErrors *[]error) {
 	t.Helper()
 	*checklist = append(*checklist, check{name: name, settings: settings, expectedConnection: expectedConnection, expectedConstructErrors: expectedConstructErrors, expectedSecurityType: expectedSecurityType, expectedHostName: expectedHostName, expectedCheckErrors: expectedCheckErrors, expectedConnectErrors: expectedConnectErrors})
@@ -228,6 +463,147 @@ func startDns(ip net.IP, port int) (func() error, error) {
 	return (*ds).Stop, nil
 }
 
+// dnsFixture is a DNS server for the records in a memory store of the DNS mock. A, AAAA and MX queries are answered by the DNS mock.
+// TXT, SRV and TLSA queries, which the DNS mock does not support, are answered from the same store, with the records in zone file
+// format, e.g. "0 1 587 smtp.domain.local." for SRV and "3 1 1 <hex>" for TLSA. Several records of a name are separated by new lines.
+// The AD bit of these answers is set when the fixture is authenticated.
+type dnsFixture struct {
+	address       string
+	conn          net.PacketConn
+	mutex         sync.Mutex
+	store         *dnsstoragememory.MemoryStore
+	authenticated bool
+}
+
+func startDnsFixture(store *dnsstoragememory.MemoryStore) (*dnsFixture, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	dns := &dnsFixture{address: conn.LocalAddr().String(), conn: conn, store: store}
+	go dns.serve()
+	return dns, nil
+}
+
+// set replaces the records of name and type. Without records the name does not exist for that type.
+func (d *dnsFixture) set(name string, dnsType dnsconst.DnsType, records ...string) {
+	(*d).mutex.Lock()
+	defer (*d).mutex.Unlock()
+	(*(*d).store).Set(name, dnsType, strings.Join(records, "\n"))
+}
+
+func (d *dnsFixture) setAuthenticated(authenticated bool) {
+	(*d).mutex.Lock()
+	defer (*d).mutex.Unlock()
+	(*d).authenticated = authenticated
+}
+
+func (d *dnsFixture) stop() error {
+	return (*d).conn.Close()
+}
+
+func (d *dnsFixture) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := (*d).conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		answer, err := d.answer(buf[:n])
+		if err != nil {
+			continue
+		}
+		(*d).conn.WriteTo(answer, addr)
+	}
+}
+
+func (d *dnsFixture) answer(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+	(*d).mutex.Lock()
+	defer (*d).mutex.Unlock()
+	switch question.Type {
+	case dnsmessage.TypeTXT, dnsmessage.TypeSRV, typeTLSA:
+		var records []string
+		if result, err := (*(*d).store).Get(strings.TrimSuffix(question.Name.String(), "."), dnsconst.DnsType(question.Type)); err == nil && result != "" {
+			records = strings.Split(result, "\n")
+		}
+		return buildRecordAnswer(header.ID, question, records, (*d).authenticated)
+	default:
+		dh := dnsservermock.NewDnsHandling()
+		if err := dh.ReadingQuery(query, len(query)); err == nil {
+			if err := dh.CreateResponse(); err == nil {
+				dh.ExecuteQueries((*d).store)
+			}
+		}
+		if err := dh.WriteResponse(); err != nil {
+			return nil, err
+		}
+		return dh.GetOutput(), nil
+	}
+}
+
+// buildRecordAnswer builds the answer with TXT, SRV or TLSA records in zone file format. A name without records does not exist.
+func buildRecordAnswer(id uint16, question dnsmessage.Question, records []string, authenticated bool) ([]byte, error) {
+	header := dnsmessage.Header{ID: id, Response: true, RecursionAvailable: true, AuthenticData: authenticated}
+	if len(records) == 0 {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+	builder := dnsmessage.NewBuilder(nil, header)
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	for _, r := range records {
+		switch question.Type {
+		case dnsmessage.TypeTXT:
+			if err := builder.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{r}}); err != nil {
+				return nil, err
+			}
+		case dnsmessage.TypeSRV:
+			var srv dnsmessage.SRVResource
+			var target string
+			if _, err := fmt.Sscan(r, &srv.Priority, &srv.Weight, &srv.Port, &target); err != nil {
+				return nil, err
+			}
+			var err error
+			if srv.Target, err = dnsmessage.NewName(target); err != nil {
+				return nil, err
+			}
+			if err := builder.SRVResource(rh, srv); err != nil {
+				return nil, err
+			}
+		case typeTLSA:
+			var usage, selector, matchingType uint8
+			var data string
+			if _, err := fmt.Sscan(r, &usage, &selector, &matchingType, &data); err != nil {
+				return nil, err
+			}
+			hash, err := hex.DecodeString(data)
+			if err != nil {
+				return nil, err
+			}
+			if err := builder.UnknownResource(rh, dnsmessage.UnknownResource{Type: typeTLSA, Data: append([]byte{usage, selector, matchingType}, hash...)}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return builder.Finish()
+}
+
 func setDefaultResolver(dnsAddress string) {
 	cr := &net.Resolver{
 		PreferGo: true,
@@ -241,6 +617,31 @@ func setDefaultResolver(dnsAddress string) {
 	net.DefaultResolver = cr
 }
 
+// isVerificationOutcome reports whether a connection is expected to succeed or to fail on the verification of the server certificate only
+func isVerificationOutcome(expectedErr *[]error) bool {
+	if expectedErr == nil {
+		return true
+	}
+	for _, exp := range []error{ErrPinMismatch, ErrX509UnknownAuthority, ErrX509WrongHost} {
+		if (*expectedErr)[0] == exp {
+			return true
+		}
+	}
+	return false
+}
+
+func readCertificate(path string) (*x509.Certificate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
 func getAddress(host string, port types.TCPPort) string {
 	return fmt.Sprintf("%s:%d", host, port)
 }
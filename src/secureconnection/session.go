@@ -0,0 +1,112 @@
+package secureconnection
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+// Time for the server to reply to QUIT after the session has been aborted
+const quitTimeout = 2 * time.Second
+
+// Timeouts limits the duration of the SMTP session. Zero means no timeout. The complete session is limited by the deadline of its context.
+type Timeouts struct {
+	Connect time.Duration // Dialing the server, including the proxy
+	Command time.Duration // Each read and write, i.e. sending a command and receiving its reply
+}
+
+func GetTimeouts(st *cmdflags.Settings) Timeouts {
+	return Timeouts{Connect: st.ConnectTimeout.GetDuration(), Command: st.CommandTimeout.GetDuration()}
+}
+
+// inPhase marks err with the phase of the session in which it occurred
+func inPhase(phase types.SmtpPhase, err error) error {
+	return &types.PhaseError{Phase: phase, Err: err}
+}
+
+// connectContext limits dialing by the connect timeout
+func connectContext(ctx context.Context, timeouts Timeouts) (context.Context, context.CancelFunc) {
+	if timeouts.Connect > 0 {
+		return context.WithTimeout(ctx, timeouts.Connect)
+	}
+	return context.WithCancel(ctx)
+}
+
+// sessionConn sets the deadline of the connection before every read and write: the command timeout from now, but not after the deadline of the context.
+// When the context is cancelled, a pending read or write is interrupted.
+type sessionConn struct {
+	net.Conn
+	ctx      context.Context
+	timeout  time.Duration
+	mu       sync.Mutex
+	aborting time.Time
+	stop     func() bool
+}
+
+func newSessionConn(ctx context.Context, conn net.Conn, timeout time.Duration) *sessionConn {
+	c := &sessionConn{Conn: conn, ctx: ctx, timeout: timeout}
+	(*c).stop = context.AfterFunc(ctx, c.extend)
+	return c
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	c.extend()
+	return (*c).Conn.Read(b)
+}
+
+func (c *sessionConn) Write(b []byte) (int, error) {
+	c.extend()
+	return (*c).Conn.Write(b)
+}
+
+func (c *sessionConn) Close() error {
+	(*c).stop()
+	return (*c).Conn.Close()
+}
+
+func (c *sessionConn) extend() {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+
+	var deadline time.Time
+	switch {
+	case (*c).ctx.Err() != nil && (*c).aborting.IsZero():
+		deadline = time.Now()
+	case (*c).ctx.Err() != nil:
+		deadline = (*c).aborting
+	default:
+		if (*c).timeout > 0 {
+			deadline = time.Now().Add((*c).timeout)
+		}
+		if d, ok := (*c).ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+	}
+	(*c).Conn.SetDeadline(deadline)
+}
+
+// quitter is the client of an SMTP or LMTP session
+type quitter interface {
+	Quit() error
+	Close() error
+}
+
+// closeSession returns the function that ends the session with QUIT, or closes the connection when the server does not reply.
+// An aborted session waits for the reply to QUIT no longer than quitTimeout.
+func (c *sessionConn) closeSession(client quitter) func() error {
+	return func() error {
+		if (*c).ctx.Err() != nil {
+			(*c).mu.Lock()
+			(*c).aborting = time.Now().Add(quitTimeout)
+			(*c).mu.Unlock()
+		}
+		if err := client.Quit(); err == nil {
+			return nil
+		}
+		return client.Close()
+	}
+}
@@ -0,0 +1,153 @@
+package secureconnection
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_SessionTimeouts(t *testing.T) {
+	silent, err := startSlowServer(false)
+	if err != nil {
+		t.Fatalf("Cannot start stand-in server: %s", err)
+	}
+	defer silent.stop()
+
+	type timeoutCheck struct {
+		name           string
+		timeouts       Timeouts
+		ctxTimeout     time.Duration
+		cancelled      bool
+		expectedErrors *[]error
+	}
+	checklist := []timeoutCheck{
+		{name: "command timeout", timeouts: Timeouts{Command: 200 * time.Millisecond}, expectedErrors: &[]error{errors.New("i/o timeout")}},
+		{name: "deadline of context", ctxTimeout: 200 * time.Millisecond, expectedErrors: &[]error{errors.New("i/o timeout")}},
+		{name: "cancelled before dial", timeouts: Timeouts{Connect: time.Second}, cancelled: true, expectedErrors: &[]error{errors.New("operation was canceled")}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if c.ctxTimeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, c.ctxTimeout)
+				defer cancel()
+			}
+			if c.cancelled {
+				cancel()
+			}
+
+			conn := NewConnectNone("127.0.0.1", silent.port)
+			conn.SetTimeouts(c.timeouts)
+			start := time.Now()
+			_, close, _, err := conn.ClientConnect(ctx)
+			if cont, err := checkError(err, c.expectedErrors); !cont {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if elapsed := time.Since(start); elapsed > 2*time.Second {
+					t.Errorf("Expected the connection to end within 2s, took %s", elapsed)
+				}
+				return
+			}
+			close()
+		})
+	}
+}
+
+func Test_SessionAbort(t *testing.T) {
+	server, err := startSlowServer(true)
+	if err != nil {
+		t.Fatalf("Cannot start stand-in server: %s", err)
+	}
+	defer server.stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := NewConnectNone("127.0.0.1", server.port)
+	client, close, _, err := conn.ClientConnect(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	// The stand-in server does not reply to MAIL
+	time.AfterFunc(200*time.Millisecond, cancel)
+	if err := client.Mail("sender@domain.local"); err == nil {
+		t.Fatalf("Expected MAIL to be interrupted, got no error")
+	}
+	if err := close(); err != nil {
+		t.Errorf("Expected QUIT to be accepted, got %s", err)
+	}
+	if got := server.lastCommand(); got != "QUIT" {
+		t.Errorf("Expected last command QUIT, got %q", got)
+	}
+}
+
+// slowServer greets and replies to EHLO and QUIT only, or does not reply at all when silent
+type slowServer struct {
+	port     int
+	stop     func() error
+	mu       sync.Mutex
+	commands []string
+}
+
+func startSlowServer(greet bool) (*slowServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &slowServer{port: listener.Addr().(*net.TCPAddr).Port, stop: listener.Close}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, greet)
+		}
+	}()
+	return s, nil
+}
+
+func (s *slowServer) serve(conn net.Conn, greet bool) {
+	defer conn.Close()
+	if !greet {
+		// Hold the connection until the client gives up
+		conn.Read(make([]byte, 1))
+		return
+	}
+	fmt.Fprintf(conn, "220 Slow SMTP Server\r\n")
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			fmt.Fprintf(conn, "250 Slow SMTP Server\r\n")
+		case cmd == "QUIT":
+			fmt.Fprintf(conn, "221 Bye\r\n")
+			return
+		}
+	}
+}
+
+func (s *slowServer) lastCommand() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.commands) == 0 {
+		return ""
+	}
+	return s.commands[len(s.commands)-1]
+}
@@ -0,0 +1,77 @@
+package secureconnection
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+var (
+	ErrSourceFamily    = errors.New("bind address does not match IP family")
+	ErrNoFamilyAddress = errors.New("no address of the IP family")
+)
+
+// Source selects the local address and IP version of the connection. With a proxy it applies to the connection to the proxy.
+type Source struct {
+	Address net.IP         // Local address, or nil to let the system choose
+	Family  types.IpFamily // IPv4, IPv6, or both with Happy Eyeballs (RFC 6555) when empty or auto
+}
+
+func GetSource(st *cmdflags.Settings) Source {
+	return Source{Address: st.BindAddress.GetIP(), Family: st.IpFamily}
+}
+
+func (s Source) Check() error {
+	if s.Address == nil {
+		return nil
+	}
+	ipv4 := s.Address.To4() != nil
+	if (s.Family == types.Ipv4Family && !ipv4) || (s.Family == types.Ipv6Family && ipv4) {
+		return fmt.Errorf("%w: %s with IPv%s", ErrSourceFamily, s.Address, s.Family)
+	}
+	return nil
+}
+
+// network returns the network for net.Dial. The Go dialer falls back between IPv6 and IPv4 for "tcp".
+func (s Source) network() string {
+	switch s.Family {
+	case types.Ipv4Family:
+		return "tcp4"
+	case types.Ipv6Family:
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+func (s Source) dialer() *net.Dialer {
+	d := &net.Dialer{}
+	if s.Address != nil {
+		// Only remote addresses of the same IP version are tried
+		(*d).LocalAddr = &net.TCPAddr{IP: s.Address}
+	}
+	return d
+}
+
+// filter keeps the addresses of the IP family and of the bind address
+func (s Source) filter(ips []net.IPAddr) []net.IPAddr {
+	family := s.Family
+	if s.Address != nil && s.Address.To4() != nil {
+		family = types.Ipv4Family
+	} else if s.Address != nil {
+		family = types.Ipv6Family
+	}
+
+	var filtered []net.IPAddr
+	for _, ip := range ips {
+		ipv4 := ip.IP.To4() != nil
+		if (family == types.Ipv4Family && !ipv4) || (family == types.Ipv6Family && ipv4) {
+			continue
+		}
+		filtered = append(filtered, ip)
+	}
+	return filtered
+}
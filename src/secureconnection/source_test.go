@@ -0,0 +1,76 @@
+package secureconnection
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+func Test_Source(t *testing.T) {
+	server, err := startSlowServer(true)
+	if err != nil {
+		t.Fatalf("Cannot start stand-in server: %s", err)
+	}
+	defer server.stop()
+
+	type sourceCheck struct {
+		name           string
+		hostname       string
+		source         Source
+		expectedLocal  string
+		expectedErrors *[]error
+	}
+	checklist := []sourceCheck{
+		{name: "default", hostname: "127.0.0.1", expectedLocal: "127.0.0.1:"},
+		{name: "bind address", hostname: "127.0.0.1", source: Source{Address: net.ParseIP("127.0.0.2")}, expectedLocal: "127.0.0.2:"},
+		{name: "bind address ipv4", hostname: "127.0.0.1", source: Source{Address: net.ParseIP("127.0.0.3"), Family: types.Ipv4Family}, expectedLocal: "127.0.0.3:"},
+		{name: "ipv4 of localhost", hostname: "localhost", source: Source{Family: types.Ipv4Family}, expectedLocal: "127.0.0.1:"},
+		{name: "ipv6 to ipv4 address", hostname: "127.0.0.1", source: Source{Family: types.Ipv6Family}, expectedErrors: &[]error{errors.New("no suitable address")}},
+		{name: "bind address of other family", hostname: "127.0.0.1", source: Source{Address: net.ParseIP("::1"), Family: types.Ipv4Family}, expectedErrors: &[]error{ErrSourceFamily}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			conn := NewConnectNone(c.hostname, server.port)
+			conn.SetSource(c.source)
+			_, close, local, err := conn.ClientConnect(context.Background())
+			if cont, err := checkError(err, c.expectedErrors); !cont {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			defer close()
+			if !strings.HasPrefix(local, c.expectedLocal) {
+				t.Errorf("Expected local address %s<port>, got %s", c.expectedLocal, local)
+			}
+		})
+	}
+}
+
+func Test_SourceFilter(t *testing.T) {
+	ips := []net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("2001:db8::1")}}
+	type filterCheck struct {
+		name     string
+		source   Source
+		expected []net.IPAddr
+	}
+	checklist := []filterCheck{
+		{name: "auto", source: Source{Family: types.AutoIpFamily}, expected: ips},
+		{name: "ipv4", source: Source{Family: types.Ipv4Family}, expected: []net.IPAddr{ips[1]}},
+		{name: "ipv6", source: Source{Family: types.Ipv6Family}, expected: []net.IPAddr{ips[0], ips[2]}},
+		{name: "ipv4 bind address", source: Source{Address: net.ParseIP("192.0.2.10")}, expected: []net.IPAddr{ips[1]}},
+		{name: "ipv6 bind address", source: Source{Address: net.ParseIP("2001:db8::10")}, expected: []net.IPAddr{ips[0], ips[2]}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.source.filter(ips); !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("Expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package secureconnection
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/smtp"
@@ -10,13 +12,37 @@ import (
 )
 
 type ConnectSslTls struct {
-	hostname   string
-	port       int
-	rootCaPath string
+	hostname string
+	port     int
+	policy   TlsPolicy
+	proxy    *Proxy
+	timeouts Timeouts
+	source   Source
+	ehloName string
 }
 
-func NewConnectSslTls(hostname string, port int, rootCaPath string) *ConnectSslTls {
-	return &ConnectSslTls{hostname: hostname, port: port, rootCaPath: rootCaPath}
+func NewConnectSslTls(hostname string, port int, policy TlsPolicy) *ConnectSslTls {
+	return &ConnectSslTls{hostname: hostname, port: port, policy: policy}
+}
+
+// SetProxy connects through p, or directly when p is nil
+func (c *ConnectSslTls) SetProxy(p *Proxy) {
+	(*c).proxy = p
+}
+
+// SetTimeouts limits connecting and every command of the session
+func (c *ConnectSslTls) SetTimeouts(t Timeouts) {
+	(*c).timeouts = t
+}
+
+// SetSource sets the local address and IP version of the connection
+func (c *ConnectSslTls) SetSource(s Source) {
+	(*c).source = s
+}
+
+// SetEhloName sets the name sent with EHLO, or the default name when empty
+func (c *ConnectSslTls) SetEhloName(name string) {
+	(*c).ehloName = name
 }
 
 func (c *ConnectSslTls) Check() error {
@@ -27,9 +53,8 @@ func (c *ConnectSslTls) Check() error {
 	if (*c).port == 0 {
 		errMsgs = append(errMsgs, ErrNoPort)
 	}
-	if (*c).rootCaPath != "" {
-		errMsgs = append(errMsgs, checkPath((*c).rootCaPath))
-	}
+	errMsgs = append(errMsgs, (*c).source.Check())
+	errMsgs = append(errMsgs, (*c).policy.Check())
 	return errors.Join(errMsgs...)
 }
 
@@ -41,39 +66,55 @@ func (c *ConnectSslTls) GetHostName() string {
 	return (*c).hostname
 }
 
-func (c *ConnectSslTls) ClientConnect() (*smtp.Client, func() error, string, error) {
+func (c *ConnectSslTls) ClientConnect(ctx context.Context) (*smtp.Client, func() error, string, error) {
 	if err := c.Check(); err != nil {
 		return nil, nil, "", err
 	}
 
-	config := &tls.Config{
-		ServerName: (*c).hostname,
-	}
-	if c.rootCaPath != "" {
-		var err error
-		(*config).RootCAs, err = getPemCertificate((*c).rootCaPath)
-		if err != nil {
-			return nil, nil, "", err
-		}
+	config, err := (*c).policy.getConfig(ctx, (*c).hostname, (*c).port)
+	if err != nil {
+		return nil, nil, "", err
 	}
 
-	conn, err := tls.Dial("tcp", fmt.Sprintf("%s:%d", (*c).hostname, (*c).port), config)
+	conn, raw, err := (*c).dialTls(ctx, config)
 	if err != nil {
-		return nil, nil, "", fmt.Errorf("%w : %w", ErrSslTlsNotSupported, err)
+		return nil, nil, "", err
 	}
-	client, err := smtp.NewClient(conn, (*c).hostname)
+	client, err := newClient(ctx, conn, (*c).hostname, (*c).ehloName)
 	if err != nil {
 		conn.Close()
 		return nil, nil, "", err
 	}
+	return client, raw.closeSession(client), conn.LocalAddr().String(), nil
+}
+
+func (c *ConnectSslTls) ProbeCertificates(ctx context.Context) ([]*x509.Certificate, error) {
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+	config, err := (*c).policy.getProbeConfig(ctx, (*c).hostname)
+	if err != nil {
+		return nil, err
+	}
 
-	close := func() error {
-		errClient := client.Close()
-		errConnection := conn.Close()
-		if errClient != nil || errConnection != nil {
-			return errors.Join(errClient, errConnection)
-		}
-		return nil
+	conn, _, err := (*c).dialTls(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates, nil
+}
+
+// dialTls returns the TLS connection and the underlying connection, which ends the session
+func (c *ConnectSslTls) dialTls(ctx context.Context, config *tls.Config) (*tls.Conn, *sessionConn, error) {
+	raw, err := dial(ctx, (*c).proxy, (*c).timeouts, (*c).source, (*c).hostname, (*c).port)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := tls.Client(raw, config)
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
+		return nil, nil, inPhase(types.StartTlsPhase, fmt.Errorf("%w : %w", ErrSslTlsNotSupported, err))
 	}
-	return client, close, conn.LocalAddr().String(), nil
+	return conn, raw, nil
 }
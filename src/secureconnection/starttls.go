@@ -1,10 +1,10 @@
 package secureconnection
 
 import (
-	"crypto/tls"
+	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"net"
 	"net/smtp"
 
 	"github.com/Sternisaea/gosend/src/types"
@@ -13,13 +13,37 @@ import (
 const StartTls = "starttls"
 
 type ConnectStarttls struct {
-	hostname   string
-	port       int
-	rootCaPath string
+	hostname string
+	port     int
+	policy   TlsPolicy
+	proxy    *Proxy
+	timeouts Timeouts
+	source   Source
+	ehloName string
 }
 
-func NewConnectStarttls(hostname string, port int, rootCaPath string) *ConnectStarttls {
-	return &ConnectStarttls{hostname: hostname, port: port, rootCaPath: rootCaPath}
+func NewConnectStarttls(hostname string, port int, policy TlsPolicy) *ConnectStarttls {
+	return &ConnectStarttls{hostname: hostname, port: port, policy: policy}
+}
+
+// SetProxy connects through p, or directly when p is nil
+func (c *ConnectStarttls) SetProxy(p *Proxy) {
+	(*c).proxy = p
+}
+
+// SetTimeouts limits connecting and every command of the session
+func (c *ConnectStarttls) SetTimeouts(t Timeouts) {
+	(*c).timeouts = t
+}
+
+// SetSource sets the local address and IP version of the connection
+func (c *ConnectStarttls) SetSource(s Source) {
+	(*c).source = s
+}
+
+// SetEhloName sets the name sent with EHLO, or the default name when empty
+func (c *ConnectStarttls) SetEhloName(name string) {
+	(*c).ehloName = name
 }
 
 func (c *ConnectStarttls) Check() error {
@@ -30,9 +54,8 @@ func (c *ConnectStarttls) Check() error {
 	if (*c).port == 0 {
 		errMsgs = append(errMsgs, ErrNoPort)
 	}
-	if (*c).rootCaPath != "" {
-		errMsgs = append(errMsgs, checkPath((*c).rootCaPath))
-	}
+	errMsgs = append(errMsgs, (*c).source.Check())
+	errMsgs = append(errMsgs, (*c).policy.Check())
 	return errors.Join(errMsgs...)
 }
 
@@ -44,40 +67,68 @@ func (c *ConnectStarttls) GetHostName() string {
 	return (*c).hostname
 }
 
-func (c *ConnectStarttls) ClientConnect() (*smtp.Client, func() error, string, error) {
+func (c *ConnectStarttls) ClientConnect(ctx context.Context) (*smtp.Client, func() error, string, error) {
 	if err := c.Check(); err != nil {
 		return nil, nil, "", err
 	}
 
 	// Not using smtp.Dial, because Source TCP Port need to be ascertained
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", (*c).hostname, (*c).port))
+	conn, err := dial(ctx, (*c).proxy, (*c).timeouts, (*c).source, (*c).hostname, (*c).port)
 	if err != nil {
 		return nil, nil, "", err
 	}
-	client, err := smtp.NewClient(conn, (*c).hostname)
+	client, err := newClient(ctx, conn, (*c).hostname, (*c).ehloName)
 	if err != nil {
 		return nil, nil, "", err
 	}
 
 	if ok, _ := client.Extension(StartTls); !ok {
 		client.Close()
-		return nil, nil, "", fmt.Errorf("%w : %s", ErrStarttlsNotSupported, (*c).hostname)
+		return nil, nil, "", inPhase(types.StartTlsPhase, fmt.Errorf("%w : %s", ErrStarttlsNotSupported, (*c).hostname))
 	}
 
-	config := &tls.Config{
-		ServerName: (*c).hostname,
-	}
-	if c.rootCaPath != "" {
-		var err error
-		(*config).RootCAs, err = getPemCertificate((*c).rootCaPath)
-		if err != nil {
-			return nil, nil, "", err
-		}
+	config, err := (*c).policy.getConfig(ctx, (*c).hostname, (*c).port)
+	if err != nil {
+		client.Close()
+		return nil, nil, "", err
 	}
 
 	if err = client.StartTLS(config); err != nil {
 		client.Close()
-		return nil, nil, "", err
+		return nil, nil, "", inPhase(types.StartTlsPhase, err)
+	}
+	return client, conn.closeSession(client), conn.LocalAddr().String(), nil
+}
+
+func (c *ConnectStarttls) ProbeCertificates(ctx context.Context) ([]*x509.Certificate, error) {
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+	config, err := (*c).policy.getProbeConfig(ctx, (*c).hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dial(ctx, (*c).proxy, (*c).timeouts, (*c).source, (*c).hostname, (*c).port)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newClient(ctx, conn, (*c).hostname, (*c).ehloName)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension(StartTls); !ok {
+		return nil, inPhase(types.StartTlsPhase, fmt.Errorf("%w : %s", ErrStarttlsNotSupported, (*c).hostname))
+	}
+	if err := client.StartTLS(config); err != nil {
+		return nil, err
+	}
+	state, ok := client.TLSConnectionState()
+	if !ok {
+		return nil, ErrNoTls
 	}
-	return client, client.Close, conn.LocalAddr().String(), nil
+	client.Quit()
+	return state.PeerCertificates, nil
 }
@@ -0,0 +1,245 @@
+package secureconnection
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	typeTLSA   dnsmessage.Type = 52 // RFC 6698
+	dnsTimeout                 = 5 * time.Second
+	dnsUdpSize                 = 1232
+)
+
+var (
+	ErrDnsLookup        = errors.New("DNS lookup failed")
+	ErrDnsInvalidAnswer = errors.New("invalid DNS answer")
+)
+
+// Path of the resolver configuration with the name servers used for TLSA lookups
+var resolvConf = "/etc/resolv.conf"
+
+type tlsaRecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// lookupTLSA queries the TLSA records of _port._tcp.hostname. It also returns whether the resolver marked the answer
+// as authenticated by DNSSEC (AD bit). The AD bit is not protected on its way from a remote resolver, so it is only
+// accepted from a resolver on the loopback interface, or from any resolver with "options trust-ad" in resolv.conf like glibc.
+// The name servers of the resolver configuration are tried in turn until one answers, as long as ctx is not done.
+func lookupTLSA(ctx context.Context, hostname string, port int) ([]tlsaRecord, bool, error) {
+	name, err := dnsmessage.NewName(fmt.Sprintf("_%d._tcp.%s.", port, strings.TrimSuffix(hostname, ".")))
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrDnsLookup, err)
+	}
+
+	servers, trustAd := getNameServers()
+	var errMsgs []error
+	for _, server := range servers {
+		if err := ctx.Err(); err != nil {
+			return nil, false, fmt.Errorf("%w: %s: %w", ErrDnsLookup, name, err)
+		}
+		records, authenticated, remote, err := queryTlsa(ctx, server, name)
+		if err == nil {
+			return records, authenticated && (trustAd || isLoopback(remote)), nil
+		}
+		errMsgs = append(errMsgs, fmt.Errorf("%s: %w", server, err))
+	}
+	return nil, false, fmt.Errorf("%w: %s: %w", ErrDnsLookup, name, errors.Join(errMsgs...))
+}
+
+// queryTlsa asks one name server for the TLSA records, within dnsTimeout. It also returns the address the answer came from.
+func queryTlsa(ctx context.Context, server string, name dnsmessage.Name) ([]tlsaRecord, bool, net.Addr, error) {
+	query, id, err := buildTlsaQuery(name)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	answer, remote, err := exchangeDns(ctx, "udp", server, query)
+	if err == nil && len(answer) > 2 && answer[2]&0x02 != 0 {
+		// Truncated answer, retry over TCP
+		answer, remote, err = exchangeDns(ctx, "tcp", server, query)
+	}
+	if err != nil {
+		return nil, false, nil, err
+	}
+	records, authenticated, err := parseTlsaAnswer(answer, id, name)
+	return records, authenticated, remote, err
+}
+
+// isLoopback reports whether the address is on the loopback interface, e.g. a local validating resolver
+func isLoopback(addr net.Addr) bool {
+	if addr == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func buildTlsaQuery(name dnsmessage.Name) ([]byte, uint16, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	// The AD bit in a query asks the resolver to report whether the answer was validated (RFC 6840)
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true, AuthenticData: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: typeTLSA, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	if err := builder.StartAdditionals(); err != nil {
+		return nil, 0, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(dnsUdpSize, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, 0, err
+	}
+	if err := builder.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, 0, err
+	}
+	query, err := builder.Finish()
+	return query, id, err
+}
+
+func parseTlsaAnswer(answer []byte, id uint16, name dnsmessage.Name) ([]tlsaRecord, bool, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(answer)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrDnsInvalidAnswer, err)
+	}
+	if header.ID != id || !header.Response {
+		return nil, false, fmt.Errorf("%w: unexpected message", ErrDnsInvalidAnswer)
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, header.AuthenticData, nil
+	default:
+		return nil, false, fmt.Errorf("%w: %s: %s", ErrDnsLookup, name, header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrDnsInvalidAnswer, err)
+	}
+
+	var records []tlsaRecord
+	for {
+		rh, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %w", ErrDnsInvalidAnswer, err)
+		}
+		if rh.Type != typeTLSA || rh.Class != dnsmessage.ClassINET {
+			// E.g. the CNAME records of an alias
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, false, fmt.Errorf("%w: %w", ErrDnsInvalidAnswer, err)
+			}
+			continue
+		}
+		res, err := parser.UnknownResource()
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %w", ErrDnsInvalidAnswer, err)
+		}
+		if len(res.Data) < 4 {
+			return nil, false, fmt.Errorf("%w: TLSA record too short", ErrDnsInvalidAnswer)
+		}
+		records = append(records, tlsaRecord{Usage: res.Data[0], Selector: res.Data[1], MatchingType: res.Data[2], Data: res.Data[3:]})
+	}
+	return records, header.AuthenticData, nil
+}
+
+// exchangeDns sends a DNS query and returns the answer with the address it came from. Over TCP messages are prefixed by their length (RFC 1035).
+// A custom Dial function of net.DefaultResolver is used as well, so lookups follow the same path as the other lookups.
+func exchangeDns(ctx context.Context, network, server string, query []byte) ([]byte, net.Addr, error) {
+	var conn net.Conn
+	var err error
+	if net.DefaultResolver.Dial != nil {
+		conn, err = net.DefaultResolver.Dial(ctx, network, server)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, server)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, isPacket := conn.(net.PacketConn); isPacket {
+		if _, err := conn.Write(query); err != nil {
+			return nil, nil, err
+		}
+		answer := make([]byte, dnsUdpSize)
+		n, err := conn.Read(answer)
+		if err != nil {
+			return nil, nil, err
+		}
+		return answer[:n], conn.RemoteAddr(), nil
+	}
+
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+		return nil, nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, nil, err
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, nil, err
+	}
+	return answer, conn.RemoteAddr(), nil
+}
+
+// getNameServers returns the name servers of the resolver configuration in their order, or the local resolver.
+// It also returns whether the configuration trusts the AD bit of its name servers (options trust-ad).
+func getNameServers() ([]string, bool) {
+	var servers []string
+	trustAd := false
+	if file, err := os.Open(resolvConf); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			switch {
+			case len(fields) >= 2 && fields[0] == "nameserver":
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			case len(fields) >= 2 && fields[0] == "options" && slices.Contains(fields[1:], "trust-ad"):
+				trustAd = true
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{net.JoinHostPort("127.0.0.1", "53")}
+	}
+	return servers, trustAd
+}
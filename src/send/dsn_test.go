@@ -0,0 +1,95 @@
+package send
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/Sternisaea/gosend/src/authentication"
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/secureconnection"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+func Test_SmtpSendDsn(t *testing.T) {
+	server, err := startMailServer("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot start SMTP server: %s", err)
+	}
+	defer server.stop()
+	host, port, _ := net.SplitHostPort(server.address)
+	portNo, _ := strconv.Atoi(port)
+
+	type dsnCheck struct {
+		name             string
+		ehloName         string
+		ret              string
+		envelopeId       string
+		notify           string
+		orcpt            bool
+		expectedEnvelope []string
+	}
+	checklist := []dsnCheck{
+		{name: "all parameters", ehloName: "dsn.domain.local", ret: "hdrs", envelopeId: "QQ+314=x y", notify: "success,failure", orcpt: true, expectedEnvelope: []string{
+			"MAIL FROM:<sender@domain.local> RET=HDRS ENVID=QQ+2B314+3Dx+20y",
+			"RCPT TO:<alice@domain.local> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;alice@domain.local",
+			"RCPT TO:<bob+news@domain.local> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;bob+2Bnews@domain.local",
+		}},
+		{name: "never notify", ehloName: "dsn.domain.local", notify: "never", expectedEnvelope: []string{
+			"MAIL FROM:<sender@domain.local>",
+			"RCPT TO:<alice@domain.local> NOTIFY=NEVER",
+			"RCPT TO:<bob+news@domain.local> NOTIFY=NEVER",
+		}},
+		{name: "no parameters", ehloName: "dsn.domain.local", expectedEnvelope: []string{
+			"MAIL FROM:<sender@domain.local>",
+			"RCPT TO:<alice@domain.local>",
+			"RCPT TO:<bob+news@domain.local>",
+		}},
+		{name: "dsn not supported", ehloName: "client.domain.local", ret: "full", envelopeId: "QQ314", notify: "failure,delay", orcpt: true, expectedEnvelope: []string{
+			"MAIL FROM:<sender@domain.local>",
+			"RCPT TO:<alice@domain.local>",
+			"RCPT TO:<bob+news@domain.local>",
+		}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			st := &cmdflags.Settings{
+				Sender:       types.Email(mail.Address{Address: "sender@domain.local"}),
+				RecipientsTo: types.EmailAddresses{types.Email(mail.Address{Address: "alice@domain.local"}), types.Email(mail.Address{Address: "bob+news@domain.local"})},
+				Subject:      c.name,
+				BodyText:     "DSN",
+				DsnOrcpt:     types.Switch(c.orcpt),
+			}
+			if c.ret != "" {
+				if err := st.DsnReturn.Set(c.ret); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.envelopeId != "" {
+				if err := st.DsnEnvelopeId.Set(c.envelopeId); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.notify != "" {
+				if err := st.DsnNotify.Set(c.notify); err != nil {
+					t.Fatal(err)
+				}
+			}
+			conn := secureconnection.NewConnectNone(host, portNo)
+			conn.SetEhloName(c.ehloName)
+			s := NewSmtpSend(conn, authentication.NewAuthNone())
+			if err := s.CreateMessage(st); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SendMail(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := server.lastEnvelope(); !reflect.DeepEqual(got, c.expectedEnvelope) {
+				t.Errorf("Expected envelope %q, got %q", c.expectedEnvelope, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package send
+
+import (
+	"errors"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/message"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+// Enhanced status code at the start of a reply, e.g. 5.1.1 (RFC 3463 section 2)
+var enhancedCodeRegex = regexp.MustCompile(`^([245])\.\d{1,3}\.\d{1,3}$`)
+
+// SmtpError is the failure of a phase of the SMTP or LMTP session, e.g. a recipient rejected at RCPT or a failed authentication.
+// It is found with errors.As in the errors returned by SendMail and in the results per recipient.
+type SmtpError struct {
+	Phase        types.SmtpPhase
+	Code         int    // Reply code of the server, 0 when the server did not reply, e.g. when connecting failed
+	EnhancedCode string // Enhanced status code of the reply, e.g. 5.1.1, empty when the server did not send one
+	Err          error
+}
+
+func newSmtpError(phase types.SmtpPhase, err error) *SmtpError {
+	e := &SmtpError{Phase: phase, Err: err}
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		(*e).Code = reply.Code
+		(*e).EnhancedCode = enhancedCode(reply.Code, reply.Msg)
+	}
+	return e
+}
+
+func (e *SmtpError) Error() string {
+	return string((*e).Phase) + ": " + (*e).Err.Error()
+}
+
+func (e *SmtpError) Unwrap() error {
+	return (*e).Err
+}
+
+// Permanent reports whether the server rejected with a 5xx reply
+func (e *SmtpError) Permanent() bool {
+	return (*e).Code >= 500 && (*e).Code < 600
+}
+
+// enhancedCode returns the enhanced status code at the start of the reply text, when its class matches the reply code
+func enhancedCode(code int, msg string) string {
+	first, _, _ := strings.Cut(msg, "\n")
+	field, _, _ := strings.Cut(first, " ")
+	match := enhancedCodeRegex.FindStringSubmatch(field)
+	if match == nil || int(match[1][0]-'0') != code/100 {
+		return ""
+	}
+	return field
+}
+
+// smtpError returns err as SmtpError when it is marked with the phase of the session in which it occurred
+func smtpError(err error) error {
+	var smtpErr *SmtpError
+	var phaseErr *types.PhaseError
+	if errors.As(err, &smtpErr) || !errors.As(err, &phaseErr) {
+		return err
+	}
+	return newSmtpError((*phaseErr).Phase, err)
+}
+
+// smtpResults converts the errors of the rejected recipients to SmtpError
+func smtpResults(results []message.RecipientResult) []message.RecipientResult {
+	for i := range results {
+		if results[i].Err != nil {
+			results[i].Err = smtpError(results[i].Err)
+		}
+	}
+	return results
+}
+
+// firstFailure returns the error of the first recipient that was not accepted
+func firstFailure(results []message.RecipientResult) error {
+	for _, r := range results {
+		if !r.Accepted() {
+			return r.Err
+		}
+	}
+	return nil
+}
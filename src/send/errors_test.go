@@ -0,0 +1,158 @@
+package send
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strconv"
+	"testing"
+
+	"github.com/Sternisaea/gosend/src/authentication"
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/message"
+	"github.com/Sternisaea/gosend/src/secureconnection"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+func Test_SmtpError(t *testing.T) {
+	server, err := startMailServer("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot start SMTP server: %s", err)
+	}
+	defer server.stop()
+	host, port, _ := net.SplitHostPort(server.address)
+	portNo, _ := strconv.Atoi(port)
+
+	// A port without server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	settings := func(to ...string) *cmdflags.Settings {
+		st := &cmdflags.Settings{
+			Sender:      types.Email(mail.Address{Address: "sender@domain.local"}),
+			Subject:     "Errors",
+			BodyText:    "Errors",
+			LmtpAddress: types.LmtpAddress(server.address),
+		}
+		for _, r := range to {
+			st.RecipientsTo = append(st.RecipientsTo, types.Email(mail.Address{Address: r}))
+		}
+		return st
+	}
+	smtpSend := func(t *testing.T, conn secureconnection.SecureConnection, policy message.RecipientPolicy, to ...string) *SmtpSend {
+		s := NewSmtpSend(conn, authentication.NewAuthNone())
+		s.SetRecipientPolicy(policy)
+		if err := s.CreateMessage(settings(to...)); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	lmtpSend := func(t *testing.T, policy message.RecipientPolicy, to ...string) *LmtpSend {
+		conn, err := secureconnection.GetLmtpConnection(settings(to...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetEhloName("client.domain.local")
+		s := NewLmtpSend(conn)
+		s.SetRecipientPolicy(policy)
+		if err := s.CreateMessage(settings(to...)); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	type errorCheck struct {
+		name                 string
+		send                 func(t *testing.T) error
+		expectedPhase        types.SmtpPhase
+		expectedCode         int
+		expectedEnhancedCode string
+		expectedErrors       *[]error
+	}
+	checklist := []errorCheck{
+		{name: "connect", send: func(t *testing.T) error {
+			return smtpSend(t, secureconnection.NewConnectNone(host, closedPort), message.RecipientPolicy{}, "alice@domain.local").SendMail(context.Background())
+		}, expectedPhase: types.ConnectPhase, expectedErrors: &[]error{errors.New("connect: dial tcp"), errors.New("refused")}},
+		{name: "starttls not offered", send: func(t *testing.T) error {
+			conn := secureconnection.NewConnectStarttls(host, portNo, secureconnection.TlsPolicy{})
+			conn.SetEhloName("client.domain.local")
+			_, _, _, err := conn.ClientConnect(context.Background())
+			return sessionError(context.Background(), err)
+		}, expectedPhase: types.StartTlsPhase, expectedErrors: &[]error{secureconnection.ErrStarttlsNotSupported}},
+		{name: "rcpt rejected", send: func(t *testing.T) error {
+			conn := secureconnection.NewConnectNone(host, portNo)
+			conn.SetEhloName("client.domain.local")
+			return smtpSend(t, conn, message.RecipientPolicy{}, "alice@domain.local", "unknown@domain.local").SendMail(context.Background())
+		}, expectedPhase: types.RcptPhase, expectedCode: 550, expectedEnhancedCode: "5.1.1", expectedErrors: &[]error{errors.New("RCPT: 550"), errors.New("No such user")}},
+		{name: "rcpt result", send: func(t *testing.T) error {
+			conn := secureconnection.NewConnectNone(host, portNo)
+			conn.SetEhloName("client.domain.local")
+			s := smtpSend(t, conn, message.RecipientPolicy{SkipRejected: true}, "alice@domain.local", "busy@domain.local")
+			if err := s.SendMail(context.Background()); !errors.Is(err, ErrPartialDelivery) {
+				t.Errorf("Expected error %s, got %v", ErrPartialDelivery, err)
+			}
+			return s.GetResults()[1].Err
+		}, expectedPhase: types.RcptPhase, expectedCode: 450, expectedEnhancedCode: "4.2.1", expectedErrors: &[]error{errors.New("Mailbox busy")}},
+		{name: "too few accepted", send: func(t *testing.T) error {
+			conn := secureconnection.NewConnectNone(host, portNo)
+			conn.SetEhloName("client.domain.local")
+			return smtpSend(t, conn, message.RecipientPolicy{SkipRejected: true}, "unknown@domain.local").SendMail(context.Background())
+		}, expectedPhase: types.RcptPhase, expectedCode: 550, expectedEnhancedCode: "5.1.1", expectedErrors: &[]error{message.ErrTooFewAccepted}},
+		{name: "lmtp data result", send: func(t *testing.T) error {
+			s := lmtpSend(t, message.RecipientPolicy{}, "full@domain.local", "alice@domain.local")
+			if err := s.SendMail(context.Background()); !errors.Is(err, ErrPartialDelivery) {
+				t.Errorf("Expected error %s, got %v", ErrPartialDelivery, err)
+			}
+			return s.GetResults()[0].Err
+		}, expectedPhase: types.DataPhase, expectedCode: 452, expectedEnhancedCode: "4.2.2", expectedErrors: &[]error{errors.New("Mailbox full")}},
+		{name: "lmtp nothing delivered", send: func(t *testing.T) error {
+			return lmtpSend(t, message.RecipientPolicy{SkipRejected: true}, "unknown@domain.local").SendMail(context.Background())
+		}, expectedPhase: types.RcptPhase, expectedCode: 550, expectedEnhancedCode: "5.1.1", expectedErrors: &[]error{message.ErrTooFewAccepted, errors.New("No such user")}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.send(t)
+			if cont, err := checkError(err, c.expectedErrors); !cont && err != nil {
+				t.Fatal(err)
+			}
+			var smtpErr *SmtpError
+			if !errors.As(err, &smtpErr) {
+				t.Fatalf("Expected SmtpError, got %v", err)
+			}
+			if smtpErr.Phase != c.expectedPhase || smtpErr.Code != c.expectedCode || smtpErr.EnhancedCode != c.expectedEnhancedCode {
+				t.Errorf("Expected %s %d %q, got %s %d %q", c.expectedPhase, c.expectedCode, c.expectedEnhancedCode, smtpErr.Phase, smtpErr.Code, smtpErr.EnhancedCode)
+			}
+		})
+	}
+}
+
+func Test_EnhancedCode(t *testing.T) {
+	type codeCheck struct {
+		name     string
+		code     int
+		msg      string
+		expected string
+	}
+	checklist := []codeCheck{
+		{name: "permanent", code: 550, msg: "5.1.1 No such user", expected: "5.1.1"},
+		{name: "transient", code: 452, msg: "4.2.2 Mailbox full", expected: "4.2.2"},
+		{name: "three digits", code: 554, msg: "5.7.100 Rejected", expected: "5.7.100"},
+		{name: "multiline", code: 554, msg: "5.7.1 Rejected\nSee policy", expected: "5.7.1"},
+		{name: "no enhanced code", code: 421, msg: "Service not available", expected: ""},
+		{name: "class mismatch", code: 550, msg: "4.2.1 Mailbox busy", expected: ""},
+		{name: "too many digits", code: 550, msg: "5.1.1000 No such user", expected: ""},
+		{name: "not at start", code: 550, msg: "User 5.1.1", expected: ""},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			if got := enhancedCode(c.code, c.msg); got != c.expected {
+				t.Errorf("Expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
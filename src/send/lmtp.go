@@ -0,0 +1,143 @@
+package send
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/message"
+	"github.com/Sternisaea/gosend/src/secureconnection"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+// LmtpSend delivers a message into a mail store with LMTP. The server accepts or rejects the message for each recipient.
+type LmtpSend struct {
+	connection *secureconnection.ConnectLmtp
+	message    *message.Message
+	recipients message.RecipientPolicy
+	results    []message.RecipientResult
+}
+
+func NewLmtpSend(conn *secureconnection.ConnectLmtp) *LmtpSend {
+	return &LmtpSend{connection: conn}
+}
+
+// SetRecipientPolicy decides whether the message is sent to the accepted recipients when the server rejects others at RCPT
+func (s *LmtpSend) SetRecipientPolicy(policy message.RecipientPolicy) {
+	(*s).recipients = policy
+}
+
+func (s *LmtpSend) CreateMessage(st *cmdflags.Settings) error {
+	msg, err := createMessage(st)
+	if err != nil {
+		return err
+	}
+	if err := addDeliveryHeaders(msg, st); err != nil {
+		return err
+	}
+	(*s).message = msg
+	return nil
+}
+
+func (s *LmtpSend) CheckMessage() error {
+	var errMsgs []error
+	errMsgs = append(errMsgs, (*s).connection.Check())
+	errMsgs = append(errMsgs, (*s).message.CheckMessage())
+	return errors.Join(errMsgs...)
+}
+
+// SendMail delivers the message in one LMTP session. The outcome per recipient is available with GetResults.
+// Accepted recipients without error were only delivered when the message was sent, i.e. without error or with ErrPartialDelivery.
+func (s *LmtpSend) SendMail(ctx context.Context) error {
+	if err := s.CheckMessage(); err != nil {
+		return err
+	}
+	(*s).results = nil
+	if sent, err := s.deliver(ctx, (*s).message.GetRecipients()); err != nil {
+		failed := rejectedRecipients((*s).results)
+		if delivered := len((*s).results) - len(failed); sent && delivered > 0 {
+			// The session failed after the message was delivered to some recipients
+			return errors.Join(deliveryError(delivered, failed, nil), sessionError(ctx, err))
+		}
+		return sessionError(ctx, err)
+	}
+
+	failed := rejectedRecipients((*s).results)
+	return deliveryError(len((*s).results)-len(failed), failed, firstFailure((*s).results))
+}
+
+func (s *LmtpSend) GetResults() []message.RecipientResult {
+	return (*s).results
+}
+
+// deliver sets the result of every recipient that was tried, unless the session fails before RCPT, and reports whether the message was sent.
+// The message is not sent when the recipient policy rejects the replies to RCPT. When the session fails after DATA, the recipients without a reply get the error of the session.
+func (s *LmtpSend) deliver(ctx context.Context, recipients []string) (bool, error) {
+	content, err := (*s).message.GetContent()
+	if err != nil {
+		return false, err
+	}
+	client, close, err := (*s).connection.LmtpConnect(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer close()
+
+	if err := client.Mail((*s).message.GetSender()); err != nil {
+		return false, newSmtpError(types.MailPhase, err)
+	}
+	// The results are in the order of the recipients, the replies after DATA are in the order of the accepted recipients
+	results := make([]message.RecipientResult, 0, len(recipients))
+	var accepted []int
+	var firstErr error
+	for _, r := range recipients {
+		result := message.RecipientResult{Recipient: r}
+		if result.Code, result.Err = client.Rcpt(r); result.Err == nil {
+			accepted = append(accepted, len(results))
+			results = append(results, result)
+			continue
+		}
+		result.Err = newSmtpError(types.RcptPhase, result.Err)
+		results = append(results, result)
+		if firstErr == nil {
+			firstErr = result.Err
+		}
+		if !(*s).recipients.SkipRejected {
+			break
+		}
+	}
+	(*s).results = results
+
+	policyErr := firstErr
+	if (*s).recipients.SkipRejected || firstErr == nil {
+		if policyErr = (*s).recipients.CheckAccepted(len(accepted), len(recipients), firstErr); policyErr != nil {
+			policyErr = newSmtpError(types.RcptPhase, policyErr)
+		}
+	}
+	if policyErr != nil {
+		// The accepted recipients are dropped with the transaction, without accepted recipients DATA is not allowed
+		client.Reset()
+		return false, policyErr
+	}
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	codes, replies, err := client.Data(content, len(accepted))
+	for j, i := range accepted {
+		switch {
+		case j < len(codes):
+			results[i].Code = codes[j]
+			if replies[j] != nil {
+				results[i].Err = newSmtpError(types.DataPhase, replies[j])
+			}
+		case err != nil:
+			results[i].Code = 0
+			results[i].Err = newSmtpError(types.DataPhase, err)
+		}
+	}
+	if err != nil {
+		return true, newSmtpError(types.DataPhase, err)
+	}
+	return true, nil
+}
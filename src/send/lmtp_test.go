@@ -0,0 +1,298 @@
+package send
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/message"
+	"github.com/Sternisaea/gosend/src/secureconnection"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+func Test_LmtpSend(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "lmtp.sock")
+	unixServer, err := startMailServer("unix", socket)
+	if err != nil {
+		t.Fatalf("Cannot start LMTP server on unix socket: %s", err)
+	}
+	defer unixServer.stop()
+	tcpServer, err := startMailServer("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot start LMTP server on TCP port: %s", err)
+	}
+	defer tcpServer.stop()
+
+	type lmtpCheck struct {
+		name             string
+		server           *mailServer
+		address          string
+		to               []string
+		policy           message.RecipientPolicy
+		expectedTried    []string
+		expectedFailures []string
+		expectedData     bool
+		expectedErrors   *[]error
+	}
+	skipRejected := message.RecipientPolicy{SkipRejected: true}
+	checklist := []lmtpCheck{
+		{name: "unix socket", server: unixServer, address: "unix:" + socket, to: []string{"alice@domain.local", "bob@domain.local"}, expectedData: true},
+		{name: "tcp", server: tcpServer, address: tcpServer.address, to: []string{"alice@domain.local"}, expectedData: true},
+		{name: "unknown recipient", server: unixServer, address: "unix:" + socket, to: []string{"alice@domain.local", "unknown@domain.local"}, policy: skipRejected, expectedFailures: []string{"unknown@domain.local"}, expectedData: true, expectedErrors: &[]error{ErrPartialDelivery, errors.New("unknown@domain.local")}},
+		{name: "mailbox full", server: unixServer, address: "unix:" + socket, to: []string{"full@domain.local", "alice@domain.local"}, expectedFailures: []string{"full@domain.local"}, expectedData: true, expectedErrors: &[]error{ErrPartialDelivery, errors.New("full@domain.local")}},
+		{name: "unknown and full", server: tcpServer, address: tcpServer.address, to: []string{"unknown@domain.local", "full@domain.local", "alice@domain.local"}, policy: skipRejected, expectedFailures: []string{"unknown@domain.local", "full@domain.local"}, expectedData: true, expectedErrors: &[]error{ErrPartialDelivery}},
+		{name: "connection lost after data", server: tcpServer, address: tcpServer.address, to: []string{"alice@domain.local", "full@domain.local", "drop@domain.local", "bob@domain.local"}, expectedFailures: []string{"full@domain.local", "drop@domain.local", "bob@domain.local"}, expectedData: true, expectedErrors: &[]error{ErrPartialDelivery, errors.New("DATA: EOF")}},
+		{name: "fail fast", server: unixServer, address: "unix:" + socket, to: []string{"alice@domain.local", "unknown@domain.local", "bob@domain.local"}, expectedTried: []string{"alice@domain.local", "unknown@domain.local"}, expectedFailures: []string{"unknown@domain.local"}, expectedErrors: &[]error{errors.New("RCPT: 550"), errors.New("No such user")}},
+		{name: "too few accepted", server: tcpServer, address: tcpServer.address, to: []string{"alice@domain.local", "unknown@domain.local", "bob@domain.local"}, policy: message.RecipientPolicy{SkipRejected: true, MinAccepted: 3}, expectedFailures: []string{"unknown@domain.local"}, expectedErrors: &[]error{message.ErrTooFewAccepted, errors.New("2 of 3, 3 required")}},
+		{name: "no recipient accepted", server: unixServer, address: "unix:" + socket, to: []string{"unknown@domain.local"}, policy: skipRejected, expectedFailures: []string{"unknown@domain.local"}, expectedErrors: &[]error{message.ErrTooFewAccepted}},
+		{name: "no server", address: "unix:" + filepath.Join(t.TempDir(), "missing.sock"), to: []string{"alice@domain.local"}, expectedErrors: &[]error{errors.New("no such file")}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			var address types.LmtpAddress
+			if err := address.Set(c.address); err != nil {
+				t.Fatal(err)
+			}
+			st := &cmdflags.Settings{
+				Sender:      types.Email(mail.Address{Address: "sender@domain.local"}),
+				Subject:     c.name,
+				BodyText:    "LMTP",
+				LmtpAddress: address,
+			}
+			for _, to := range c.to {
+				st.RecipientsTo = append(st.RecipientsTo, types.Email(mail.Address{Address: to}))
+			}
+			conn, err := secureconnection.GetLmtpConnection(st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetEhloName("client.domain.local")
+			s := NewLmtpSend(conn)
+			s.SetRecipientPolicy(c.policy)
+			if err := s.CreateMessage(st); err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.SendMail(context.Background())
+			if c.server != nil {
+				if got := c.server.lastData(); strings.Contains(got, "Subject: "+c.name) != c.expectedData {
+					t.Errorf("Expected message delivered %t, got %q", c.expectedData, got)
+				}
+			}
+			if cont, err := checkError(err, c.expectedErrors); !cont {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c.server == nil {
+					return
+				}
+			}
+
+			tried := c.expectedTried
+			if tried == nil {
+				tried = c.to
+			}
+			results := s.GetResults()
+			if len(results) != len(tried) {
+				t.Fatalf("Expected %d results, got %d", len(tried), len(results))
+			}
+			var failures []string
+			for i, r := range results {
+				if r.Recipient != tried[i] {
+					t.Errorf("Expected result for %s, got %s", tried[i], r.Recipient)
+				}
+				if r.Err != nil {
+					failures = append(failures, r.Recipient)
+				}
+			}
+			if !reflect.DeepEqual(failures, c.expectedFailures) {
+				t.Errorf("Expected failures %v, got %v", c.expectedFailures, failures)
+			}
+		})
+	}
+}
+
+func Test_LmtpSecurity(t *testing.T) {
+	st := &cmdflags.Settings{Security: types.StartTlsSec, LmtpAddress: "unix:/run/lmtp"}
+	if _, err := secureconnection.GetLmtpConnection(st); !errors.Is(err, secureconnection.ErrLmtpSecurity) {
+		t.Errorf("Expected error %s, got %v", secureconnection.ErrLmtpSecurity, err)
+	}
+}
+
+// mailServer is an LMTP and SMTP stand-in. Recipients starting with "unknown" or "busy" are rejected at RCPT,
+// recipients starting with "full" after DATA with LMTP. The connection is dropped after DATA for a recipient starting with "drop", with LMTP at its reply. DSN is offered to clients with an EHLO name starting with "dsn".
+// With a TLS configuration STARTTLS and AUTH are offered, and every AUTH command is recorded.
+type mailServer struct {
+	address   string
+	stop      func() error
+	mu        sync.Mutex
+	tlsConfig *tls.Config
+	data      string
+	envelope  []string
+	auth      []string
+}
+
+func startMailServer(network string, address string) (*mailServer, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s := &mailServer{address: listener.Addr().String(), stop: listener.Close}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+// setTls offers STARTTLS and AUTH with config
+func (s *mailServer) setTls(config *tls.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tlsConfig = config
+}
+
+// authCommands returns the AUTH commands received by the server
+func (s *mailServer) authCommands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.auth
+}
+
+// lastData returns the message of the last transaction, or an empty string when DATA was not sent
+func (s *mailServer) lastData() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data
+}
+
+// lastEnvelope returns the MAIL and RCPT commands of the last transaction
+func (s *mailServer) lastEnvelope() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.envelope
+}
+
+func (s *mailServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "220 Mail Server ready\r\n")
+	reader := bufio.NewReader(conn)
+	var recipients []string
+	lmtp := false
+	s.mu.Lock()
+	config := s.tlsConfig
+	s.mu.Unlock()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(strings.ToUpper(line), "RCPT TO:") {
+			s.mu.Lock()
+			s.envelope = append(s.envelope, line)
+			s.mu.Unlock()
+		}
+		switch cmd := strings.ToUpper(line); {
+		case strings.HasPrefix(cmd, "LHLO"):
+			lmtp = true
+			fmt.Fprintf(conn, "250-LMTP Server\r\n250-8BITMIME\r\n250 ENHANCEDSTATUSCODES\r\n")
+		case strings.HasPrefix(cmd, "EHLO") && config != nil:
+			if _, ok := conn.(*tls.Conn); !ok {
+				fmt.Fprintf(conn, "250-SMTP Server\r\n250-STARTTLS\r\n250 AUTH PLAIN\r\n")
+			} else {
+				fmt.Fprintf(conn, "250-SMTP Server\r\n250 AUTH PLAIN\r\n")
+			}
+		case cmd == "STARTTLS" && config != nil:
+			fmt.Fprintf(conn, "220 2.0.0 Ready to start TLS\r\n")
+			tlsConn := tls.Server(conn, config)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, reader = tlsConn, bufio.NewReader(tlsConn)
+		case strings.HasPrefix(cmd, "AUTH"):
+			s.mu.Lock()
+			s.auth = append(s.auth, line)
+			s.mu.Unlock()
+			fmt.Fprintf(conn, "235 2.7.0 Authentication successful\r\n")
+		case strings.HasPrefix(cmd, "EHLO DSN"):
+			fmt.Fprintf(conn, "250-SMTP Server\r\n250-DSN\r\n250 ENHANCEDSTATUSCODES\r\n")
+		case strings.HasPrefix(cmd, "EHLO"):
+			fmt.Fprintf(conn, "250-SMTP Server\r\n250 ENHANCEDSTATUSCODES\r\n")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			recipients = nil
+			s.mu.Lock()
+			s.data = ""
+			s.envelope = []string{line}
+			s.mu.Unlock()
+			fmt.Fprintf(conn, "250 2.1.0 OK\r\n")
+		case strings.HasPrefix(cmd, "RCPT TO:<UNKNOWN"):
+			fmt.Fprintf(conn, "550 5.1.1 No such user\r\n")
+		case strings.HasPrefix(cmd, "RCPT TO:<BUSY"):
+			fmt.Fprintf(conn, "450 4.2.1 Mailbox busy\r\n")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			recipients = append(recipients, strings.TrimPrefix(cmd, "RCPT TO:"))
+			fmt.Fprintf(conn, "250 2.1.5 OK\r\n")
+		case cmd == "DATA":
+			if len(recipients) == 0 {
+				fmt.Fprintf(conn, "503 5.5.1 No valid recipients\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "354 Start mail input\r\n")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.mu.Lock()
+			s.data = data.String()
+			s.mu.Unlock()
+			if !lmtp {
+				if slices.ContainsFunc(recipients, func(r string) bool { return strings.HasPrefix(r, "<DROP") }) {
+					return
+				}
+				fmt.Fprintf(conn, "250 2.0.0 Queued\r\n")
+				continue
+			}
+			for _, r := range recipients {
+				if strings.HasPrefix(r, "<DROP") {
+					return
+				} else if strings.HasPrefix(r, "<FULL") {
+					fmt.Fprintf(conn, "452 4.2.2 Mailbox full\r\n")
+				} else {
+					fmt.Fprintf(conn, "250 2.1.5 Delivered\r\n")
+				}
+			}
+		case cmd == "RSET":
+			recipients = nil
+			fmt.Fprintf(conn, "250 2.0.0 OK\r\n")
+		case cmd == "QUIT":
+			fmt.Fprintf(conn, "221 2.0.0 Bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "500 5.5.1 Unknown command\r\n")
+		}
+	}
+}
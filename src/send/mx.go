@@ -0,0 +1,299 @@
+package send
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/message"
+	"github.com/Sternisaea/gosend/src/secureconnection"
+)
+
+const MxPort = 25
+
+var (
+	ErrNullMx           = errors.New("domain does not accept mail (null MX)")
+	ErrInvalidRecipient = errors.New("invalid recipient address")
+	ErrDeliveryFailed   = errors.New("delivery failed")
+)
+
+// DomainResult is the outcome of the delivery to the recipients of one domain
+type DomainResult struct {
+	Domain     string
+	Recipients []string
+	Host       string // MX host that accepted the message, or the last host tried
+	Tls        bool
+	StsMode    string                    // Mode of the MTA-STS policy of the domain, if any
+	Results    []message.RecipientResult // Replies to RCPT of Host
+	Err        error
+}
+
+// MxSend delivers a message directly to the MX hosts of the recipient domains, without an SMTP relay
+type MxSend struct {
+	port       int
+	policy     secureconnection.TlsPolicy
+	stsCache   *secureconnection.StsCache
+	proxy      *secureconnection.Proxy
+	timeouts   secureconnection.Timeouts
+	source     secureconnection.Source
+	ehloName   string
+	recipients message.RecipientPolicy
+	message    *message.Message
+	results    []DomainResult
+	log        func(format string, v ...any)
+}
+
+// NewMxSend creates a delivery to the MX hosts on port, or on port 25 when port is 0
+func NewMxSend(port int, policy secureconnection.TlsPolicy) *MxSend {
+	if port == 0 {
+		port = MxPort
+	}
+	return &MxSend{port: port, policy: policy}
+}
+
+// SetLogger sets the function that reports problems that do not stop the delivery, e.g. log.Printf
+func (s *MxSend) SetLogger(log func(format string, v ...any)) {
+	(*s).log = log
+}
+
+// SetStsCache enables MTA-STS (RFC 8461): the policies of the recipient domains are retrieved and kept in cache
+func (s *MxSend) SetStsCache(cache *secureconnection.StsCache) {
+	(*s).stsCache = cache
+}
+
+// SetProxy delivers through a proxy, which must allow connections to port 25
+func (s *MxSend) SetProxy(proxy *secureconnection.Proxy) {
+	(*s).proxy = proxy
+}
+
+// SetTimeouts limits connecting to each MX host and every command of the sessions
+func (s *MxSend) SetTimeouts(timeouts secureconnection.Timeouts) {
+	(*s).timeouts = timeouts
+}
+
+// SetSource sets the local address and IP version of the connections to the MX hosts
+func (s *MxSend) SetSource(source secureconnection.Source) {
+	(*s).source = source
+}
+
+// SetEhloName sets the name sent with EHLO to the MX hosts, or the default name when empty
+func (s *MxSend) SetEhloName(name string) {
+	(*s).ehloName = name
+}
+
+// SetRecipientPolicy decides whether the message is sent to the accepted recipients of a domain when its MX host rejects others
+func (s *MxSend) SetRecipientPolicy(policy message.RecipientPolicy) {
+	(*s).recipients = policy
+}
+
+func (s *MxSend) CreateMessage(st *cmdflags.Settings) error {
+	msg, err := createMessage(st)
+	if err != nil {
+		return err
+	}
+	if err := addDeliveryHeaders(msg, st); err != nil {
+		return err
+	}
+	(*s).message = msg
+	return nil
+}
+
+// addDeliveryHeaders adds Message-ID and Date when missing. Without a submission server nobody adds these headers on the way.
+func addDeliveryHeaders(msg *message.Message, st *cmdflags.Settings) error {
+	if st.MessageID == "" {
+		id, err := newMessageId(st.Sender.GetMailAddress().Address)
+		if err != nil {
+			return err
+		}
+		msg.SetMessageId(id)
+	}
+	hasDate := false
+	for _, h := range st.Headers {
+		hasDate = hasDate || strings.HasPrefix(strings.ToLower(h.String()), "date:")
+	}
+	if !hasDate {
+		msg.AddCustomHeader("Date: " + time.Now().Format(time.RFC1123Z))
+	}
+	return nil
+}
+
+func (s *MxSend) CheckMessage() error {
+	var errMsgs []error
+	errMsgs = append(errMsgs, (*s).policy.Check())
+	errMsgs = append(errMsgs, (*s).source.Check())
+	errMsgs = append(errMsgs, (*s).message.CheckMessage())
+	for _, r := range (*s).message.GetRecipients() {
+		if _, err := getDomain(r); err != nil {
+			errMsgs = append(errMsgs, err)
+		}
+	}
+	return errors.Join(errMsgs...)
+}
+
+// SendMail delivers the message to every recipient domain. The outcome per domain is available with GetResults.
+func (s *MxSend) SendMail(ctx context.Context) error {
+	if err := s.CheckMessage(); err != nil {
+		return err
+	}
+
+	domains, recipients := groupByDomain((*s).message.GetRecipients())
+	(*s).results = make([]DomainResult, 0, len(domains))
+	delivered := 0
+	var failed []string
+	var cause error
+	for _, domain := range domains {
+		result := s.deliverDomain(ctx, domain, recipients[domain])
+		if result.Err != nil {
+			failed = append(failed, result.Recipients...)
+			cause = cmp.Or(cause, result.Err)
+		} else {
+			rejected := rejectedRecipients(result.Results)
+			delivered += len(result.Recipients) - len(rejected)
+			failed = append(failed, rejected...)
+			cause = cmp.Or(cause, firstFailure(result.Results))
+		}
+		(*s).results = append((*s).results, result)
+	}
+	return deliveryError(delivered, failed, cause)
+}
+
+func (s *MxSend) GetResults() []DomainResult {
+	return (*s).results
+}
+
+func (s *MxSend) deliverDomain(ctx context.Context, domain string, recipients []string) DomainResult {
+	result := DomainResult{Domain: domain, Recipients: recipients}
+	hosts, err := lookupMxHosts(domain)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	var sts *secureconnection.StsPolicy
+	if (*s).stsCache != nil {
+		// Without a policy, e.g. when it cannot be fetched and is not in cache, the delivery continues as usual (RFC 8461 section 5)
+		if sts, err = (*s).stsCache.GetPolicy(domain); err != nil {
+			s.logf("Warning: %s: %s", domain, err)
+		}
+		if sts != nil {
+			result.StsMode = (*sts).Mode
+		}
+	}
+	if hosts, result.Err = sts.FilterHosts(hosts); result.Err != nil {
+		return result
+	}
+	return s.deliverHosts(ctx, result, hosts, sts)
+}
+
+func (s *MxSend) logf(format string, v ...any) {
+	if (*s).log != nil {
+		(*s).log(format, v...)
+	}
+}
+
+// deliverHosts tries the hosts in order until one accepts the message. A permanent rejection (5xx) or an aborted session ends the delivery for the domain.
+// So does a session that failed in the DATA phase without a reply, as the host may have delivered the message already.
+func (s *MxSend) deliverHosts(ctx context.Context, result DomainResult, hosts []string, sts *secureconnection.StsPolicy) DomainResult {
+	for _, host := range hosts {
+		result.Host = host
+		result.Tls, result.Results, result.Err = s.deliverHost(ctx, host, result.Recipients, sts)
+		if result.Err != nil {
+			result.Err = sessionError(ctx, result.Err)
+		}
+		if result.Err == nil || isPermanent(result.Err) || isLostInData(result.Err) || ctx.Err() != nil {
+			break
+		}
+	}
+	return result
+}
+
+func (s *MxSend) deliverHost(ctx context.Context, host string, recipients []string, sts *secureconnection.StsPolicy) (bool, []message.RecipientResult, error) {
+	policy, err := sts.Apply(host, (*s).policy)
+	if err != nil {
+		return false, nil, err
+	}
+	conn := secureconnection.NewConnectOpportunistic(host, (*s).port, policy)
+	conn.SetSkipVerify(true)
+	conn.SetProxy((*s).proxy)
+	conn.SetTimeouts((*s).timeouts)
+	conn.SetSource((*s).source)
+	conn.SetEhloName((*s).ehloName)
+	client, close, _, err := conn.ClientConnect(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	defer close()
+
+	_, tls := client.TLSConnectionState()
+	results, err := (*s).message.SendContentTo(ctx, client, recipients, (*s).recipients)
+	results = smtpResults(results)
+	return tls, results, err
+}
+
+// lookupMxHosts returns the MX hosts of domain in order of preference. Without MX records the domain itself is used (RFC 5321 section 5.1).
+func lookupMxHosts(domain string) ([]string, error) {
+	mxs, err := net.LookupMX(domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return []string{domain}, nil
+		}
+		return nil, err
+	}
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, fmt.Errorf("%w: %s", ErrNullMx, domain)
+	}
+
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// groupByDomain returns the recipient domains in order of appearance and the recipients per domain
+func groupByDomain(recipients []string) ([]string, map[string][]string) {
+	var domains []string
+	grouped := make(map[string][]string)
+	for _, r := range recipients {
+		domain, err := getDomain(r)
+		if err != nil {
+			continue
+		}
+		if _, ok := grouped[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		grouped[domain] = append(grouped[domain], r)
+	}
+	return domains, grouped
+}
+
+func getDomain(address string) (string, error) {
+	i := strings.LastIndex(address, "@")
+	if i < 0 || i == len(address)-1 {
+		return "", fmt.Errorf("%w: %s", ErrInvalidRecipient, address)
+	}
+	return strings.ToLower(address[i+1:]), nil
+}
+
+func newMessageId(sender string) (string, error) {
+	domain, err := getDomain(sender)
+	if err != nil {
+		domain = "localhost"
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(random), domain), nil
+}
@@ -0,0 +1,380 @@
+package send
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sternisaea/dnsservermock/src/dnsconst"
+	"github.com/Sternisaea/dnsservermock/src/dnsservermock"
+	"github.com/Sternisaea/dnsservermock/src/dnsstorage/dnsstoragememory"
+	"github.com/Sternisaea/gosend/src/certificates"
+	"github.com/Sternisaea/gosend/src/message"
+	"github.com/Sternisaea/gosend/src/secureconnection"
+	"github.com/Sternisaea/gosend/src/types"
+	"github.com/Sternisaea/smtpservermock/src/smtpservermock"
+)
+
+var (
+	dnsIP         = "127.0.0.1"
+	dnsPort       = types.TCPPort(5356)
+	smtpMxPort    = types.TCPPort(40981)
+	smtpNoTlsPort = types.TCPPort(40982)
+
+	ErrNoSuchHost = errors.New("no such host")
+)
+
+func Test_MxSend(t *testing.T) {
+	cancelDns, err := startDns(net.ParseIP(dnsIP), int(dnsPort))
+	if err != nil {
+		t.Fatalf("Cannot start DNS server: %s", err)
+	}
+	defer cancelDns()
+	setDefaultResolver(fmt.Sprintf("%s:%d", dnsIP, dnsPort))
+
+	cert, key, err := certificates.CreateCertificate("Domain Local", "mail.domain.local")
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	defer os.Remove(key)
+	defer os.Remove(cert)
+
+	mockStarttls, err := smtpservermock.NewSmtpServer(smtpservermock.StartTlsSec, "Mock MX with STARTTLS", getAddress("localhost", smtpMxPort), cert, key)
+	if err != nil {
+		t.Fatalf("Cannot initialise SMTP server with STARTTLS: %s", err)
+	}
+	if err := mockStarttls.ListenAndServe(); err != nil {
+		t.Fatalf("Cannot start SMTP server with STARTTLS: %s", err)
+	}
+	defer mockStarttls.Shutdown()
+
+	mockNoTls, err := smtpservermock.NewSmtpServer(smtpservermock.NoSecurity, "Mock MX without security", getAddress("localhost", smtpNoTlsPort), "", "")
+	if err != nil {
+		t.Fatalf("Cannot initialise SMTP server without security: %s", err)
+	}
+	if err := mockNoTls.ListenAndServe(); err != nil {
+		t.Fatalf("Cannot start SMTP server without security: %s", err)
+	}
+	defer mockNoTls.Shutdown()
+
+	rsaOnly := secureconnection.TlsPolicy{MaxVersion: tls.VersionTLS12, Ciphers: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}
+
+	type mxCheck struct {
+		name            string
+		port            types.TCPPort
+		policy          secureconnection.TlsPolicy
+		to, bcc         []mail.Address
+		expectedErrors  *[]error
+		expectedResults []DomainResult
+	}
+	checklist := []mxCheck{
+		{
+			name: "mx and implicit mx",
+			port: smtpMxPort,
+			to:   []mail.Address{{Address: "alice@domain.local"}, {Address: "carol@other.local"}},
+			bcc:  []mail.Address{{Address: "bob@Domain.Local"}},
+			expectedResults: []DomainResult{
+				{Domain: "domain.local", Recipients: []string{"alice@domain.local", "bob@Domain.Local"}, Host: "mail.domain.local", Tls: true},
+				{Domain: "other.local", Recipients: []string{"carol@other.local"}, Host: "other.local", Tls: true},
+			},
+		},
+		{
+			name:           "unknown domain",
+			port:           smtpMxPort,
+			to:             []mail.Address{{Address: "alice@domain.local"}, {Address: "dave@missing.local"}},
+			expectedErrors: &[]error{ErrPartialDelivery, errors.New("dave@missing.local")},
+			expectedResults: []DomainResult{
+				{Domain: "domain.local", Recipients: []string{"alice@domain.local"}, Host: "mail.domain.local", Tls: true},
+				{Domain: "missing.local", Recipients: []string{"dave@missing.local"}, Host: "missing.local", Err: ErrNoSuchHost},
+			},
+		},
+		{
+			name: "no starttls",
+			port: smtpNoTlsPort,
+			to:   []mail.Address{{Address: "alice@domain.local"}},
+			expectedResults: []DomainResult{
+				{Domain: "domain.local", Recipients: []string{"alice@domain.local"}, Host: "mail.domain.local", Tls: false},
+			},
+		},
+		{
+			// After the failed handshake the delivery continues without TLS, which this server refuses
+			name:           "failed handshake",
+			port:           smtpMxPort,
+			policy:         rsaOnly,
+			to:             []mail.Address{{Address: "alice@domain.local"}},
+			expectedErrors: &[]error{ErrDeliveryFailed},
+			expectedResults: []DomainResult{
+				{Domain: "domain.local", Recipients: []string{"alice@domain.local"}, Host: "mail.domain.local", Tls: false, Err: errors.New("530")},
+			},
+		},
+		{
+			name:           "no starttls with dane",
+			port:           smtpNoTlsPort,
+			policy:         secureconnection.TlsPolicy{Verify: types.DaneVerify},
+			to:             []mail.Address{{Address: "alice@domain.local"}},
+			expectedErrors: &[]error{ErrDeliveryFailed},
+			expectedResults: []DomainResult{
+				{Domain: "domain.local", Recipients: []string{"alice@domain.local"}, Host: "mail.domain.local", Err: secureconnection.ErrStarttlsNotSupported},
+			},
+		},
+	}
+
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			msg := message.NewMessage()
+			msg.SetSender(mail.Address{Address: "sender@domain.local"})
+			msg.SetRecipientTo(c.to)
+			msg.SetRecipientBCC(c.bcc)
+			msg.SetSubject(c.name)
+			msg.SetBodyPlainText("Direct delivery")
+
+			mx := NewMxSend(int(c.port), c.policy)
+			(*mx).message = msg
+			if cont, err := checkError(mx.SendMail(context.Background()), c.expectedErrors); !cont && err != nil {
+				t.Fatal(err, mx.GetResults())
+			}
+			checkResults(t, mx.GetResults(), c.expectedResults)
+		})
+	}
+}
+
+func Test_MxFailover(t *testing.T) {
+	cancelDns, err := startDns(net.ParseIP(dnsIP), int(dnsPort))
+	if err != nil {
+		t.Fatalf("Cannot start DNS server: %s", err)
+	}
+	defer cancelDns()
+	setDefaultResolver(fmt.Sprintf("%s:%d", dnsIP, dnsPort))
+
+	mock, err := smtpservermock.NewSmtpServer(smtpservermock.NoSecurity, "Mock MX without security", getAddress("localhost", smtpNoTlsPort), "", "")
+	if err != nil {
+		t.Fatalf("Cannot initialise SMTP server without security: %s", err)
+	}
+	if err := mock.ListenAndServe(); err != nil {
+		t.Fatalf("Cannot start SMTP server without security: %s", err)
+	}
+	defer mock.Shutdown()
+
+	msg := message.NewMessage()
+	msg.SetSender(mail.Address{Address: "sender@domain.local"})
+	msg.SetRecipientTo([]mail.Address{{Address: "alice@domain.local"}})
+	msg.SetSubject("Failover")
+	mx := NewMxSend(int(smtpNoTlsPort), secureconnection.TlsPolicy{})
+	(*mx).message = msg
+
+	domain := DomainResult{Domain: "domain.local", Recipients: []string{"alice@domain.local"}}
+	result := mx.deliverHosts(context.Background(), domain, []string{"missing.local", "mail.domain.local"}, nil)
+	checkResults(t, []DomainResult{result}, []DomainResult{{Domain: "domain.local", Recipients: []string{"alice@domain.local"}, Host: "mail.domain.local"}})
+
+	result = mx.deliverHosts(context.Background(), domain, []string{"mail.domain.local", "missing.local"}, nil)
+	checkResults(t, []DomainResult{result}, []DomainResult{{Domain: "domain.local", Recipients: []string{"alice@domain.local"}, Host: "mail.domain.local"}})
+
+	// The next host is not tried when the connection is lost after the message data, as the message may have been delivered
+	server, err := startMailServer("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot start SMTP server: %s", err)
+	}
+	defer server.stop()
+	_, port, _ := net.SplitHostPort(server.address)
+	portNo, _ := strconv.Atoi(port)
+	msg.SetRecipientTo([]mail.Address{{Address: "drop@domain.local"}})
+	mx = NewMxSend(portNo, secureconnection.TlsPolicy{})
+	(*mx).message = msg
+
+	domain = DomainResult{Domain: "domain.local", Recipients: []string{"drop@domain.local"}}
+	result = mx.deliverHosts(context.Background(), domain, []string{"mail.domain.local", "other.local"}, nil)
+	checkResults(t, []DomainResult{result}, []DomainResult{{Domain: "domain.local", Recipients: []string{"drop@domain.local"}, Host: "mail.domain.local", Err: io.EOF}})
+	var smtpErr *SmtpError
+	if !errors.As(result.Err, &smtpErr) || (*smtpErr).Phase != types.DataPhase {
+		t.Errorf("Expected error in phase %s, got %v", types.DataPhase, result.Err)
+	}
+}
+
+func Test_MxSts(t *testing.T) {
+	cancelDns, err := startDns(net.ParseIP(dnsIP), int(dnsPort))
+	if err != nil {
+		t.Fatalf("Cannot start DNS server: %s", err)
+	}
+	defer cancelDns()
+	setDefaultResolver(fmt.Sprintf("%s:%d", dnsIP, dnsPort))
+
+	cert, key, err := certificates.CreateCertificate("Domain Local", "mail.domain.local")
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	defer os.Remove(key)
+	defer os.Remove(cert)
+
+	mock, err := smtpservermock.NewSmtpServer(smtpservermock.StartTlsSec, "Mock MX with STARTTLS", getAddress("localhost", smtpMxPort), cert, key)
+	if err != nil {
+		t.Fatalf("Cannot initialise SMTP server with STARTTLS: %s", err)
+	}
+	if err := mock.ListenAndServe(); err != nil {
+		t.Fatalf("Cannot start SMTP server with STARTTLS: %s", err)
+	}
+	defer mock.Shutdown()
+
+	// The DNS mock has no _mta-sts TXT records, so the cached policies remain in use until they expire
+	type stsCheck struct {
+		name            string
+		mode            string
+		mx              string
+		policy          secureconnection.TlsPolicy
+		expectedErrors  *[]error
+		expectedResults []DomainResult
+	}
+	checklist := []stsCheck{
+		{
+			name:            "testing without verification",
+			mode:            secureconnection.StsTesting,
+			mx:              "*.other.local",
+			expectedResults: []DomainResult{{Domain: "domain.local", Recipients: []string{"alice@domain.local"}, Host: "mail.domain.local", Tls: true}},
+		},
+		{
+			name:            "enforce with unknown certificate authority",
+			mode:            secureconnection.StsEnforce,
+			mx:              "mail.domain.local",
+			expectedErrors:  &[]error{ErrDeliveryFailed},
+			expectedResults: []DomainResult{{Domain: "domain.local", Recipients: []string{"alice@domain.local"}, Host: "mail.domain.local", Err: errors.New("certificate signed by unknown authority")}},
+		},
+		{
+			name:            "enforce with root ca",
+			mode:            secureconnection.StsEnforce,
+			mx:              "*.domain.local",
+			policy:          secureconnection.TlsPolicy{RootCaPath: cert},
+			expectedResults: []DomainResult{{Domain: "domain.local", Recipients: []string{"alice@domain.local"}, Host: "mail.domain.local", Tls: true}},
+		},
+		{
+			name:            "enforce without matching mx",
+			mode:            secureconnection.StsEnforce,
+			mx:              "mx.other.local",
+			expectedErrors:  &[]error{ErrDeliveryFailed},
+			expectedResults: []DomainResult{{Domain: "domain.local", Recipients: []string{"alice@domain.local"}, Err: secureconnection.ErrStsNoMatchingMx}},
+		},
+	}
+
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mta-sts.json")
+			content := fmt.Sprintf(`{"domain.local": {"id": "1", "mode": %q, "mx": [%q], "max_age": 3600, "expires": %q}}`, c.mode, c.mx, time.Now().Add(time.Hour).Format(time.RFC3339))
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatalf("Cannot write cache: %s", err)
+			}
+			cache, err := secureconnection.LoadStsCache(path)
+			if err != nil {
+				t.Fatalf("Cannot load cache: %s", err)
+			}
+
+			msg := message.NewMessage()
+			msg.SetSender(mail.Address{Address: "sender@domain.local"})
+			msg.SetRecipientTo([]mail.Address{{Address: "alice@domain.local"}})
+			msg.SetSubject(c.name)
+			mx := NewMxSend(int(smtpMxPort), c.policy)
+			mx.SetStsCache(cache)
+			(*mx).message = msg
+			if cont, err := checkError(mx.SendMail(context.Background()), c.expectedErrors); !cont && err != nil {
+				t.Fatal(err, mx.GetResults())
+			}
+			checkResults(t, mx.GetResults(), c.expectedResults)
+			if results := mx.GetResults(); len(results) == 1 && results[0].StsMode != c.mode {
+				t.Errorf("Expected MTA-STS mode %s, got %s", c.mode, results[0].StsMode)
+			}
+		})
+	}
+}
+
+func Test_GroupByDomain(t *testing.T) {
+	domains, grouped := groupByDomain([]string{"a@B.example", "c@a.example", "d@b.example", "invalid"})
+	if !slices.Equal(domains, []string{"b.example", "a.example"}) {
+		t.Errorf("Expected domains %v, got %v", []string{"b.example", "a.example"}, domains)
+	}
+	expected := map[string][]string{"b.example": {"a@B.example", "d@b.example"}, "a.example": {"c@a.example"}}
+	if !reflect.DeepEqual(grouped, expected) {
+		t.Errorf("Expected %v, got %v", expected, grouped)
+	}
+}
+
+func checkResults(t *testing.T, results, expected []DomainResult) {
+	t.Helper()
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %d: %v", len(expected), len(results), results)
+	}
+	for i, r := range results {
+		exp := expected[i]
+		if r.Domain != exp.Domain || r.Host != exp.Host || r.Tls != exp.Tls || !slices.Equal(r.Recipients, exp.Recipients) {
+			t.Errorf("Expected result %v, got %v", exp, r)
+		}
+		if cont, err := checkError(r.Err, errorList(exp.Err)); !cont && err != nil {
+			t.Errorf("%s: %s", r.Domain, err)
+		}
+	}
+}
+
+func errorList(err error) *[]error {
+	if err == nil {
+		return nil
+	}
+	return &[]error{err}
+}
+
+func checkError(occuredErr error, expectedErr *[]error) (bool, error) {
+	if expectedErr == nil || len(*expectedErr) == 0 {
+		if occuredErr != nil {
+			return false, fmt.Errorf("Expected no error, got %s", occuredErr)
+		}
+	} else {
+		if occuredErr == nil {
+			return false, fmt.Errorf("Expected errors %s, got no error", errors.Join(*expectedErr...))
+		}
+		for _, exp := range *expectedErr {
+			if !strings.Contains(occuredErr.Error(), exp.Error()) {
+				return false, fmt.Errorf("Expected error %s, got %s", exp, occuredErr)
+			}
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+func startDns(ip net.IP, port int) (func() error, error) {
+	store := dnsstoragememory.NewMemoryStore()
+	(*store).Set("domain.local", dnsconst.Type_A, "127.0.0.1")
+	(*store).Set("mail.domain.local", dnsconst.Type_A, "127.0.0.1")
+	(*store).Set("domain.local", dnsconst.Type_MX, "mail.domain.local")
+	(*store).Set("other.local", dnsconst.Type_A, "127.0.0.1")
+
+	ds := dnsservermock.NewDnsServer(ip, port, store)
+	if err := (*ds).Start(); err != nil {
+		return nil, err
+	}
+	return (*ds).Stop, nil
+}
+
+func setDefaultResolver(dnsAddress string) {
+	cr := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := net.Dialer{
+				Timeout: time.Second,
+			}
+			return d.DialContext(ctx, "udp", dnsAddress)
+		},
+	}
+	net.DefaultResolver = cr
+}
+
+func getAddress(host string, port types.TCPPort) string {
+	return net.JoinHostPort(host, port.String())
+}
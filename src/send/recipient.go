@@ -0,0 +1,43 @@
+package send
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/message"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+// The message was delivered to some recipients, but not to all
+var ErrPartialDelivery = fmt.Errorf("%w for part of the recipients", ErrDeliveryFailed)
+
+func GetRecipientPolicy(st *cmdflags.Settings) message.RecipientPolicy {
+	return message.RecipientPolicy{SkipRejected: st.RecipientPolicy == types.SkipRejectedPolicy, MinAccepted: int(st.MinAccepted)}
+}
+
+// deliveryError returns ErrPartialDelivery with the failed recipients when others were delivered,
+// or ErrDeliveryFailed with cause, the failure of the first recipient, when none was delivered
+func deliveryError(delivered int, failed []string, cause error) error {
+	switch {
+	case len(failed) == 0:
+		return nil
+	case delivered > 0:
+		return fmt.Errorf("%w: %s", ErrPartialDelivery, strings.Join(failed, ", "))
+	case cause != nil:
+		return fmt.Errorf("%w: %s: %w", ErrDeliveryFailed, strings.Join(failed, ", "), cause)
+	default:
+		return fmt.Errorf("%w: %s", ErrDeliveryFailed, strings.Join(failed, ", "))
+	}
+}
+
+// rejectedRecipients returns the recipients that were not accepted
+func rejectedRecipients(results []message.RecipientResult) []string {
+	var rejected []string
+	for _, r := range results {
+		if !r.Accepted() {
+			rejected = append(rejected, r.Recipient)
+		}
+	}
+	return rejected
+}
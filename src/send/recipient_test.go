@@ -0,0 +1,101 @@
+package send
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Sternisaea/gosend/src/authentication"
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/message"
+	"github.com/Sternisaea/gosend/src/secureconnection"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+func Test_SmtpSendRecipients(t *testing.T) {
+	server, err := startMailServer("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot start SMTP server: %s", err)
+	}
+	defer server.stop()
+	host, port, _ := net.SplitHostPort(server.address)
+	portNo, _ := strconv.Atoi(port)
+
+	skipRejected := message.RecipientPolicy{SkipRejected: true}
+	type recipientCheck struct {
+		name           string
+		policy         message.RecipientPolicy
+		to             []string
+		expectedCodes  []int
+		expectedData   bool
+		expectedErrors *[]error
+	}
+	checklist := []recipientCheck{
+		{name: "all accepted", to: []string{"alice@domain.local", "bob@domain.local"}, expectedCodes: []int{250, 250}, expectedData: true},
+		{name: "fail fast", to: []string{"alice@domain.local", "unknown@domain.local", "bob@domain.local"}, expectedCodes: []int{250, 550}, expectedErrors: &[]error{errors.New("550"), errors.New("No such user")}},
+		{name: "skip rejected", policy: skipRejected, to: []string{"alice@domain.local", "unknown@domain.local", "busy@domain.local"}, expectedCodes: []int{250, 550, 450}, expectedData: true, expectedErrors: &[]error{ErrPartialDelivery, errors.New("unknown@domain.local, busy@domain.local")}},
+		{name: "none accepted", policy: skipRejected, to: []string{"unknown@domain.local", "busy@domain.local"}, expectedCodes: []int{550, 450}, expectedErrors: &[]error{message.ErrTooFewAccepted, errors.New("0 of 2, 1 required")}},
+		{name: "minimum accepted", policy: message.RecipientPolicy{SkipRejected: true, MinAccepted: 2}, to: []string{"alice@domain.local", "unknown@domain.local", "bob@domain.local"}, expectedCodes: []int{250, 550, 250}, expectedData: true, expectedErrors: &[]error{ErrPartialDelivery}},
+		{name: "too few accepted", policy: message.RecipientPolicy{SkipRejected: true, MinAccepted: 2}, to: []string{"alice@domain.local", "unknown@domain.local"}, expectedCodes: []int{250, 550}, expectedErrors: &[]error{message.ErrTooFewAccepted, errors.New("1 of 2, 2 required")}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			st := &cmdflags.Settings{
+				Sender:   types.Email(mail.Address{Address: "sender@domain.local"}),
+				Subject:  c.name,
+				BodyText: "Recipients",
+			}
+			for _, to := range c.to {
+				st.RecipientsTo = append(st.RecipientsTo, types.Email(mail.Address{Address: to}))
+			}
+			conn := secureconnection.NewConnectNone(host, portNo)
+			conn.SetEhloName("client.domain.local")
+			s := NewSmtpSend(conn, authentication.NewAuthNone())
+			s.SetRecipientPolicy(c.policy)
+			if err := s.CreateMessage(st); err != nil {
+				t.Fatal(err)
+			}
+
+			err := s.SendMail(context.Background())
+			if got := server.lastData(); strings.Contains(got, "Subject: "+c.name) != c.expectedData {
+				t.Errorf("Expected message sent %t, got %q", c.expectedData, got)
+			}
+			if cont, err := checkError(err, c.expectedErrors); !cont && err != nil {
+				t.Fatal(err)
+			}
+
+			var codes []int
+			for _, r := range s.GetResults() {
+				codes = append(codes, r.Code)
+			}
+			if !reflect.DeepEqual(codes, c.expectedCodes) {
+				t.Errorf("Expected codes %v, got %v", c.expectedCodes, codes)
+			}
+		})
+	}
+}
+
+func Test_GetRecipientPolicy(t *testing.T) {
+	type policyCheck struct {
+		name     string
+		st       *cmdflags.Settings
+		expected message.RecipientPolicy
+	}
+	checklist := []policyCheck{
+		{name: "default", st: &cmdflags.Settings{}, expected: message.RecipientPolicy{}},
+		{name: "fail fast", st: &cmdflags.Settings{RecipientPolicy: types.FailFastPolicy, MinAccepted: 2}, expected: message.RecipientPolicy{MinAccepted: 2}},
+		{name: "skip rejected", st: &cmdflags.Settings{RecipientPolicy: types.SkipRejectedPolicy, MinAccepted: 3}, expected: message.RecipientPolicy{SkipRejected: true, MinAccepted: 3}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			if got := GetRecipientPolicy(c.st); got != c.expected {
+				t.Errorf("Expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
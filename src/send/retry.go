@@ -0,0 +1,110 @@
+package send
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/textproto"
+	"time"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+const (
+	DefaultRetryDelay = 5 * time.Second // Delay before the first retry when no delay is set
+	maxRetryDelay     = 24 * time.Hour  // Maximum delay between attempts, before jitter
+)
+
+// Random addition to the retry delay, can be replaced by tests
+var retryRandom = rand.Int64N
+
+// RetryPolicy sends the message again after a transient failure, with an exponentially increasing delay
+type RetryPolicy struct {
+	Attempts   int           // Maximum number of attempts, including the first
+	Delay      time.Duration // Delay before the first retry, doubled for every next retry
+	Jitter     time.Duration // Maximum random time added to every delay
+	MaxElapsed time.Duration // No retry is started after this time since the first attempt, zero means no limit
+}
+
+func GetRetryPolicy(st *cmdflags.Settings) RetryPolicy {
+	r := RetryPolicy{
+		Attempts:   int(st.RetryAttempts),
+		Delay:      st.RetryDelay.GetDuration(),
+		Jitter:     st.RetryJitter.GetDuration(),
+		MaxElapsed: st.RetryMaxElapsed.GetDuration(),
+	}
+	if r.Attempts == 0 {
+		r.Attempts = 1
+	}
+	if r.Delay == 0 {
+		r.Delay = DefaultRetryDelay
+	}
+	return r
+}
+
+// next returns the delay before the attempt following a failed attempt, or false when the message must not be sent again
+func (r RetryPolicy) next(attempt int, elapsed time.Duration, err error) (time.Duration, bool) {
+	if attempt >= r.Attempts || !IsTransient(err) {
+		return 0, false
+	}
+	delay := r.Delay
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRetryDelay)
+	if r.Jitter > 0 {
+		delay += time.Duration(retryRandom(int64(r.Jitter) + 1))
+	}
+	if r.MaxElapsed > 0 && elapsed+delay > r.MaxElapsed {
+		return 0, false
+	}
+	return delay, true
+}
+
+// IsTransient reports whether a failed attempt may succeed later: a 4xx reply of the server (RFC 5321 section 4.2.1),
+// or a connection that could not be made, was closed or timed out. A 5xx reply, a TLS failure and an aborted session are permanent.
+// A connection that was closed or timed out in the DATA phase without a reply is not retried either, as the server may have
+// received the complete message and delivered it.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	// The message has been sent to the accepted recipients
+	if errors.Is(err, ErrPartialDelivery) {
+		return false
+	}
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 400 && smtpErr.Code < 500
+	}
+	if isLostInData(err) {
+		return false
+	}
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isLostInData reports whether the session failed in the DATA phase without a reply of the server,
+// e.g. a closed connection or a timeout after the message data was sent, so the message may have been delivered
+func isLostInData(err error) bool {
+	var reply *textproto.Error
+	var phaseErr *types.PhaseError
+	return errors.As(err, &phaseErr) && (*phaseErr).Phase == types.DataPhase && !errors.As(err, &reply)
+}
+
+func isPermanent(err error) bool {
+	var smtpErr *textproto.Error
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 500
+}
@@ -0,0 +1,257 @@
+package send
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sternisaea/gosend/src/authentication"
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/message"
+	"github.com/Sternisaea/gosend/src/secureconnection"
+	"github.com/Sternisaea/gosend/src/types"
+	"github.com/Sternisaea/smtpservermock/src/smtpservermock"
+)
+
+var smtpRetryPort = types.TCPPort(40983)
+
+func Test_SmtpSendRetry(t *testing.T) {
+	mock, err := smtpservermock.NewSmtpServer(smtpservermock.NoSecurity, "Mock SMTP Server without security", getAddress("localhost", smtpRetryPort), "", "")
+	if err != nil {
+		t.Fatalf("Cannot initialise SMTP server without security: %s", err)
+	}
+	if err := mock.ListenAndServe(); err != nil {
+		t.Fatalf("Cannot start SMTP server without security: %s", err)
+	}
+	defer mock.Shutdown()
+
+	type retryCheck struct {
+		name           string
+		rejections     []string
+		retry          RetryPolicy
+		expectedLogs   int
+		expectedErrors *[]error
+	}
+	retry := RetryPolicy{Attempts: 3, Delay: 10 * time.Millisecond}
+	checklist := []retryCheck{
+		{name: "no rejection", retry: retry},
+		{name: "greeting 421 once", rejections: []string{"421"}, retry: retry, expectedLogs: 1},
+		{name: "mail 451 twice", rejections: []string{"451", "451"}, retry: retry, expectedLogs: 2},
+		{name: "connection closed", rejections: []string{"close"}, retry: retry, expectedLogs: 1},
+		{name: "attempts exceeded", rejections: []string{"451", "451", "451"}, retry: retry, expectedLogs: 2, expectedErrors: &[]error{errors.New("451")}},
+		{name: "permanent rejection", rejections: []string{"550"}, retry: retry, expectedErrors: &[]error{errors.New("550")}},
+		{name: "without retry policy", rejections: []string{"451"}, expectedErrors: &[]error{errors.New("451")}},
+		{name: "max elapsed", rejections: []string{"451"}, retry: RetryPolicy{Attempts: 3, Delay: time.Second, MaxElapsed: 500 * time.Millisecond}, expectedErrors: &[]error{errors.New("451")}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			front, err := startRejectingFront(getAddress("localhost", smtpRetryPort), c.rejections)
+			if err != nil {
+				t.Fatalf("Cannot start rejecting server: %s", err)
+			}
+			defer front.stop()
+
+			st := &cmdflags.Settings{
+				Sender:       types.Email(mail.Address{Address: "sender@domain.local"}),
+				RecipientsTo: types.EmailAddresses{types.Email(mail.Address{Address: "alice@domain.local"})},
+				Subject:      c.name,
+				BodyText:     "Retry",
+			}
+			s := NewSmtpSend(secureconnection.NewConnectNone("127.0.0.1", front.port), authentication.NewAuthNone())
+			s.SetRetry(c.retry)
+			var logs []string
+			s.SetLogger(func(format string, v ...any) {
+				logs = append(logs, fmt.Sprintf(format, v...))
+			})
+			if err := s.CreateMessage(st); err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.SendMail(context.Background())
+			if len(logs) != c.expectedLogs {
+				t.Errorf("Expected %d logged attempts, got %d: %v", c.expectedLogs, len(logs), logs)
+			}
+			if cont, err := checkError(err, c.expectedErrors); !cont {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			msg, err := mock.GetResultMessage(front.forwarded(), 1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains((*msg).Data, "Subject: "+c.name) {
+				t.Errorf("Expected message with subject %q, got %s", c.name, (*msg).Data)
+			}
+		})
+	}
+}
+
+func Test_RetryNext(t *testing.T) {
+	defer func(r func(int64) int64) { retryRandom = r }(retryRandom)
+	retryRandom = func(n int64) int64 { return n - 1 }
+
+	transient := &textproto.Error{Code: 451, Msg: "Try again later"}
+	type nextCheck struct {
+		name          string
+		retry         RetryPolicy
+		attempt       int
+		elapsed       time.Duration
+		err           error
+		expectedDelay time.Duration
+		expectedRetry bool
+	}
+	checklist := []nextCheck{
+		{name: "first retry", retry: RetryPolicy{Attempts: 5, Delay: time.Second}, attempt: 1, err: transient, expectedDelay: time.Second, expectedRetry: true},
+		{name: "third retry", retry: RetryPolicy{Attempts: 5, Delay: time.Second}, attempt: 3, err: transient, expectedDelay: 4 * time.Second, expectedRetry: true},
+		{name: "jitter", retry: RetryPolicy{Attempts: 5, Delay: time.Second, Jitter: 500 * time.Millisecond}, attempt: 2, err: transient, expectedDelay: 2500 * time.Millisecond, expectedRetry: true},
+		{name: "maximum delay", retry: RetryPolicy{Attempts: 100, Delay: time.Hour}, attempt: 99, err: transient, expectedDelay: 24 * time.Hour, expectedRetry: true},
+		{name: "maximum first delay", retry: RetryPolicy{Attempts: 3, Delay: 48 * time.Hour}, attempt: 1, err: transient, expectedDelay: 24 * time.Hour, expectedRetry: true},
+		{name: "last attempt", retry: RetryPolicy{Attempts: 3, Delay: time.Second}, attempt: 3, err: transient},
+		{name: "permanent", retry: RetryPolicy{Attempts: 3, Delay: time.Second}, attempt: 1, err: &textproto.Error{Code: 550, Msg: "No such user"}},
+		{name: "within max elapsed", retry: RetryPolicy{Attempts: 3, Delay: time.Second, MaxElapsed: time.Minute}, attempt: 1, elapsed: 59 * time.Second, err: transient, expectedDelay: time.Second, expectedRetry: true},
+		{name: "beyond max elapsed", retry: RetryPolicy{Attempts: 3, Delay: time.Second, MaxElapsed: time.Minute}, attempt: 1, elapsed: 59500 * time.Millisecond, err: transient},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			delay, retry := c.retry.next(c.attempt, c.elapsed, c.err)
+			if delay != c.expectedDelay || retry != c.expectedRetry {
+				t.Errorf("Expected %s %t, got %s %t", c.expectedDelay, c.expectedRetry, delay, retry)
+			}
+		})
+	}
+}
+
+func Test_IsTransient(t *testing.T) {
+	type transientCheck struct {
+		name     string
+		err      error
+		expected bool
+	}
+	checklist := []transientCheck{
+		{name: "421", err: &textproto.Error{Code: 421, Msg: "Service not available"}, expected: true},
+		{name: "451 wrapped", err: fmt.Errorf("rcpt: %w", &textproto.Error{Code: 451, Msg: "Try again later"}), expected: true},
+		{name: "535", err: &textproto.Error{Code: 535, Msg: "Authentication failed"}},
+		{name: "550", err: &textproto.Error{Code: 550, Msg: "No such user"}},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, expected: true},
+		{name: "connection closed", err: io.EOF, expected: true},
+		{name: "connection closed in mail", err: newSmtpError(types.MailPhase, &types.PhaseError{Phase: types.MailPhase, Err: io.EOF}), expected: true},
+		{name: "connection closed in data", err: newSmtpError(types.DataPhase, &types.PhaseError{Phase: types.DataPhase, Err: io.EOF})},
+		{name: "timeout in data", err: &types.PhaseError{Phase: types.DataPhase, Err: &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}}},
+		{name: "451 in data", err: newSmtpError(types.DataPhase, &types.PhaseError{Phase: types.DataPhase, Err: &textproto.Error{Code: 451, Msg: "Local error in processing"}}), expected: true},
+		{name: "unknown host", err: &net.DNSError{Err: "no such host", Name: "missing.local", IsNotFound: true}},
+		{name: "dns failure", err: &net.DNSError{Err: "server misbehaving", Name: "domain.local", IsTemporary: true}, expected: true},
+		{name: "aborted", err: fmt.Errorf("%w: %w", context.Canceled, io.EOF)},
+		{name: "starttls not supported", err: secureconnection.ErrStarttlsNotSupported},
+		{name: "partial delivery", err: fmt.Errorf("%w: %w", ErrPartialDelivery, &textproto.Error{Code: 452, Msg: "Mailbox full"})},
+		{name: "too few accepted", err: fmt.Errorf("%w: %w", message.ErrTooFewAccepted, &textproto.Error{Code: 450, Msg: "Mailbox busy"}), expected: true},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			if got := IsTransient(c.err); got != c.expected {
+				t.Errorf("Expected %t, got %t", c.expected, got)
+			}
+		})
+	}
+}
+
+// rejectingFront rejects the first connections as listed in rejections, and forwards the next connections to the SMTP server mock
+type rejectingFront struct {
+	port       int
+	stop       func() error
+	target     string
+	rejections []string
+	mu         sync.Mutex
+	count      int
+	lastLocal  string
+}
+
+func startRejectingFront(target string, rejections []string) (*rejectingFront, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &rejectingFront{port: listener.Addr().(*net.TCPAddr).Port, stop: listener.Close, target: target, rejections: rejections}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			i := f.count
+			f.count++
+			f.mu.Unlock()
+			if i < len(f.rejections) {
+				go reject(conn, f.rejections[i])
+			} else {
+				go f.forward(conn)
+			}
+		}
+	}()
+	return f, nil
+}
+
+// forwarded returns the local address of the last connection to the SMTP server mock
+func (f *rejectingFront) forwarded() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastLocal
+}
+
+func (f *rejectingFront) forward(conn net.Conn) {
+	defer conn.Close()
+	target, err := net.Dial("tcp", f.target)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	f.mu.Lock()
+	f.lastLocal = target.LocalAddr().String()
+	f.mu.Unlock()
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// reject closes the connection at once, replies 421 to the greeting, or replies with the code to MAIL
+func reject(conn net.Conn, code string) {
+	defer conn.Close()
+	switch code {
+	case "close":
+		return
+	case "421":
+		fmt.Fprintf(conn, "421 4.3.2 Service not available\r\n")
+		return
+	}
+	fmt.Fprintf(conn, "220 Rejecting SMTP Server\r\n")
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"):
+			fmt.Fprintf(conn, "250 Rejecting SMTP Server\r\n")
+		case strings.HasPrefix(cmd, "MAIL"):
+			fmt.Fprintf(conn, "%s Rejected\r\n", code)
+		case cmd == "QUIT":
+			fmt.Fprintf(conn, "221 Bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "503 Bad sequence of commands\r\n")
+		}
+	}
+}
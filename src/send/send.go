@@ -1,8 +1,10 @@
 package send
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/Sternisaea/gosend/src/authentication"
 	"github.com/Sternisaea/gosend/src/cmdflags"
@@ -16,13 +18,41 @@ type SmtpSend struct {
 	authentication authentication.SmtpAuthentication
 	message        *message.Message
 	localAddress   string
+	retry          RetryPolicy
+	recipients     message.RecipientPolicy
+	results        []message.RecipientResult
+	log            func(format string, v ...any)
 }
 
 func NewSmtpSend(conn secureconnection.SecureConnection, auth authentication.SmtpAuthentication) *SmtpSend {
 	return &SmtpSend{connection: conn, authentication: auth, message: nil}
 }
 
+// SetRetry sends the message again after a transient failure. Without retry policy the message is sent once.
+func (s *SmtpSend) SetRetry(retry RetryPolicy) {
+	(*s).retry = retry
+}
+
+// SetRecipientPolicy decides whether the message is sent to the accepted recipients when the server rejects others
+func (s *SmtpSend) SetRecipientPolicy(policy message.RecipientPolicy) {
+	(*s).recipients = policy
+}
+
+// SetLogger sets the function that reports failed attempts, e.g. log.Printf
+func (s *SmtpSend) SetLogger(log func(format string, v ...any)) {
+	(*s).log = log
+}
+
 func (s *SmtpSend) CreateMessage(st *cmdflags.Settings) error {
+	msg, err := createMessage(st)
+	if err != nil {
+		return err
+	}
+	(*s).message = msg
+	return nil
+}
+
+func createMessage(st *cmdflags.Settings) (*message.Message, error) {
 	msg := message.NewMessage()
 	msg.SetSender(st.Sender.GetMailAddress())
 	msg.SetRecipientTo(st.RecipientsTo.GetMailAddresses())
@@ -31,6 +61,10 @@ func (s *SmtpSend) CreateMessage(st *cmdflags.Settings) error {
 	msg.SetReplyTo(st.ReplyTo.GetMailAddresses())
 	msg.SetSubject(st.Subject)
 	msg.SetMessageId(st.MessageID)
+	msg.SetDsnReturn(st.DsnReturn.String())
+	msg.SetDsnEnvelopeId(st.DsnEnvelopeId.String())
+	msg.SetDsnNotify(st.DsnNotify)
+	msg.SetDsnOriginalRecipient(bool(st.DsnOrcpt))
 	for _, h := range st.Headers {
 		msg.AddCustomHeader(h.String())
 	}
@@ -38,11 +72,10 @@ func (s *SmtpSend) CreateMessage(st *cmdflags.Settings) error {
 	msg.SetBodyHtml(st.BodyHtml)
 	for _, a := range st.Attachments {
 		if _, err := msg.AddAttachment(a.String()); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	(*s).message = msg
-	return nil
+	return msg, nil
 }
 
 func (s *SmtpSend) CheckMessage() error {
@@ -50,41 +83,91 @@ func (s *SmtpSend) CheckMessage() error {
 	errMsgs = append(errMsgs, (*s).connection.Check())
 	errMsgs = append(errMsgs, (*s).authentication.Check())
 
-	// Check combinations for Security Protocol and Authentication Method
-	if (*s).connection.GetType() == types.NoSecurity {
-		if (*s).authentication.GetType() == types.PlainAuth && (*s).connection.GetHostName() != "localhost" {
-			errMsgs = append(errMsgs, fmt.Errorf("authentication method '%s' is only allowed on an secure connection", types.PlainAuth.String()))
-		}
-	} else {
-		if (*s).authentication.GetType() == types.NoAuthentication {
-			errMsgs = append(errMsgs, fmt.Errorf("authentication is required for security protocol '%s'", (*s).connection.GetType()))
-		}
+	// Check combinations for Security Protocol and Authentication Method. Whether an opportunistic session is encrypted is checked after connecting.
+	tls := (*s).connection.GetType() != types.NoSecurity
+	if err := authentication.CheckSecurity((*s).authentication.GetType(), tls, (*s).connection.GetHostName()); err != nil {
+		errMsgs = append(errMsgs, err)
+	}
+	if tls && (*s).connection.GetType() != types.OpportunisticSec && (*s).authentication.GetType() == types.NoAuthentication {
+		errMsgs = append(errMsgs, fmt.Errorf("authentication is required for security protocol '%s'", (*s).connection.GetType()))
 	}
 
 	errMsgs = append(errMsgs, (*s).message.CheckMessage())
 	return errors.Join(errMsgs...)
 }
 
-func (s *SmtpSend) SendMail() error {
+// SendMail sends the message in one SMTP session, which is aborted with QUIT when ctx is done.
+// After a transient failure a new session is started, as allowed by the retry policy.
+func (s *SmtpSend) SendMail(ctx context.Context) error {
 	if err := s.CheckMessage(); err != nil {
 		return err
 	}
 
-	client, close, addr, err := (*s).connection.ClientConnect()
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		(*s).results = nil
+		err := s.sendSession(ctx)
+		if err == nil {
+			return nil
+		}
+		delay, retry := (*s).retry.next(attempt, time.Since(start), err)
+		if !retry {
+			return err
+		}
+		s.logf("Attempt %d of %d failed: %s. Retrying in %s", attempt, (*s).retry.Attempts, err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return sessionError(ctx, err)
+		}
+	}
+}
+
+func (s *SmtpSend) sendSession(ctx context.Context) error {
+	client, close, addr, err := (*s).connection.ClientConnect(ctx)
 	if err != nil {
-		return err
+		return sessionError(ctx, err)
 	}
 	defer close()
 	(*s).localAddress = addr
 
-	if err := (*s).authentication.Authenticate(client); err != nil {
-		return err
+	server := authentication.GetServerCapabilities(client, (*s).connection.GetHostName())
+	if err := authentication.CheckSecurity((*s).authentication.GetType(), (*server).Tls, (*s).connection.GetHostName()); err != nil {
+		// The session may have continued without TLS
+		return newSmtpError(types.AuthPhase, err)
+	}
+	if err := (*s).authentication.Authenticate(ctx, client, server); err != nil {
+		return sessionError(ctx, newSmtpError(types.AuthPhase, err))
 	}
 
-	if err := (*s).message.SendContent(client); err != nil {
-		return err
+	results, err := (*s).message.SendContent(ctx, client, (*s).recipients)
+	(*s).results = smtpResults(results)
+	if err != nil {
+		return sessionError(ctx, err)
 	}
-	return nil
+	rejected := rejectedRecipients(results)
+	return deliveryError(len(results)-len(rejected), rejected, firstFailure(results))
+}
+
+func (s *SmtpSend) logf(format string, v ...any) {
+	if (*s).log != nil {
+		(*s).log(format, v...)
+	}
+}
+
+// sessionError returns err as SmtpError when it is marked with the phase of the session,
+// and adds the reason when the session was aborted, because an interrupted read or write only reports a timeout
+func sessionError(ctx context.Context, err error) error {
+	err = smtpError(err)
+	if ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+	return err
+}
+
+// GetResults returns the replies to RCPT of the last session, for the recipients that were tried
+func (s *SmtpSend) GetResults() []message.RecipientResult {
+	return (*s).results
 }
 
 func (s *SmtpSend) GetLocalAddress() string {
@@ -0,0 +1,211 @@
+package send
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Sternisaea/gosend/src/authentication"
+	"github.com/Sternisaea/gosend/src/certificates"
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/secureconnection"
+	"github.com/Sternisaea/gosend/src/types"
+	"github.com/Sternisaea/smtpservermock/src/smtpservermock"
+)
+
+func Test_SmtpSendOpportunistic(t *testing.T) {
+	cancelDns, err := startDns(net.ParseIP(dnsIP), int(dnsPort))
+	if err != nil {
+		t.Fatalf("Cannot start DNS server: %s", err)
+	}
+	defer cancelDns()
+	setDefaultResolver(fmt.Sprintf("%s:%d", dnsIP, dnsPort))
+
+	cert, key, err := certificates.CreateCertificate("Domain Local", "mail.domain.local")
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	defer os.Remove(key)
+	defer os.Remove(cert)
+
+	mockStarttls, err := smtpservermock.NewSmtpServer(smtpservermock.StartTlsSec, "Mock SMTP Server with STARTTLS", getAddress("localhost", smtpMxPort), cert, key)
+	if err != nil {
+		t.Fatalf("Cannot initialise SMTP server with STARTTLS: %s", err)
+	}
+	if err := mockStarttls.ListenAndServe(); err != nil {
+		t.Fatalf("Cannot start SMTP server with STARTTLS: %s", err)
+	}
+	defer mockStarttls.Shutdown()
+
+	mockNoTls, err := smtpservermock.NewSmtpServer(smtpservermock.NoSecurity, "Mock SMTP Server without security", getAddress("localhost", smtpNoTlsPort), "", "")
+	if err != nil {
+		t.Fatalf("Cannot initialise SMTP server without security: %s", err)
+	}
+	if err := mockNoTls.ListenAndServe(); err != nil {
+		t.Fatalf("Cannot start SMTP server without security: %s", err)
+	}
+	defer mockNoTls.Shutdown()
+
+	type sendCheck struct {
+		name                string
+		security            types.Security
+		port                types.TCPPort
+		method              types.AuthenticationMethod
+		expectedCheckErrors *[]error
+		expectedSendErrors  *[]error
+	}
+	checklist := []sendCheck{
+		{name: "opportunistic with tls", security: types.OpportunisticSec, port: smtpMxPort, method: types.PlainAuth},
+		{name: "opportunistic without tls", security: types.OpportunisticSec, port: smtpNoTlsPort, method: types.PlainAuth, expectedSendErrors: &[]error{authentication.ErrRequiresSecureConnection, errors.New("plain")}},
+		{name: "opportunistic without tls nor authentication", security: types.OpportunisticSec, port: smtpNoTlsPort},
+		{name: "no security", security: types.NoSecurity, port: smtpNoTlsPort, method: types.PlainAuth, expectedCheckErrors: &[]error{authentication.ErrRequiresSecureConnection}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			st := &cmdflags.Settings{
+				SmtpHost:       "mail.domain.local",
+				SmtpPort:       c.port,
+				Security:       c.security,
+				Authentication: c.method,
+				Login:          "user",
+				Password:       "secret",
+				Sender:         types.Email(mail.Address{Address: "sender@domain.local"}),
+				RecipientsTo:   types.EmailAddresses{types.Email(mail.Address{Address: "alice@domain.local"})},
+				Subject:        c.name,
+				BodyText:       "Opportunistic",
+			}
+			if c.port == smtpMxPort {
+				// A Root CA requires a verified TLS session, so it cannot be used with the server without STARTTLS
+				st.RootCA = types.FilePath(cert)
+			}
+			conn, err := secureconnection.GetSecureConnection(st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth, err := authentication.GetAuthentication(st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := NewSmtpSend(conn, auth)
+			if err := s.CreateMessage(st); err != nil {
+				t.Fatal(err)
+			}
+			if cont, err := checkError(s.CheckMessage(), c.expectedCheckErrors); !cont {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if cont, err := checkError(s.SendMail(context.Background()), c.expectedSendErrors); !cont && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func Test_SmtpSendOpportunisticUntrusted(t *testing.T) {
+	cancelDns, err := startDns(net.ParseIP(dnsIP), int(dnsPort))
+	if err != nil {
+		t.Fatalf("Cannot start DNS server: %s", err)
+	}
+	defer cancelDns()
+	setDefaultResolver(fmt.Sprintf("%s:%d", dnsIP, dnsPort))
+
+	// A server that presents a certificate no certificate authority vouches for, as a man-in-the-middle would
+	cert, key, err := certificates.CreateCertificate("Attacker", "mail.domain.local")
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	defer os.Remove(key)
+	defer os.Remove(cert)
+	keyPair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := startMailServer("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot start SMTP server: %s", err)
+	}
+	defer server.stop()
+	server.setTls(&tls.Config{Certificates: []tls.Certificate{keyPair}})
+	_, port, _ := net.SplitHostPort(server.address)
+	portNo, _ := strconv.Atoi(port)
+
+	st := &cmdflags.Settings{
+		SmtpHost:       "mail.domain.local",
+		SmtpPort:       types.TCPPort(portNo),
+		Security:       types.OpportunisticSec,
+		Authentication: types.PlainAuth,
+		Login:          "user",
+		Password:       "secret",
+		Sender:         types.Email(mail.Address{Address: "sender@domain.local"}),
+		RecipientsTo:   types.EmailAddresses{types.Email(mail.Address{Address: "alice@domain.local"})},
+		Subject:        "Untrusted",
+		BodyText:       "Opportunistic",
+	}
+	conn, err := secureconnection.GetSecureConnection(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := authentication.GetAuthentication(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSmtpSend(conn, auth)
+	if err := s.CreateMessage(st); err != nil {
+		t.Fatal(err)
+	}
+	err = s.SendMail(context.Background())
+	if cont, err := checkError(err, &[]error{errors.New("certificate signed by unknown authority")}); !cont && err != nil {
+		t.Fatal(err)
+	}
+	var smtpErr *SmtpError
+	if !errors.As(err, &smtpErr) || smtpErr.Phase != types.StartTlsPhase {
+		t.Errorf("Expected error in phase %s, got %v", types.StartTlsPhase, err)
+	}
+	if commands := server.authCommands(); len(commands) > 0 {
+		t.Errorf("Expected no credentials sent, got %q", commands)
+	}
+}
+
+func Test_SmtpSendLocalAddress(t *testing.T) {
+	mock, err := smtpservermock.NewSmtpServer(smtpservermock.NoSecurity, "Mock SMTP Server without security", getAddress("localhost", smtpRetryPort), "", "")
+	if err != nil {
+		t.Fatalf("Cannot initialise SMTP server without security: %s", err)
+	}
+	if err := mock.ListenAndServe(); err != nil {
+		t.Fatalf("Cannot start SMTP server without security: %s", err)
+	}
+	defer mock.Shutdown()
+	front, err := startRejectingFront(getAddress("localhost", smtpRetryPort), nil)
+	if err != nil {
+		t.Fatalf("Cannot start forwarding server: %s", err)
+	}
+	defer front.stop()
+
+	conn := secureconnection.NewConnectNone("127.0.0.1", front.port)
+	conn.SetSource(secureconnection.Source{Address: net.ParseIP("127.0.0.2"), Family: types.Ipv4Family})
+	s := NewSmtpSend(conn, authentication.NewAuthNone())
+	st := &cmdflags.Settings{
+		Sender:       types.Email(mail.Address{Address: "sender@domain.local"}),
+		RecipientsTo: types.EmailAddresses{types.Email(mail.Address{Address: "alice@domain.local"})},
+		Subject:      "Bind address",
+		BodyText:     "Bind address",
+	}
+	if err := s.CreateMessage(st); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendMail(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if local := s.GetLocalAddress(); !strings.HasPrefix(local, "127.0.0.2:") {
+		t.Errorf("Expected local address 127.0.0.2:<port>, got %s", local)
+	}
+}
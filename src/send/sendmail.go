@@ -0,0 +1,143 @@
+package send
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/message"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+const DefaultSendmailCommand = "/usr/sbin/sendmail -oi"
+
+// Time to wait for the output of sendmail after it has been ended, because child processes may keep standard error open
+const sendmailWaitDelay = 2 * time.Second
+
+var (
+	ErrSendmail         = errors.New("sendmail command failed")
+	ErrSendmailNotFound = errors.New("sendmail command not found")
+)
+
+// Names of the exit statuses of sendmail (sysexits.h)
+var sysexitNames = map[int]string{
+	64: "EX_USAGE",
+	65: "EX_DATAERR",
+	66: "EX_NOINPUT",
+	67: "EX_NOUSER",
+	68: "EX_NOHOST",
+	69: "EX_UNAVAILABLE",
+	70: "EX_SOFTWARE",
+	71: "EX_OSERR",
+	72: "EX_OSFILE",
+	73: "EX_CANTCREAT",
+	74: "EX_IOERR",
+	75: "EX_TEMPFAIL",
+	76: "EX_PROTOCOL",
+	77: "EX_NOPERM",
+	78: "EX_CONFIG",
+}
+
+// SendmailError is the failure of the sendmail command with its exit status and the output on standard error
+type SendmailError struct {
+	Command  string
+	ExitCode int // -1 when the command was ended by a signal
+	Stderr   string
+}
+
+func (e *SendmailError) Error() string {
+	status := fmt.Sprintf("exit status %d", (*e).ExitCode)
+	if (*e).ExitCode < 0 {
+		status = "terminated"
+	} else if name, ok := sysexitNames[(*e).ExitCode]; ok {
+		status += " (" + name + ")"
+	}
+	if (*e).Stderr == "" {
+		return fmt.Sprintf("%s: %s: %s", ErrSendmail, (*e).Command, status)
+	}
+	return fmt.Sprintf("%s: %s: %s: %s", ErrSendmail, (*e).Command, status, (*e).Stderr)
+}
+
+func (e *SendmailError) Unwrap() error {
+	return ErrSendmail
+}
+
+// SendmailSend hands the message to the local sendmail command, which delivers or queues it like the mail system of the host
+type SendmailSend struct {
+	command types.Command
+	message *message.Message
+}
+
+// NewSendmailSend creates a delivery by command, or by /usr/sbin/sendmail -oi when command is empty
+func NewSendmailSend(command types.Command) *SendmailSend {
+	if len(command) == 0 {
+		command.Set(DefaultSendmailCommand)
+	}
+	return &SendmailSend{command: command}
+}
+
+func (s *SendmailSend) CreateMessage(st *cmdflags.Settings) error {
+	msg, err := createMessage(st)
+	if err != nil {
+		return err
+	}
+	(*s).message = msg
+	return nil
+}
+
+func (s *SendmailSend) CheckMessage() error {
+	var errMsgs []error
+	if _, err := exec.LookPath((*s).command[0]); err != nil {
+		errMsgs = append(errMsgs, fmt.Errorf("%w: %w", ErrSendmailNotFound, err))
+	}
+	errMsgs = append(errMsgs, (*s).message.CheckMessage())
+	return errors.Join(errMsgs...)
+}
+
+// SendMail pipes the message to the command, with the sender as -f and the recipients as arguments.
+// With -t in the command, sendmail takes the recipients from the headers and removes the Bcc header.
+func (s *SendmailSend) SendMail(ctx context.Context) error {
+	if err := s.CheckMessage(); err != nil {
+		return err
+	}
+
+	args := slices.Clone((*s).command[1:])
+	fromHeaders := slices.Contains(args, "-t")
+	args = append(args, "-f", (*s).message.GetSender())
+	var content string
+	var err error
+	if fromHeaders {
+		content, err = (*s).message.GetContentWithBcc()
+	} else {
+		args = append(args, "--")
+		args = append(args, (*s).message.GetRecipients()...)
+		content, err = (*s).message.GetContent()
+	}
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, (*s).command[0], args...)
+	// Lines end with a newline on the local system
+	cmd.Stdin = strings.NewReader(strings.ReplaceAll(content, "\r\n", "\n"))
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = sendmailWaitDelay
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &exitErr):
+		err = &SendmailError{Command: (*s).command.String(), ExitCode: exitErr.ExitCode(), Stderr: strings.TrimSpace(stderr.String())}
+	default:
+		err = fmt.Errorf("%w: %s: %w", ErrSendmail, (*s).command, err)
+	}
+	return sessionError(ctx, err)
+}
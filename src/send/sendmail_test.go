@@ -0,0 +1,117 @@
+package send
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sternisaea/gosend/src/cmdflags"
+	"github.com/Sternisaea/gosend/src/types"
+)
+
+func Test_SendmailSend(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	messageFile := filepath.Join(dir, "message")
+
+	// The fake sendmail writes its arguments and the message to files, then exits with the status of its first argument
+	fake := filepath.Join(dir, "sendmail")
+	script := "#!/bin/sh\n" +
+		"status=$1; shift\n" +
+		"printf '%s\\n' \"$@\" > " + argsFile + "\n" +
+		"cat > " + messageFile + "\n" +
+		"if [ \"$status\" != 0 ]; then echo \"sendmail: fatal: status $status\" >&2; fi\n" +
+		"if [ \"$status\" = sleep ]; then exec sleep 5; fi\n" +
+		"exit $status\n"
+	if err := os.WriteFile(fake, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	type sendmailCheck struct {
+		name            string
+		command         string
+		timeout         time.Duration
+		expectedArgs    []string
+		expectedHeaders []string
+		expectedErrors  *[]error
+	}
+	checklist := []sendmailCheck{
+		{name: "envelope", command: fake + " 0 -oi", expectedArgs: []string{"-oi", "-f", "sender@domain.local", "--", "alice@domain.local", "bob@domain.local", "carol@domain.local"}, expectedHeaders: []string{"To: <alice@domain.local>\n", "Cc: <bob@domain.local>\n"}},
+		{name: "recipients from headers", command: fake + " 0 -oi -t", expectedArgs: []string{"-oi", "-t", "-f", "sender@domain.local"}, expectedHeaders: []string{"To: <alice@domain.local>\n", "Bcc: <carol@domain.local>\n"}},
+		{name: "unknown user", command: fake + " 67 -oi", expectedErrors: &[]error{ErrSendmail, errors.New("exit status 67 (EX_NOUSER): sendmail: fatal: status 67")}},
+		{name: "temporary failure", command: fake + " 75", expectedErrors: &[]error{ErrSendmail, errors.New("EX_TEMPFAIL")}},
+		{name: "aborted", command: fake + " sleep", timeout: 100 * time.Millisecond, expectedErrors: &[]error{context.DeadlineExceeded, errors.New("terminated")}},
+		{name: "not found", command: filepath.Join(dir, "missing") + " -oi", expectedErrors: &[]error{ErrSendmailNotFound}},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			os.Remove(argsFile)
+			os.Remove(messageFile)
+
+			st := &cmdflags.Settings{
+				Sender:        types.Email(mail.Address{Address: "sender@domain.local"}),
+				RecipientsTo:  types.EmailAddresses{types.Email(mail.Address{Address: "alice@domain.local"})},
+				RecipientsCC:  types.EmailAddresses{types.Email(mail.Address{Address: "bob@domain.local"})},
+				RecipientsBCC: types.EmailAddresses{types.Email(mail.Address{Address: "carol@domain.local"})},
+				Subject:       c.name,
+				BodyText:      "Sendmail",
+			}
+			if err := st.Sendmail.Set(c.command); err != nil {
+				t.Fatal(err)
+			}
+			s := NewSendmailSend(st.Sendmail)
+			if err := s.CreateMessage(st); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.Background()
+			if c.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, c.timeout)
+				defer cancel()
+			}
+			if cont, err := checkError(s.SendMail(ctx), c.expectedErrors); !cont {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			args, err := os.ReadFile(argsFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Fields(string(args)); !reflect.DeepEqual(got, c.expectedArgs) {
+				t.Errorf("Expected arguments %v, got %v", c.expectedArgs, got)
+			}
+			msg, err := os.ReadFile(messageFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(msg), "\r\n") {
+				t.Errorf("Expected lines ending with a newline only")
+			}
+			for _, h := range append(c.expectedHeaders, "Subject: "+c.name+"\n") {
+				if !strings.Contains(string(msg), h) {
+					t.Errorf("Expected header %q in message %s", h, msg)
+				}
+			}
+			if fromHeaders := strings.Contains(c.command, "-t"); !fromHeaders && strings.Contains(string(msg), "Bcc:") {
+				t.Errorf("Expected no Bcc header in message %s", msg)
+			}
+		})
+	}
+}
+
+func Test_NewSendmailSend(t *testing.T) {
+	s := NewSendmailSend(nil)
+	if got := (*s).command.String(); got != DefaultSendmailCommand {
+		t.Errorf("Expected %s, got %s", DefaultSendmailCommand, got)
+	}
+}
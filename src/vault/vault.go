@@ -0,0 +1,266 @@
+package vault
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	EnvVaultFile       = "GOSEND_VAULT"
+	EnvVaultPassphrase = "GOSEND_VAULT_PASSPHRASE"
+
+	// Prefix of a settings value that refers to a vault entry, e.g. password=vault:work-relay
+	ReferencePrefix = "vault:"
+
+	formatVersion = 1
+	kdfScrypt     = "scrypt"
+	saltLength    = 16
+)
+
+var (
+	ErrVaultExists      = errors.New("vault already exists")
+	ErrVaultNotFound    = errors.New("vault does not exist")
+	ErrVaultInvalid     = errors.New("invalid vault file")
+	ErrWrongPassphrase  = errors.New("wrong passphrase or corrupted vault")
+	ErrNoPassphrase     = errors.New("no passphrase provided")
+	ErrEntryNotFound    = errors.New("vault entry not found")
+	ErrNoEntryName      = errors.New("no vault entry name provided")
+	ErrUnsupportedCrypt = errors.New("unsupported vault encryption")
+)
+
+// Cost parameters of scrypt for new vaults (recommended interactive values). Existing vaults keep their own parameters.
+var (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Limits of the scrypt parameters accepted from a vault file, so a crafted file cannot exhaust memory or CPU.
+// With N 2^20 and r 8 scrypt takes 1 GiB of memory.
+const (
+	maxScryptN  = 1 << 20
+	maxScryptRP = 16
+)
+
+// vaultFile is the JSON layout on disk. The entries are encrypted as a whole, so entry names are not readable either.
+type vaultFile struct {
+	Version int       `json:"version"`
+	Kdf     kdfParams `json:"kdf"`
+	Nonce   []byte    `json:"nonce"`
+	Data    []byte    `json:"data"`
+}
+
+type kdfParams struct {
+	Name string `json:"name"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+type Vault struct {
+	path    string
+	kdf     kdfParams
+	key     []byte
+	entries map[string]string
+}
+
+// DefaultPath returns $GOSEND_VAULT or gosend/vault.json in the user configuration directory
+func DefaultPath() (string, error) {
+	if path := os.Getenv(EnvVaultFile); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gosend", "vault.json"), nil
+}
+
+// Create initialises a new empty vault at path, protected by passphrase
+func Create(path, passphrase string) (*Vault, error) {
+	if passphrase == "" {
+		return nil, ErrNoPassphrase
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrVaultExists, path)
+	}
+
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	v := &Vault{
+		path:    path,
+		kdf:     kdfParams{Name: kdfScrypt, Salt: salt, N: scryptN, R: scryptR, P: scryptP},
+		entries: make(map[string]string),
+	}
+	var err error
+	if (*v).key, err = deriveKey(passphrase, &(*v).kdf); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := v.Save(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Open reads and decrypts the vault at path
+func Open(path, passphrase string) (*Vault, error) {
+	if passphrase == "" {
+		return nil, ErrNoPassphrase
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", ErrVaultNotFound, path)
+		}
+		return nil, err
+	}
+	var vf vaultFile
+	if err := json.Unmarshal(content, &vf); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrVaultInvalid, err)
+	}
+	if vf.Version != formatVersion || vf.Kdf.Name != kdfScrypt {
+		return nil, fmt.Errorf("%w: version %d, key derivation %s", ErrUnsupportedCrypt, vf.Version, vf.Kdf.Name)
+	}
+
+	if err := vf.Kdf.check(); err != nil {
+		return nil, err
+	}
+
+	v := &Vault{path: path, kdf: vf.Kdf}
+	if (*v).key, err = deriveKey(passphrase, &(*v).kdf); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX((*v).key)
+	if err != nil {
+		return nil, err
+	}
+	if len(vf.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%w: invalid nonce", ErrVaultInvalid)
+	}
+	plain, err := aead.Open(nil, vf.Nonce, vf.Data, additionalData(&vf))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	if err := json.Unmarshal(plain, &(*v).entries); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrVaultInvalid, err)
+	}
+	if (*v).entries == nil {
+		(*v).entries = make(map[string]string)
+	}
+	return v, nil
+}
+
+func (v *Vault) Get(name string) (string, error) {
+	secret, ok := (*v).entries[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrEntryNotFound, name)
+	}
+	return secret, nil
+}
+
+// Set adds or replaces an entry. Call Save to store the change.
+func (v *Vault) Set(name, secret string) error {
+	if name == "" {
+		return ErrNoEntryName
+	}
+	(*v).entries[name] = secret
+	return nil
+}
+
+// Remove deletes an entry. Call Save to store the change.
+func (v *Vault) Remove(name string) error {
+	if _, ok := (*v).entries[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrEntryNotFound, name)
+	}
+	delete((*v).entries, name)
+	return nil
+}
+
+func (v *Vault) List() []string {
+	return slices.Sorted(maps.Keys((*v).entries))
+}
+
+// Save encrypts the entries with a fresh nonce and atomically replaces the vault file, readable for its owner only
+func (v *Vault) Save() error {
+	plain, err := json.Marshal((*v).entries)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX((*v).key)
+	if err != nil {
+		return err
+	}
+	vf := vaultFile{Version: formatVersion, Kdf: (*v).kdf, Nonce: make([]byte, aead.NonceSize())}
+	if _, err := rand.Read(vf.Nonce); err != nil {
+		return err
+	}
+	vf.Data = aead.Seal(nil, vf.Nonce, plain, additionalData(&vf))
+	content, err := json.MarshalIndent(vf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir((*v).path), "."+filepath.Base((*v).path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if err := tmpFile.Chmod(0600); err != nil {
+		return fmt.Errorf("failed to write file: %s", err)
+	}
+	if _, err := tmpFile.Write(append(content, '\n')); err != nil {
+		return fmt.Errorf("failed to write file: %s", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("failed to write file: %s", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %s", err)
+	}
+	if err := os.Rename(tmpFile.Name(), (*v).path); err != nil {
+		return fmt.Errorf("failed to write file: %s", err)
+	}
+	return nil
+}
+
+// check rejects scrypt parameters that scrypt does not accept or that exceed the limits
+func (kdf *kdfParams) check() error {
+	n, r, p := (*kdf).N, (*kdf).R, (*kdf).P
+	if n < 2 || n > maxScryptN || n&(n-1) != 0 {
+		return fmt.Errorf("%w: scrypt N %d is not a power of two up to %d", ErrVaultInvalid, n, maxScryptN)
+	}
+	if r < 1 || p < 1 || r > maxScryptRP/p {
+		return fmt.Errorf("%w: scrypt r %d and p %d, r*p must be at most %d", ErrVaultInvalid, r, p, maxScryptRP)
+	}
+	return nil
+}
+
+func deriveKey(passphrase string, kdf *kdfParams) ([]byte, error) {
+	key, err := scrypt.Key([]byte(passphrase), (*kdf).Salt, (*kdf).N, (*kdf).R, (*kdf).P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrVaultInvalid, err)
+	}
+	return key, nil
+}
+
+// additionalData binds the key derivation parameters to the ciphertext, so they cannot be altered unnoticed
+func additionalData(vf *vaultFile) []byte {
+	return []byte(fmt.Sprintf("gosend-vault:%d:%s:%x:%d:%d:%d", (*vf).Version, (*vf).Kdf.Name, (*vf).Kdf.Salt, (*vf).Kdf.N, (*vf).Kdf.R, (*vf).Kdf.P))
+}
@@ -0,0 +1,129 @@
+package vault
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_Vault(t *testing.T) {
+	scryptN = 1 << 10 // Keep the tests fast
+
+	path := filepath.Join(t.TempDir(), "gosend", "vault.json")
+	v, err := Create(path, "MyPassphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create(path, "MyPassphrase"); !errors.Is(err, ErrVaultExists) {
+		t.Errorf("Expected error %s, got %v", ErrVaultExists, err)
+	}
+
+	for name, secret := range map[string]string{"work-relay": "WorkSecret", "alerts": "秘密のパスワード", "token": "ya29.token"} {
+		if err := v.Set(name, secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.Set("", "NoName"); !errors.Is(err, ErrNoEntryName) {
+		t.Errorf("Expected error %s, got %v", ErrNoEntryName, err)
+	}
+	if err := v.Remove("token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Remove("token"); !errors.Is(err, ErrEntryNotFound) {
+		t.Errorf("Expected error %s, got %v", ErrEntryNotFound, err)
+	}
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected permissions 0600, got %o", perm)
+	}
+
+	if _, err := Open(path, "WrongPassphrase"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Expected error %s, got %v", ErrWrongPassphrase, err)
+	}
+	if _, err := Open(path, ""); !errors.Is(err, ErrNoPassphrase) {
+		t.Errorf("Expected error %s, got %v", ErrNoPassphrase, err)
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.json"), "MyPassphrase"); !errors.Is(err, ErrVaultNotFound) {
+		t.Errorf("Expected error %s, got %v", ErrVaultNotFound, err)
+	}
+
+	reopened, err := Open(path, "MyPassphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := reopened.List(); !reflect.DeepEqual(names, []string{"alerts", "work-relay"}) {
+		t.Errorf("Expected entries [alerts work-relay], got %v", names)
+	}
+	if secret, err := reopened.Get("alerts"); err != nil || secret != "秘密のパスワード" {
+		t.Errorf("Expected secret 秘密のパスワード, got %q (%v)", secret, err)
+	}
+	if _, err := reopened.Get("token"); !errors.Is(err, ErrEntryNotFound) {
+		t.Errorf("Expected error %s, got %v", ErrEntryNotFound, err)
+	}
+
+	// Tampering with the key derivation parameters must be detected
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := []byte(string(content))
+	for i := range tampered {
+		if string(tampered[i:i+6]) == `"n": 1` {
+			tampered[i+5] = '2'
+			break
+		}
+	}
+	if err := os.WriteFile(path, tampered, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, "MyPassphrase"); err == nil {
+		t.Errorf("Expected error for tampered vault, got no error")
+	}
+}
+
+func Test_KdfParams(t *testing.T) {
+	type kdfCheck struct {
+		name          string
+		n, r, p       int
+		expectedError error
+	}
+	checklist := []kdfCheck{
+		{name: "default", n: 1 << 15, r: 8, p: 1},
+		{name: "maximum", n: 1 << 20, r: 8, p: 2},
+		{name: "n too large", n: 1 << 21, r: 8, p: 1, expectedError: ErrVaultInvalid},
+		{name: "n not power of two", n: 1000, r: 8, p: 1, expectedError: ErrVaultInvalid},
+		{name: "n one", n: 1, r: 8, p: 1, expectedError: ErrVaultInvalid},
+		{name: "n negative", n: -(1 << 15), r: 8, p: 1, expectedError: ErrVaultInvalid},
+		{name: "r times p too large", n: 1 << 15, r: 8, p: 4, expectedError: ErrVaultInvalid},
+		{name: "r overflow", n: 1 << 15, r: 1 << 62, p: 4, expectedError: ErrVaultInvalid},
+		{name: "r zero", n: 1 << 15, r: 0, p: 1, expectedError: ErrVaultInvalid},
+		{name: "p zero", n: 1 << 15, r: 8, p: 0, expectedError: ErrVaultInvalid},
+	}
+	for _, c := range checklist {
+		t.Run(c.name, func(t *testing.T) {
+			kdf := kdfParams{Name: kdfScrypt, N: c.n, R: c.r, P: c.p}
+			if err := kdf.check(); !errors.Is(err, c.expectedError) {
+				t.Errorf("Expected error %v, got %v", c.expectedError, err)
+			}
+		})
+	}
+
+	// A vault file with excessive parameters is rejected before the key is derived
+	path := filepath.Join(t.TempDir(), "vault.json")
+	content := `{"version": 1, "kdf": {"name": "scrypt", "salt": "AAAAAAAAAAAAAAAAAAAAAA==", "n": 1073741824, "r": 8, "p": 1}, "nonce": "", "data": ""}`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, "MyPassphrase"); !errors.Is(err, ErrVaultInvalid) {
+		t.Errorf("Expected error %s, got %v", ErrVaultInvalid, err)
+	}
+}